@@ -0,0 +1,285 @@
+// Package agent implements a background process that keeps the unlocked encryption key
+// in memory, so that repeated commands don't have to ask for the passphrase.
+//
+// The agent listens on a Unix socket that only its owner can reach and answers one JSON
+// request per connection. The key is forgotten after an idle timeout, after a maximum
+// lifetime, or when the agent is locked.
+package agent
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// ErrNotRunning is returned by the client functions when no agent is listening
+var ErrNotRunning = errors.New("agent is not running")
+
+// ErrUnsupported is returned on platforms without Unix socket peer credentials
+var ErrUnsupported = errors.New("agent is not supported on this platform")
+
+// Default lifetimes of the cached key
+const (
+	DefaultIdleTimeout = 15 * time.Minute
+	DefaultMaxLifetime = 8 * time.Hour
+)
+
+// Request operations
+const (
+	opGet    = "get"
+	opStatus = "status"
+	opLock   = "lock"
+)
+
+// request is sent by the client, one per connection
+type request struct {
+	Op string `json:"op"`
+}
+
+// response is the agent's answer to a request
+type response struct {
+	OK     bool    `json:"ok"`
+	Error  string  `json:"error,omitempty"`
+	Key    string  `json:"key,omitempty"`
+	Status *Status `json:"status,omitempty"`
+}
+
+// Status describes a running agent
+type Status struct {
+	PID         int           `json:"pid"`
+	Started     time.Time     `json:"started"`
+	IdleTimeout time.Duration `json:"idle_timeout"`
+	MaxLifetime time.Duration `json:"max_lifetime"`
+	ExpiresAt   time.Time     `json:"expires_at"` // when the key is forgotten if the agent stays idle
+}
+
+// SocketPath returns the path of the agent socket: $LHKM_AGENT_SOCK if set,
+// otherwise lhkeymanager/agent.sock under $XDG_RUNTIME_DIR, falling back to a
+// per-user directory in the system temp directory
+func SocketPath() string {
+	if path := os.Getenv("LHKM_AGENT_SOCK"); path != "" {
+		return path
+	}
+	dir := os.Getenv("XDG_RUNTIME_DIR")
+	if dir == "" {
+		return filepath.Join(os.TempDir(), fmt.Sprintf("lhkeymanager-%d", os.Getuid()), "agent.sock")
+	}
+	return filepath.Join(dir, "lhkeymanager", "agent.sock")
+}
+
+// Server holds the key and answers requests
+type Server struct {
+	idleTimeout time.Duration
+	maxLifetime time.Duration
+
+	mu       sync.Mutex
+	key      []byte
+	started  time.Time
+	lastUsed time.Time
+	closed   bool
+	listener net.Listener
+	done     chan struct{}
+}
+
+// NewServer creates a server for a validated key
+// key: the key to hold; the server takes ownership and wipes it when it is done
+// idleTimeout: the key is forgotten if no client asks for it for this long
+// maxLifetime: the key is forgotten this long after the server was created, however busy it is
+func NewServer(key []byte, idleTimeout, maxLifetime time.Duration) *Server {
+	lockMemory(key)
+	now := time.Now()
+	return &Server{
+		idleTimeout: idleTimeout,
+		maxLifetime: maxLifetime,
+		key:         key,
+		started:     now,
+		lastUsed:    now,
+		done:        make(chan struct{}),
+	}
+}
+
+// Serve answers requests on the listener until the key expires or the agent is locked
+// Connections from other users are rejected.
+// Returns nil once the key has been forgotten
+func (s *Server) Serve(l net.Listener) error {
+	s.mu.Lock()
+	s.listener = l
+	s.mu.Unlock()
+
+	go s.expire()
+
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			select {
+			case <-s.done:
+				return nil
+			default:
+				return err
+			}
+		}
+		go s.handle(conn)
+	}
+}
+
+// Close forgets the key and stops the server
+func (s *Server) Close() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return
+	}
+	s.closed = true
+
+	for i := range s.key {
+		s.key[i] = 0
+	}
+	unlockMemory(s.key)
+	s.key = nil
+
+	close(s.done)
+	if s.listener != nil {
+		s.listener.Close()
+	}
+}
+
+// expire closes the server once the key's idle timeout or maximum lifetime has passed
+func (s *Server) expire() {
+	for {
+		s.mu.Lock()
+		wait := time.Until(s.expiresAt())
+		s.mu.Unlock()
+
+		if wait <= 0 {
+			s.Close()
+			return
+		}
+		select {
+		case <-time.After(wait):
+		case <-s.done:
+			return
+		}
+	}
+}
+
+// expiresAt returns when the key is forgotten if it isn't used again; s.mu must be held
+func (s *Server) expiresAt() time.Time {
+	idle := s.lastUsed.Add(s.idleTimeout)
+	if max := s.started.Add(s.maxLifetime); max.Before(idle) {
+		return max
+	}
+	return idle
+}
+
+// handle answers a single request
+func (s *Server) handle(conn net.Conn) {
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+	if err := checkPeer(conn); err != nil {
+		json.NewEncoder(conn).Encode(response{Error: err.Error()})
+		return
+	}
+
+	var req request
+	if err := json.NewDecoder(bufio.NewReader(conn)).Decode(&req); err != nil {
+		json.NewEncoder(conn).Encode(response{Error: "malformed request"})
+		return
+	}
+	json.NewEncoder(conn).Encode(s.answer(req))
+
+	// Answer first, so the client learns that the key is gone before the agent exits
+	if req.Op == opLock {
+		s.Close()
+	}
+}
+
+// answer executes a request
+func (s *Server) answer(req request) response {
+	if req.Op == opLock {
+		return response{OK: true}
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed || time.Now().After(s.expiresAt()) {
+		return response{Error: "key has expired"}
+	}
+
+	switch req.Op {
+	case opGet:
+		s.lastUsed = time.Now()
+		return response{OK: true, Key: string(s.key)}
+	case opStatus:
+		return response{OK: true, Status: &Status{
+			PID:         os.Getpid(),
+			Started:     s.started,
+			IdleTimeout: s.idleTimeout,
+			MaxLifetime: s.maxLifetime,
+			ExpiresAt:   s.expiresAt(),
+		}}
+	default:
+		return response{Error: fmt.Sprintf("unknown operation %q", req.Op)}
+	}
+}
+
+// GetKey asks the agent for the key and resets its idle timeout
+// socketPath: path of the agent socket
+// Returns ErrNotRunning if no agent is listening
+func GetKey(socketPath string) (string, error) {
+	resp, err := call(socketPath, opGet)
+	if err != nil {
+		return "", err
+	}
+	return resp.Key, nil
+}
+
+// GetStatus returns the status of the agent
+// socketPath: path of the agent socket
+// Returns ErrNotRunning if no agent is listening
+func GetStatus(socketPath string) (*Status, error) {
+	resp, err := call(socketPath, opStatus)
+	if err != nil {
+		return nil, err
+	}
+	if resp.Status == nil {
+		return nil, fmt.Errorf("agent sent no status")
+	}
+	return resp.Status, nil
+}
+
+// Lock makes the agent forget the key and exit
+// socketPath: path of the agent socket
+// Returns ErrNotRunning if no agent is listening
+func Lock(socketPath string) error {
+	_, err := call(socketPath, opLock)
+	return err
+}
+
+// call sends a request to the agent and reads its response
+func call(socketPath, op string) (*response, error) {
+	conn, err := dial(socketPath)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+	if err := json.NewEncoder(conn).Encode(request{Op: op}); err != nil {
+		return nil, fmt.Errorf("failed to send request: %w", err)
+	}
+	var resp response
+	if err := json.NewDecoder(bufio.NewReader(conn)).Decode(&resp); err != nil {
+		return nil, fmt.Errorf("failed to read response: %w", err)
+	}
+	if !resp.OK {
+		return nil, fmt.Errorf("agent: %s", resp.Error)
+	}
+	return &resp, nil
+}
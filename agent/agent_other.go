@@ -0,0 +1,28 @@
+//go:build !unix
+
+package agent
+
+import "net"
+
+// Listen is not supported on this platform
+func Listen(socketPath string) (net.Listener, error) {
+	return nil, ErrUnsupported
+}
+
+// dial is not supported on this platform
+func dial(socketPath string) (net.Conn, error) {
+	return nil, ErrUnsupported
+}
+
+// checkPeer rejects every connection on this platform
+func checkPeer(conn net.Conn) error {
+	return ErrUnsupported
+}
+
+// Spawn is not supported on this platform
+func Spawn(exe string, args []string, key string) error {
+	return ErrUnsupported
+}
+
+func lockMemory(b []byte)   {}
+func unlockMemory(b []byte) {}
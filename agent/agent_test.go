@@ -0,0 +1,192 @@
+//go:build unix
+
+package agent
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// startServer runs a server on a socket in a fresh directory
+func startServer(t *testing.T, key string, idle, max time.Duration) (string, *Server, chan error) {
+	t.Helper()
+	dir, err := os.MkdirTemp("", "agent")
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %v", err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+
+	socketPath := filepath.Join(dir, "run", "agent.sock")
+	l, err := Listen(socketPath)
+	if err != nil {
+		t.Fatalf("Listen failed: %v", err)
+	}
+
+	server := NewServer([]byte(key), idle, max)
+	errs := make(chan error, 1)
+	go func() { errs <- server.Serve(l) }()
+	t.Cleanup(server.Close)
+	return socketPath, server, errs
+}
+
+func TestAgent_GetStatusLock(t *testing.T) {
+	socketPath, _, errs := startServer(t, "lh-test-key-1234!@u", time.Minute, time.Hour)
+
+	info, err := os.Stat(socketPath)
+	if err != nil {
+		t.Fatalf("Failed to stat socket: %v", err)
+	}
+	if info.Mode().Perm()&0077 != 0 {
+		t.Errorf("Expected socket to be private, got %o", info.Mode().Perm())
+	}
+
+	key, err := GetKey(socketPath)
+	if err != nil || key != "lh-test-key-1234!@u" {
+		t.Fatalf("GetKey: expected key, got %q (%v)", key, err)
+	}
+
+	status, err := GetStatus(socketPath)
+	if err != nil {
+		t.Fatalf("GetStatus failed: %v", err)
+	}
+	if status.PID != os.Getpid() || status.IdleTimeout != time.Minute || status.MaxLifetime != time.Hour {
+		t.Errorf("Unexpected status: %+v", status)
+	}
+	if until := time.Until(status.ExpiresAt); until <= 0 || until > time.Minute {
+		t.Errorf("Expected expiry within the idle timeout, got %v", until)
+	}
+
+	if err := Lock(socketPath); err != nil {
+		t.Fatalf("Lock failed: %v", err)
+	}
+	select {
+	case err := <-errs:
+		if err != nil {
+			t.Errorf("Serve returned %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Serve didn't stop after Lock")
+	}
+
+	if _, err := GetKey(socketPath); !errors.Is(err, ErrNotRunning) {
+		t.Errorf("Expected ErrNotRunning after Lock, got %v", err)
+	}
+}
+
+func TestAgent_IdleTimeout(t *testing.T) {
+	socketPath, _, errs := startServer(t, "lh-test-key-1234!@u", 200*time.Millisecond, time.Hour)
+
+	select {
+	case <-errs:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Agent didn't expire after the idle timeout")
+	}
+	if _, err := GetKey(socketPath); !errors.Is(err, ErrNotRunning) {
+		t.Errorf("Expected ErrNotRunning after expiry, got %v", err)
+	}
+}
+
+func TestAgent_MaxLifetime(t *testing.T) {
+	socketPath, server, errs := startServer(t, "lh-test-key-1234!@u", time.Hour, 300*time.Millisecond)
+
+	// Using the key resets the idle timeout but not the maximum lifetime
+	for i := 0; i < 3; i++ {
+		GetKey(socketPath)
+		time.Sleep(50 * time.Millisecond)
+	}
+	select {
+	case <-errs:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Agent didn't expire after its maximum lifetime")
+	}
+
+	if server.key != nil {
+		t.Errorf("Expected key to be wiped")
+	}
+}
+
+func TestListen_RejectsSharedDirectory(t *testing.T) {
+	dir, err := os.MkdirTemp("", "agent")
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	if err := os.Chmod(dir, 0777); err != nil {
+		t.Fatalf("Failed to chmod: %v", err)
+	}
+
+	if _, err := Listen(filepath.Join(dir, "agent.sock")); err == nil {
+		t.Errorf("Expected error for a directory other users can access")
+	}
+}
+
+func TestDial_RejectsUntrustedSocket(t *testing.T) {
+	socketPath, _, _ := startServer(t, "lh-test-key-1234!@u", time.Minute, time.Hour)
+	dir := filepath.Dir(socketPath)
+
+	testCases := []struct {
+		name  string
+		path  string
+		perm  os.FileMode
+		chown bool
+	}{
+		{name: "Directory readable by others", path: dir, perm: 0755},
+		{name: "Socket writable by others", path: socketPath, perm: 0777},
+		{name: "Directory owned by another user", path: dir, perm: 0700, chown: true},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			if tc.chown {
+				if os.Getuid() != 0 {
+					t.Skip("changing the owner requires root")
+				}
+				if err := os.Chown(tc.path, 65534, 65534); err != nil {
+					t.Fatalf("Failed to chown: %v", err)
+				}
+				defer os.Chown(tc.path, os.Getuid(), os.Getgid())
+			}
+			info, err := os.Stat(tc.path)
+			if err != nil {
+				t.Fatalf("Failed to stat: %v", err)
+			}
+			if err := os.Chmod(tc.path, tc.perm); err != nil {
+				t.Fatalf("Failed to chmod: %v", err)
+			}
+			defer os.Chmod(tc.path, info.Mode().Perm())
+
+			_, err = GetStatus(socketPath)
+			if err == nil || errors.Is(err, ErrNotRunning) {
+				t.Errorf("Expected the socket to be rejected, got %v", err)
+			}
+		})
+	}
+
+	// Restored permissions are accepted again
+	if _, err := GetStatus(socketPath); err != nil {
+		t.Errorf("GetStatus failed: %v", err)
+	}
+}
+
+func TestListen_AlreadyRunning(t *testing.T) {
+	socketPath, _, _ := startServer(t, "lh-test-key-1234!@u", time.Minute, time.Hour)
+	if _, err := Listen(socketPath); err == nil {
+		t.Errorf("Expected error when an agent is already running")
+	}
+}
+
+func TestSocketPath(t *testing.T) {
+	t.Setenv("LHKM_AGENT_SOCK", "")
+	t.Setenv("XDG_RUNTIME_DIR", "/run/user/1000")
+	if path := SocketPath(); path != "/run/user/1000/lhkeymanager/agent.sock" {
+		t.Errorf("Unexpected socket path %q", path)
+	}
+
+	t.Setenv("LHKM_AGENT_SOCK", "/tmp/custom.sock")
+	if path := SocketPath(); path != "/tmp/custom.sock" {
+		t.Errorf("Expected LHKM_AGENT_SOCK to win, got %q", path)
+	}
+}
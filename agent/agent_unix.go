@@ -0,0 +1,153 @@
+//go:build unix
+
+package agent
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+// Listen creates the agent socket, readable and writable only by the current user
+// socketPath: path of the socket; its directory is created with permissions 0700
+// Returns an error if another agent is already listening on the path
+func Listen(socketPath string) (net.Listener, error) {
+	dir := filepath.Dir(socketPath)
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+
+	// Don't trust a directory that someone else can write to
+	if err := checkPrivate(dir); err != nil {
+		return nil, err
+	}
+
+	// Replace a socket left behind by an agent that didn't exit cleanly
+	if _, err := GetStatus(socketPath); err == nil {
+		return nil, fmt.Errorf("an agent is already running on %s", socketPath)
+	}
+	os.Remove(socketPath)
+
+	// Create the socket with permissions 0600 from the start
+	oldMask := syscall.Umask(0077)
+	l, err := net.Listen("unix", socketPath)
+	syscall.Umask(oldMask)
+	if err != nil {
+		return nil, err
+	}
+	l.(*net.UnixListener).SetUnlinkOnClose(true)
+	return l, nil
+}
+
+// dial connects to the agent socket. The socket and its directory must belong to the current
+// user and be private to them, and so must the process listening on it, or another user could
+// stand in for the agent and collect the key.
+func dial(socketPath string) (net.Conn, error) {
+	for _, path := range []string{filepath.Dir(socketPath), socketPath} {
+		if err := checkPrivate(path); err != nil {
+			if errors.Is(err, os.ErrNotExist) {
+				return nil, ErrNotRunning
+			}
+			return nil, err
+		}
+	}
+
+	conn, err := net.Dial("unix", socketPath)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) || errors.Is(err, syscall.ECONNREFUSED) {
+			return nil, ErrNotRunning
+		}
+		return nil, err
+	}
+	if err := checkPeer(conn); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("the agent on %s is not run by the current user: %w", socketPath, err)
+	}
+	return conn, nil
+}
+
+// checkPrivate requires path to be owned by the current user and not accessible by anyone else.
+// Symbolic links are not followed.
+func checkPrivate(path string) error {
+	info, err := os.Lstat(path)
+	if err != nil {
+		return err
+	}
+	if info.Mode()&os.ModeSymlink != 0 {
+		return fmt.Errorf("%s must not be a symbolic link", path)
+	}
+	if st, ok := info.Sys().(*syscall.Stat_t); ok && int(st.Uid) != os.Getuid() {
+		return fmt.Errorf("%s is not owned by the current user", path)
+	}
+	if info.Mode().Perm()&0077 != 0 {
+		return fmt.Errorf("%s must not be accessible by other users", path)
+	}
+	return nil
+}
+
+// checkPeer rejects connections from processes of other users
+func checkPeer(conn net.Conn) error {
+	unixConn, ok := conn.(*net.UnixConn)
+	if !ok {
+		return fmt.Errorf("not a unix socket connection")
+	}
+	raw, err := unixConn.SyscallConn()
+	if err != nil {
+		return err
+	}
+
+	var uid int
+	var credErr error
+	if err := raw.Control(func(fd uintptr) {
+		uid, credErr = peerUID(int(fd))
+	}); err != nil {
+		return err
+	}
+	if credErr != nil {
+		return fmt.Errorf("failed to read peer credentials: %w", credErr)
+	}
+	if uid != os.Getuid() {
+		return fmt.Errorf("permission denied")
+	}
+	return nil
+}
+
+// Spawn starts the agent in the background, detached from the terminal
+// exe: the executable to run
+// args: its arguments
+// key: written to the agent's standard input, so it never appears in the process list or environment
+func Spawn(exe string, args []string, key string) error {
+	cmd := exec.Command(exe, args...)
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setsid: true}
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return err
+	}
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+	_, err = stdin.Write([]byte(key))
+	stdin.Close()
+	cmd.Process.Release()
+	return err
+}
+
+// lockMemory keeps the key out of swap, if the memory lock limit allows it
+func lockMemory(b []byte) {
+	if len(b) > 0 {
+		unix.Mlock(b)
+	}
+}
+
+// unlockMemory releases a buffer locked by lockMemory
+func unlockMemory(b []byte) {
+	if len(b) > 0 {
+		unix.Munlock(b)
+	}
+}
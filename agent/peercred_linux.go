@@ -0,0 +1,12 @@
+package agent
+
+import "golang.org/x/sys/unix"
+
+// peerUID returns the user id of the process on the other end of a Unix socket
+func peerUID(fd int) (int, error) {
+	cred, err := unix.GetsockoptUcred(fd, unix.SOL_SOCKET, unix.SO_PEERCRED)
+	if err != nil {
+		return -1, err
+	}
+	return int(cred.Uid), nil
+}
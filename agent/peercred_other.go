@@ -0,0 +1,8 @@
+//go:build unix && !linux && !darwin && !freebsd
+
+package agent
+
+// peerUID is not implemented on this platform, so every connection is rejected
+func peerUID(fd int) (int, error) {
+	return -1, ErrUnsupported
+}
@@ -35,8 +35,12 @@ display_security_rules() {
 	echo -e "Required special characters: ${YELLOW}$required_chars${NC}"
 	echo -e "Minimum number of special characters: ${YELLOW}$min_special_chars${NC}"
 	echo -e "Required contained string: ${YELLOW}$key_contain${NC}"
+	echo -e "Minimum key entropy bits: ${YELLOW}$min_entropy_bits${NC}"
 	echo -e "Temporary key: ${YELLOW}${temp_key:-None}${NC}"
 	echo -e "Temporary key max usage: ${YELLOW}$temp_key_max_usage${NC}"
+	echo -e "Lockout threshold: ${YELLOW}$lockout_threshold${NC}"
+	echo -e "Lockout minutes: ${YELLOW}$lockout_minutes${NC}"
+	echo -e "Require MAC: ${YELLOW}$require_mac${NC}"
 	echo -e "Key hint: ${YELLOW}$key_hint${NC}"
 }
 
@@ -48,8 +52,12 @@ construct_ldflags() {
              -X 'github.com/clh021/lhkeymanager/core.RequiredChars=$required_chars' \
              -X 'github.com/clh021/lhkeymanager/core.MinSpecialChars=$min_special_chars' \
              -X 'github.com/clh021/lhkeymanager/core.KeyContain=$key_contain' \
+             -X 'github.com/clh021/lhkeymanager/core.MinEntropyBits=$min_entropy_bits' \
              -X 'github.com/clh021/lhkeymanager/core.TempKey=$temp_key' \
              -X 'github.com/clh021/lhkeymanager/core.TempKeyMaxUsage=$temp_key_max_usage' \
+             -X 'github.com/clh021/lhkeymanager/core.LockoutThreshold=$lockout_threshold' \
+             -X 'github.com/clh021/lhkeymanager/core.LockoutMinutes=$lockout_minutes' \
+             -X 'github.com/clh021/lhkeymanager/core.RequireMAC=$require_mac' \
              -X 'github.com/clh021/lhkeymanager/core.KeyHint=$key_hint' \
              -s -w"
 }
@@ -111,6 +119,11 @@ if [[ "$config_choice" == "1" ]]; then
 		key_contain=${key_contain:-key}
 	fi
 
+	# Ask for MinEntropyBits
+	echo -e "${YELLOW}Enter minimum key entropy in bits (default: 0, 0 disables the check):${NC}"
+	read -r min_entropy_bits
+	min_entropy_bits=${min_entropy_bits:-0}
+
 	# Ask for TempKey
 	echo -e "${YELLOW}Enter temporary key (default: None, enter 'empty' for none):${NC}"
 	read -r temp_key
@@ -123,6 +136,21 @@ if [[ "$config_choice" == "1" ]]; then
 	read -r temp_key_max_usage
 	temp_key_max_usage=${temp_key_max_usage:-2}
 
+	# Ask for LockoutThreshold
+	echo -e "${YELLOW}Enter the number of failed attempts that locks out every key (default: 0, 0 disables the lockout):${NC}"
+	read -r lockout_threshold
+	lockout_threshold=${lockout_threshold:-0}
+
+	# Ask for LockoutMinutes
+	echo -e "${YELLOW}Enter lockout duration in minutes (default: 15):${NC}"
+	read -r lockout_minutes
+	lockout_minutes=${lockout_minutes:-15}
+
+	# Ask for RequireMAC
+	echo -e "${YELLOW}Require an integrity trailer in every .env file (default: 0, 1 to require):${NC}"
+	read -r require_mac
+	require_mac=${require_mac:-0}
+
 	# Ask for KeyHint
 	echo -e "${YELLOW}Enter key hint (default: No hint available.):${NC}"
 	read -r key_hint
@@ -181,8 +209,12 @@ elif [[ "$config_choice" == "2" ]]; then
 	required_chars=$(get_config_value ".security_rules.required_chars" "!@#$%^&*")
 	min_special_chars=$(get_config_value ".security_rules.min_special_chars" "2")
 	key_contain=$(get_config_value ".security_rules.key_contain" "key")
+	min_entropy_bits=$(get_config_value ".security_rules.min_entropy_bits" "0")
 	temp_key=$(get_config_value ".security_rules.temp_key" "")
 	temp_key_max_usage=$(get_config_value ".security_rules.temp_key_max_usage" "2")
+	lockout_threshold=$(get_config_value ".security_rules.lockout_threshold" "0")
+	lockout_minutes=$(get_config_value ".security_rules.lockout_minutes" "15")
+	require_mac=$(get_config_value ".security_rules.require_mac" "0")
 	key_hint=$(get_config_value ".security_rules.key_hint" "No hint available.")
 
 	display_security_rules
@@ -35,8 +35,12 @@ display_security_rules() {
 	echo -e "必需的特殊字符: ${YELLOW}$required_chars${NC}"
 	echo -e "最小特殊字符数量: ${YELLOW}$min_special_chars${NC}"
 	echo -e "必需包含的字符串: ${YELLOW}$key_contain${NC}"
+	echo -e "最小密钥熵 (比特): ${YELLOW}$min_entropy_bits${NC}"
 	echo -e "临时密钥: ${YELLOW}${temp_key:-无}${NC}"
 	echo -e "临时密钥最大使用次数: ${YELLOW}$temp_key_max_usage${NC}"
+	echo -e "锁定阈值: ${YELLOW}$lockout_threshold${NC}"
+	echo -e "锁定分钟数: ${YELLOW}$lockout_minutes${NC}"
+	echo -e "要求完整性签名: ${YELLOW}$require_mac${NC}"
 	echo -e "密钥提示: ${YELLOW}$key_hint${NC}"
 }
 
@@ -48,8 +52,12 @@ construct_ldflags() {
              -X 'github.com/clh021/lhkeymanager/core.RequiredChars=$required_chars' \
              -X 'github.com/clh021/lhkeymanager/core.MinSpecialChars=$min_special_chars' \
              -X 'github.com/clh021/lhkeymanager/core.KeyContain=$key_contain' \
+             -X 'github.com/clh021/lhkeymanager/core.MinEntropyBits=$min_entropy_bits' \
              -X 'github.com/clh021/lhkeymanager/core.TempKey=$temp_key' \
              -X 'github.com/clh021/lhkeymanager/core.TempKeyMaxUsage=$temp_key_max_usage' \
+             -X 'github.com/clh021/lhkeymanager/core.LockoutThreshold=$lockout_threshold' \
+             -X 'github.com/clh021/lhkeymanager/core.LockoutMinutes=$lockout_minutes' \
+             -X 'github.com/clh021/lhkeymanager/core.RequireMAC=$require_mac' \
              -X 'github.com/clh021/lhkeymanager/core.KeyHint=$key_hint' \
              -s -w"
 }
@@ -111,6 +119,11 @@ if [[ "$config_choice" == "1" ]]; then
 		key_contain=${key_contain:-key}
 	fi
 
+	# 询问 MinEntropyBits
+	echo -e "${YELLOW}输入最小密钥熵 (比特) (默认: 0, 0 表示不检查):${NC}"
+	read -r min_entropy_bits
+	min_entropy_bits=${min_entropy_bits:-0}
+
 	# 询问 TempKey
 	echo -e "${YELLOW}输入临时密钥 (默认: 无, 输入 'empty' 表示无):${NC}"
 	read -r temp_key
@@ -123,6 +136,21 @@ if [[ "$config_choice" == "1" ]]; then
 	read -r temp_key_max_usage
 	temp_key_max_usage=${temp_key_max_usage:-2}
 
+	# 询问 LockoutThreshold
+	echo -e "${YELLOW}输入连续失败多少次后锁定所有密钥 (默认: 0, 0 表示不锁定):${NC}"
+	read -r lockout_threshold
+	lockout_threshold=${lockout_threshold:-0}
+
+	# 询问 LockoutMinutes
+	echo -e "${YELLOW}输入锁定持续的分钟数 (默认: 15):${NC}"
+	read -r lockout_minutes
+	lockout_minutes=${lockout_minutes:-15}
+
+	# 询问 RequireMAC
+	echo -e "${YELLOW}是否要求每个 .env 文件都有完整性签名 (默认: 0, 1 表示要求):${NC}"
+	read -r require_mac
+	require_mac=${require_mac:-0}
+
 	# 询问 KeyHint
 	echo -e "${YELLOW}输入密钥提示 (默认: 无提示):${NC}"
 	read -r key_hint
@@ -181,8 +209,12 @@ elif [[ "$config_choice" == "2" ]]; then
 	required_chars=$(get_config_value ".security_rules.required_chars" "!@#$%^&*")
 	min_special_chars=$(get_config_value ".security_rules.min_special_chars" "2")
 	key_contain=$(get_config_value ".security_rules.key_contain" "key")
+	min_entropy_bits=$(get_config_value ".security_rules.min_entropy_bits" "0")
 	temp_key=$(get_config_value ".security_rules.temp_key" "")
 	temp_key_max_usage=$(get_config_value ".security_rules.temp_key_max_usage" "2")
+	lockout_threshold=$(get_config_value ".security_rules.lockout_threshold" "0")
+	lockout_minutes=$(get_config_value ".security_rules.lockout_minutes" "15")
+	require_mac=$(get_config_value ".security_rules.require_mac" "0")
 	key_hint=$(get_config_value ".security_rules.key_hint" "No hint available.")
 
 	display_security_rules
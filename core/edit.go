@@ -0,0 +1,217 @@
+package core
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+
+	"github.com/clh021/lhkeymanager/utils"
+)
+
+// ErrEditSyntax is returned by EnvEdit.Save when the edited text is not valid dotenv syntax
+var ErrEditSyntax = errors.New("syntax error")
+
+// ErrDuplicateVariable is returned by OpenEnvEdit and EnvEdit.Save when a variable is defined more than once,
+// since the edit tracks values by name and couldn't tell the definitions apart
+var ErrDuplicateVariable = errors.New("variable is defined more than once")
+
+// ErrFileChanged is returned by EnvEdit.Save when the .env file was changed since it was opened
+var ErrFileChanged = errors.New("file was changed while editing")
+
+// EnvEdit is an .env file decrypted for editing
+type EnvEdit struct {
+	// Text is the file with every value decrypted, without the integrity trailer
+	Text string
+	// Skipped lists the encrypted values that don't decrypt; Text shows them as they are stored
+	Skipped []DecryptFailure
+
+	encryptionKey string
+	envFilePath   string
+	original      []byte            // the file content when opened, nil if the file didn't exist
+	base          string            // the stored file without the integrity trailer
+	signed        bool              // the file has an integrity trailer
+	names         []string          // the stored variables in file order
+	shown         map[string]string // value shown in Text, by name
+	stored        map[string]string // value stored in the file, by name
+}
+
+// EditResult lists the variables changed by an edit
+type EditResult struct {
+	Changed []string
+	Added   []string
+	Removed []string
+	Saved   bool   // false if the edit didn't change the file, e.g. only the quoting of a value
+	Backup  string // path of the copy of the previous content, "" if the file was new
+}
+
+// OpenEnvEdit decrypts the .env file for editing. A file that doesn't exist is opened empty.
+// encryptionKey: the key the file is encrypted with, also used for changed values
+// envFilePath: path to the .env file
+// Returns the edit, or an error if the key is invalid, the file fails its integrity check,
+// defines a variable more than once (ErrDuplicateVariable), or none of its encrypted values decrypt with the key
+func OpenEnvEdit(encryptionKey, envFilePath string) (*EnvEdit, error) {
+	if !ValidateKey(encryptionKey) {
+		return nil, fmt.Errorf("invalid encryption key")
+	}
+
+	e := &EnvEdit{
+		encryptionKey: encryptionKey,
+		envFilePath:   envFilePath,
+		shown:         make(map[string]string),
+		stored:        make(map[string]string),
+	}
+
+	content, err := os.ReadFile(envFilePath)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, fmt.Errorf("failed to read .env file: %w", err)
+	}
+	e.original = content
+
+	doc, err := utils.ParseEnvDocument(string(content))
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", envFilePath, err)
+	}
+	if content == nil {
+		// A new file is signed from the start if it has to be
+		e.signed, err = signatureRequired(envFilePath)
+	} else {
+		e.signed, err = verifyDocument(encryptionKey, envFilePath, doc)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", envFilePath, err)
+	}
+	doc.SetMAC("")
+	e.base = doc.String()
+
+	entries := doc.Entries()
+	if err := checkDuplicates(entries); err != nil {
+		return nil, fmt.Errorf("%s: %w", envFilePath, err)
+	}
+	encrypted, decrypted := 0, 0
+	_, err = doc.Update(func(name, value string) (string, error) {
+		// Update visits the variables in the same order as Entries
+		entry := entries[len(e.names)]
+		e.names = append(e.names, name)
+		e.stored[name], e.shown[name] = value, value
+		if !IsEncryptedValue(value) {
+			return value, nil
+		}
+
+		encrypted++
+		plaintext, err := DecryptValue(name, value, encryptionKey)
+		if err != nil {
+			// Shown as stored; left unchanged, it is kept as it is
+			e.Skipped = append(e.Skipped, DecryptFailure{Name: name, Line: entry.Line, Reason: classifyFailure(err), Err: err})
+			return value, nil
+		}
+		decrypted++
+		e.shown[name] = plaintext
+		return plaintext, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	// Values added with a wrong key could never be read together with the others
+	if encrypted > 0 && decrypted == 0 {
+		return nil, fmt.Errorf("no variables were successfully decrypted")
+	}
+
+	e.Text = doc.String()
+	return e, nil
+}
+
+// Save encrypts the edited text and writes it to the .env file. Values that weren't changed keep their
+// stored ciphertext; changed values of encrypted variables and the values of new variables are encrypted,
+// while plaintext variables stay plaintext. Values entered in encrypted form are kept as they are.
+// A signed file is signed again, and the previous content is kept as envFilePath + ".bak".
+// edited: the edited Text
+// Returns the changed variables, or an error wrapping ErrEditSyntax if the text can't be parsed or
+// defines a variable more than once, or ErrFileChanged if the file was changed since it was opened; nothing is written then
+func (e *EnvEdit) Save(edited string) (*EditResult, error) {
+	doc, err := utils.ParseEnvDocument(edited)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrEditSyntax, err)
+	}
+	if err := checkDuplicates(doc.Entries()); err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrEditSyntax, err)
+	}
+	// The trailer is recomputed below; an old one left in the text would be wrong
+	doc.SetMAC("")
+
+	result := &EditResult{}
+	seen := make(map[string]bool)
+	_, err = doc.Update(func(name, value string) (string, error) {
+		stored, existed := e.stored[name]
+		if !seen[name] {
+			seen[name] = true
+			switch {
+			case !existed:
+				result.Added = append(result.Added, name)
+			case value != e.shown[name]:
+				result.Changed = append(result.Changed, name)
+			}
+		}
+
+		switch {
+		case existed && value == e.shown[name]:
+			return stored, nil
+		case existed && !IsEncryptedValue(stored), IsEncryptedValue(value):
+			return value, nil
+		default:
+			return EncryptValue(name, value, e.encryptionKey)
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+	for _, name := range e.names {
+		if !seen[name] {
+			seen[name] = true
+			result.Removed = append(result.Removed, name)
+		}
+	}
+
+	// Nothing to write if the text was saved unchanged
+	if doc.String() == e.base {
+		return result, nil
+	}
+
+	current, err := os.ReadFile(e.envFilePath)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, fmt.Errorf("failed to read .env file: %w", err)
+	}
+	if !bytes.Equal(current, e.original) {
+		return nil, fmt.Errorf("%s: %w", e.envFilePath, ErrFileChanged)
+	}
+
+	if e.signed {
+		if err := signDocument(e.encryptionKey, e.envFilePath, doc); err != nil {
+			return nil, err
+		}
+	}
+	if e.original != nil {
+		if err := utils.BackupFile(e.envFilePath); err != nil {
+			return nil, fmt.Errorf("failed to create backup: %w", err)
+		}
+		result.Backup = e.envFilePath + ".bak"
+	}
+	if err := doc.Save(e.envFilePath); err != nil {
+		return nil, fmt.Errorf("failed to save .env file: %w", err)
+	}
+	result.Saved = true
+	return result, nil
+}
+
+// checkDuplicates returns an error wrapping ErrDuplicateVariable for the first variable defined twice
+func checkDuplicates(entries []utils.EnvEntry) error {
+	lines := make(map[string]int)
+	for _, entry := range entries {
+		if line, ok := lines[entry.Name]; ok {
+			return fmt.Errorf("%w: %s (lines %d and %d)", ErrDuplicateVariable, entry.Name, line, entry.Line)
+		}
+		lines[entry.Name] = entry.Line
+	}
+	return nil
+}
@@ -0,0 +1,176 @@
+package core
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestEnvEdit(t *testing.T) {
+	encryptionKey := "lh-test-key-1234!@u"
+	envFilePath := filepath.Join(t.TempDir(), ".env")
+
+	keep, err := EncryptValue("KEEP", "sk-keep", encryptionKey)
+	if err != nil {
+		t.Fatalf("EncryptValue failed: %v", err)
+	}
+	change, err := EncryptValue("CHANGE", "sk-old", encryptionKey)
+	if err != nil {
+		t.Fatalf("EncryptValue failed: %v", err)
+	}
+	drop, err := EncryptValue("DROP", "sk-drop", encryptionKey)
+	if err != nil {
+		t.Fatalf("EncryptValue failed: %v", err)
+	}
+	content := "# secrets\nKEEP=" + keep + "\nCHANGE=" + change + "\nDEBUG=false\nDROP=" + drop + "\n"
+	if err := os.WriteFile(envFilePath, []byte(content), 0600); err != nil {
+		t.Fatalf("Failed to write .env file: %v", err)
+	}
+	if err := SignFile(encryptionKey, envFilePath); err != nil {
+		t.Fatalf("SignFile failed: %v", err)
+	}
+
+	edit, err := OpenEnvEdit(encryptionKey, envFilePath)
+	if err != nil {
+		t.Fatalf("OpenEnvEdit failed: %v", err)
+	}
+	expected := "# secrets\nKEEP=sk-keep\nCHANGE=sk-old\nDEBUG=false\nDROP=sk-drop\n"
+	if edit.Text != expected {
+		t.Fatalf("Expected decrypted text %q, got %q", expected, edit.Text)
+	}
+
+	if _, err := edit.Save("KEEP=\"unterminated\n"); !errors.Is(err, ErrEditSyntax) {
+		t.Errorf("Expected ErrEditSyntax, got %v", err)
+	}
+
+	edited := "# secrets\nKEEP=sk-keep\nCHANGE=sk-new\nDEBUG=true\n# new\nNEW=sk-added\n"
+	result, err := edit.Save(edited)
+	if err != nil {
+		t.Fatalf("Save failed: %v", err)
+	}
+	want := &EditResult{
+		Changed: []string{"CHANGE", "DEBUG"},
+		Added:   []string{"NEW"},
+		Removed: []string{"DROP"},
+		Saved:   true,
+		Backup:  envFilePath + ".bak",
+	}
+	if !reflect.DeepEqual(result, want) {
+		t.Errorf("Expected %+v, got %+v", want, result)
+	}
+
+	saved, _ := os.ReadFile(envFilePath)
+	lines := strings.Split(string(saved), "\n")
+	// The unchanged value keeps its ciphertext, plaintext stays plaintext, new values are encrypted
+	if lines[1] != "KEEP="+keep || lines[3] != "DEBUG=true" || !strings.HasPrefix(lines[5], "NEW="+EncPrefix) {
+		t.Errorf("Unexpected content:\n%s", saved)
+	}
+	if strings.Contains(string(saved), "sk-new") || strings.Contains(string(saved), "sk-added") {
+		t.Errorf("Expected changed values to be encrypted:\n%s", saved)
+	}
+	if signed, err := VerifyFile(encryptionKey, envFilePath); !signed || err != nil {
+		t.Errorf("Expected the file to be signed again, got signed=%v err=%v", signed, err)
+	}
+	for name, value := range map[string]string{"CHANGE": "sk-new", "NEW": "sk-added"} {
+		if got, err := GetAPIKey(encryptionKey, name, envFilePath); err != nil || got != value {
+			t.Errorf("%s: expected %q, got %q (%v)", name, value, got, err)
+		}
+	}
+}
+
+func TestEnvEdit_Conflicts(t *testing.T) {
+	encryptionKey := "lh-test-key-1234!@u"
+	dir := t.TempDir()
+
+	// A new file starts empty and needs no backup
+	newPath := filepath.Join(dir, "new.env")
+	edit, err := OpenEnvEdit(encryptionKey, newPath)
+	if err != nil || edit.Text != "" {
+		t.Fatalf("Expected an empty edit, got %q (%v)", edit.Text, err)
+	}
+	result, err := edit.Save("API_KEY=sk-1\n")
+	if err != nil || !result.Saved || result.Backup != "" {
+		t.Fatalf("Expected the new file to be saved without backup, got %+v (%v)", result, err)
+	}
+
+	// Changes made by someone else during the edit are not overwritten
+	edit, err = OpenEnvEdit(encryptionKey, newPath)
+	if err != nil {
+		t.Fatalf("OpenEnvEdit failed: %v", err)
+	}
+	if err := os.WriteFile(newPath, []byte("OTHER=1\n"), 0600); err != nil {
+		t.Fatalf("Failed to write file: %v", err)
+	}
+	if _, err := edit.Save("API_KEY=sk-2\n"); !errors.Is(err, ErrFileChanged) {
+		t.Errorf("Expected ErrFileChanged, got %v", err)
+	}
+
+	// A file that was written by someone else is opened again: the new quoting of an encrypted
+	// value changes nothing, and a key that decrypts nothing is refused
+	if err := os.WriteFile(newPath, nil, 0600); err != nil {
+		t.Fatalf("Failed to write file: %v", err)
+	}
+	edit, err = OpenEnvEdit(encryptionKey, newPath)
+	if err != nil {
+		t.Fatalf("OpenEnvEdit failed: %v", err)
+	}
+	if _, err := edit.Save("API_KEY=sk-1\n"); err != nil {
+		t.Fatalf("Save failed: %v", err)
+	}
+	edit, err = OpenEnvEdit(encryptionKey, newPath)
+	if err != nil {
+		t.Fatalf("OpenEnvEdit failed: %v", err)
+	}
+	if result, err := edit.Save("API_KEY=\"sk-1\"\n"); err != nil || result.Saved {
+		t.Errorf("Expected nothing to be saved, got %+v (%v)", result, err)
+	}
+
+	if _, err := OpenEnvEdit("lh-other-key-1234!@u", newPath); err == nil {
+		t.Errorf("Expected error for a key that decrypts nothing")
+	}
+}
+
+func TestEnvEdit_DuplicateNames(t *testing.T) {
+	encryptionKey := "lh-test-key-1234!@u"
+	envFilePath := filepath.Join(t.TempDir(), ".env")
+
+	first, err := EncryptValue("API_KEY", "sk-first", encryptionKey)
+	if err != nil {
+		t.Fatalf("EncryptValue failed: %v", err)
+	}
+	second, err := EncryptValue("API_KEY", "sk-second", encryptionKey)
+	if err != nil {
+		t.Fatalf("EncryptValue failed: %v", err)
+	}
+	content := "API_KEY=" + first + "\nDEBUG=false\nAPI_KEY=" + second + "\n"
+	if err := os.WriteFile(envFilePath, []byte(content), 0600); err != nil {
+		t.Fatalf("Failed to write .env file: %v", err)
+	}
+
+	// Which definition a value belongs to can't be told apart by name, so the file is refused
+	if _, err := OpenEnvEdit(encryptionKey, envFilePath); !errors.Is(err, ErrDuplicateVariable) {
+		t.Fatalf("Expected ErrDuplicateVariable, got %v", err)
+	}
+	if data, err := os.ReadFile(envFilePath); err != nil || string(data) != content {
+		t.Errorf("Expected the file to be left alone, got %q (%v)", data, err)
+	}
+
+	// A duplicate added in the editor is a syntax error that can be fixed
+	if err := os.WriteFile(envFilePath, []byte("API_KEY="+first+"\n"), 0600); err != nil {
+		t.Fatalf("Failed to write .env file: %v", err)
+	}
+	edit, err := OpenEnvEdit(encryptionKey, envFilePath)
+	if err != nil {
+		t.Fatalf("OpenEnvEdit failed: %v", err)
+	}
+	_, err = edit.Save("API_KEY=sk-first\nAPI_KEY=sk-changed\n")
+	if !errors.Is(err, ErrEditSyntax) || !errors.Is(err, ErrDuplicateVariable) {
+		t.Errorf("Expected a duplicate syntax error, got %v", err)
+	}
+	if _, err := edit.Save("API_KEY=sk-changed\n"); err != nil {
+		t.Errorf("Save failed after removing the duplicate: %v", err)
+	}
+}
@@ -0,0 +1,151 @@
+package core
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/clh021/lhkeymanager/utils"
+)
+
+// Key derivation cost settings for newly encrypted values
+// These values can be overridden at build time using -ldflags.
+// Decryption always uses the settings stored in the value itself.
+
+// KDFTime is the Argon2id time cost (number of passes)
+var KDFTime = "3"
+
+// KDFMemory is the Argon2id memory cost in KiB
+var KDFMemory = "65536"
+
+// KDFThreads is the Argon2id degree of parallelism
+var KDFThreads = "4"
+
+// Prefixes of the supported ciphertext formats
+const (
+	// EncryptedPrefix starts every encrypted value, whatever its format version
+	EncryptedPrefix = "enc:"
+
+	// EncPrefix marks values encrypted with the current format: an Argon2id-derived key
+	// with the cost settings and salt stored in the value, and the variable name bound
+	// to the ciphertext as associated data so it cannot be moved to another variable
+	EncPrefix = "enc:AES256v4:"
+
+	// V3EncPrefix marks values with an Argon2id-derived key but no associated data
+	V3EncPrefix = "enc:AES256v3:"
+
+	// V2EncPrefix marks values encrypted with a random nonce but an unsalted SHA-256 key
+	V2EncPrefix = "enc:AES256v2:"
+
+	// LegacyEncPrefix marks values encrypted with the original fixed-nonce format
+	LegacyEncPrefix = "enc:AES256:"
+)
+
+// valueFormat describes one ciphertext format that can be decrypted
+type valueFormat struct {
+	prefix  string
+	legacy  bool // true if values in this format should be re-encrypted
+	decrypt func(name, data, key string) (string, error)
+}
+
+// valueFormats lists every supported format, newest first
+var valueFormats = []valueFormat{
+	{prefix: EncPrefix, decrypt: func(name, data, key string) (string, error) {
+		return utils.DecryptAES256KDF(data, key, associatedData(name))
+	}},
+	{prefix: V3EncPrefix, legacy: true, decrypt: func(name, data, key string) (string, error) {
+		return utils.DecryptAES256KDF(data, key, nil)
+	}},
+	{prefix: V2EncPrefix, legacy: true, decrypt: decryptUnbound},
+	// The legacy layout is nonce||ciphertext as well, only the nonce was fixed
+	{prefix: LegacyEncPrefix, legacy: true, decrypt: decryptUnbound},
+}
+
+// decryptUnbound decrypts the SHA-256 keyed formats, which don't bind the variable name
+func decryptUnbound(name, data, key string) (string, error) {
+	return utils.DecryptAES256(data, key)
+}
+
+// associatedData returns the data authenticated together with a value of the given variable
+func associatedData(name string) []byte {
+	return []byte(name)
+}
+
+// lookupFormat finds the format of an encrypted value
+func lookupFormat(value string) (valueFormat, bool) {
+	for _, f := range valueFormats {
+		if strings.HasPrefix(value, f.prefix) {
+			return f, true
+		}
+	}
+	return valueFormat{}, false
+}
+
+// Stored values are held to cost settings near the configured ones
+func init() {
+	utils.SetStoredKDFLimit(ConfiguredKDFParams())
+}
+
+// ConfiguredKDFParams returns the configured cost settings, falling back to the defaults on invalid input
+func ConfiguredKDFParams() utils.KDFParams {
+	params := utils.DefaultKDFParams
+	if t, err := strconv.ParseUint(KDFTime, 10, 32); err == nil {
+		params.Time = uint32(t)
+	}
+	if m, err := strconv.ParseUint(KDFMemory, 10, 32); err == nil {
+		params.Memory = uint32(m)
+	}
+	if p, err := strconv.ParseUint(KDFThreads, 10, 8); err == nil {
+		params.Threads = uint8(p)
+	}
+	if params.Validate() != nil {
+		return utils.DefaultKDFParams
+	}
+	return params
+}
+
+// ErrUnknownFormat is returned for encrypted values whose format version is not supported
+var ErrUnknownFormat = errors.New("unknown encryption format")
+
+// IsEncryptedValue reports whether a value from the .env file is encrypted.
+// Values with an unknown format version count as encrypted, so they are never used as plaintext.
+func IsEncryptedValue(value string) bool {
+	return strings.HasPrefix(value, EncryptedPrefix)
+}
+
+// IsLegacyValue reports whether a value uses an outdated format and should be re-encrypted
+func IsLegacyValue(value string) bool {
+	f, ok := lookupFormat(value)
+	return ok && f.legacy
+}
+
+// FormatName returns the prefix of an encrypted value's format, e.g. "enc:AES256v4",
+// or "" for plaintext values
+func FormatName(value string) string {
+	if f, ok := lookupFormat(value); ok {
+		return strings.TrimSuffix(f.prefix, ":")
+	}
+	if !IsEncryptedValue(value) {
+		return ""
+	}
+	// Unknown version: report the prefix as written
+	version, _, _ := strings.Cut(strings.TrimPrefix(value, EncryptedPrefix), ":")
+	return EncryptedPrefix + version
+}
+
+// DecryptValue decrypts a value in any supported format
+// name: the environment variable name the value belongs to
+// value: the full value from the .env file, including its format prefix
+// encryptionKey: the key to use for decryption
+// Returns the decrypted string or an error, also when the value was moved from another variable
+func DecryptValue(name, value, encryptionKey string) (string, error) {
+	if !IsEncryptedValue(value) {
+		return "", fmt.Errorf("value is not encrypted")
+	}
+	f, ok := lookupFormat(value)
+	if !ok {
+		return "", fmt.Errorf("%w %q", ErrUnknownFormat, FormatName(value))
+	}
+	return f.decrypt(name, strings.TrimPrefix(value, f.prefix), encryptionKey)
+}
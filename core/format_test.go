@@ -0,0 +1,139 @@
+package core
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/clh021/lhkeymanager/utils"
+)
+
+// legacyValue was produced by the original fixed-nonce implementation with the key "test-key-12345u"
+const legacyValue = "enc:AES256:AAECAwQFBgcICQoLoPermubQm+/vw6TIoKrFGOY9Gfu4O5JgH9XXjAW3GQ=="
+
+func TestEncryptValue_CurrentFormat(t *testing.T) {
+	encValue, err := EncryptValue("API_KEY", "sk-1234567890abcdef", "test-key-12345u")
+	if err != nil {
+		t.Fatalf("EncryptValue failed: %v", err)
+	}
+
+	if !strings.HasPrefix(encValue, EncPrefix) {
+		t.Errorf("Expected prefix %s, got %s", EncPrefix, encValue)
+	}
+	if IsLegacyValue(encValue) {
+		t.Errorf("Expected new value not to be reported as legacy")
+	}
+
+	decrypted, err := DecryptValue("API_KEY", encValue, "test-key-12345u")
+	if err != nil {
+		t.Fatalf("DecryptValue failed: %v", err)
+	}
+	if decrypted != "sk-1234567890abcdef" {
+		t.Errorf("Expected %q, got %q", "sk-1234567890abcdef", decrypted)
+	}
+}
+
+func TestDecryptValue_Legacy(t *testing.T) {
+	if !IsEncryptedValue(legacyValue) || !IsLegacyValue(legacyValue) {
+		t.Fatalf("Expected legacy value to be recognized")
+	}
+
+	decrypted, err := DecryptValue("OLD_KEY", legacyValue, "test-key-12345u")
+	if err != nil {
+		t.Fatalf("DecryptValue failed: %v", err)
+	}
+	if decrypted != "sk-legacy-value" {
+		t.Errorf("Expected %q, got %q", "sk-legacy-value", decrypted)
+	}
+
+	if _, err := DecryptValue("PLAIN", "plain-value", "test-key-12345u"); err == nil {
+		t.Errorf("Expected error when decrypting a plaintext value")
+	}
+}
+
+func TestLoadAPIKeys_LegacyEntries(t *testing.T) {
+	tempDir, err := os.MkdirTemp("", "keymanager_test")
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	envFilePath := filepath.Join(tempDir, ".env")
+
+	encValue, err := EncryptValue("NEW_KEY", "sk-new", "test-key-12345u")
+	if err != nil {
+		t.Fatalf("EncryptValue failed: %v", err)
+	}
+	content := "OLD_KEY=" + legacyValue + "\nNEW_KEY=" + encValue + "\nPLAIN=value\n"
+	if err := os.WriteFile(envFilePath, []byte(content), 0600); err != nil {
+		t.Fatalf("Failed to write .env file: %v", err)
+	}
+
+	// Both formats load side by side
+	result, err := loadAPIKeys("test-key-12345u", envFilePath)
+	if err != nil {
+		t.Fatalf("loadAPIKeys failed: %v", err)
+	}
+	if result.Vars["OLD_KEY"] != "sk-legacy-value" || result.Vars["NEW_KEY"] != "sk-new" {
+		t.Errorf("Unexpected decrypted values: %v", result.Vars)
+	}
+
+	if len(result.Legacy) != 1 || result.Legacy[0] != "OLD_KEY" {
+		t.Errorf("Expected [OLD_KEY], got %v", result.Legacy)
+	}
+}
+
+func TestDecryptValue_V2(t *testing.T) {
+	encrypted, err := utils.EncryptAES256("sk-v2-value", "test-key-12345u")
+	if err != nil {
+		t.Fatalf("EncryptAES256 failed: %v", err)
+	}
+	value := V2EncPrefix + encrypted
+
+	if !IsLegacyValue(value) {
+		t.Errorf("Expected v2 value to be reported as legacy")
+	}
+	decrypted, err := DecryptValue("V2_KEY", value, "test-key-12345u")
+	if err != nil {
+		t.Fatalf("DecryptValue failed: %v", err)
+	}
+	if decrypted != "sk-v2-value" {
+		t.Errorf("Expected %q, got %q", "sk-v2-value", decrypted)
+	}
+}
+
+func TestDecryptValue_V3(t *testing.T) {
+	encrypted, err := utils.EncryptAES256KDF("sk-v3-value", "test-key-12345u", ConfiguredKDFParams(), nil)
+	if err != nil {
+		t.Fatalf("EncryptAES256KDF failed: %v", err)
+	}
+	value := V3EncPrefix + encrypted
+
+	if !IsLegacyValue(value) {
+		t.Errorf("Expected v3 value to be reported as legacy")
+	}
+	decrypted, err := DecryptValue("V3_KEY", value, "test-key-12345u")
+	if err != nil {
+		t.Fatalf("DecryptValue failed: %v", err)
+	}
+	if decrypted != "sk-v3-value" {
+		t.Errorf("Expected %q, got %q", "sk-v3-value", decrypted)
+	}
+}
+
+func TestDecryptValue_BoundToName(t *testing.T) {
+	prod, err := EncryptValue("PROD_DB_PASSWORD", "prod-secret", "test-key-12345u")
+	if err != nil {
+		t.Fatalf("EncryptValue failed: %v", err)
+	}
+
+	// A ciphertext swapped into another variable must not decrypt
+	if _, err := DecryptValue("DEV_DB_PASSWORD", prod, "test-key-12345u"); err == nil {
+		t.Errorf("Expected error when decrypting a value under another variable name")
+	}
+	decrypted, err := DecryptValue("PROD_DB_PASSWORD", prod, "test-key-12345u")
+	if err != nil || decrypted != "prod-secret" {
+		t.Errorf("Expected %q, got %q (%v)", "prod-secret", decrypted, err)
+	}
+}
@@ -0,0 +1,142 @@
+package core
+
+import (
+	"fmt"
+	"path/filepath"
+	"slices"
+
+	"github.com/clh021/lhkeymanager/utils"
+)
+
+// ErrIntegrity is returned when the whole-file MAC of an .env file doesn't match its entries,
+// meaning lines were deleted, reordered, changed or injected since the file was signed
+var ErrIntegrity = utils.ErrMACMismatch
+
+// ErrUnsigned is returned when an .env file has no integrity trailer although it must have one,
+// because it was signed before or the policy sets require_mac. Removing the trailer must not be
+// a way to get injected lines loaded.
+var ErrUnsigned = fmt.Errorf("%w: integrity trailer is missing", ErrIntegrity)
+
+// SignFile adds or replaces the integrity trailer of the .env file
+// encryptionKey: the key the file is encrypted with
+// envFilePath: path to the .env file
+// The trailer covers the names, values and order of all entries.
+// Returns an error if the operation fails
+func SignFile(encryptionKey, envFilePath string) error {
+	doc, err := utils.LoadEnvDocument(envFilePath)
+	if err != nil {
+		return fmt.Errorf("failed to read .env file: %w", err)
+	}
+
+	if err := signDocument(encryptionKey, envFilePath, doc); err != nil {
+		return err
+	}
+
+	if err := doc.Save(envFilePath); err != nil {
+		return fmt.Errorf("failed to write file mac: %w", err)
+	}
+	return nil
+}
+
+// IsFileSigned reports whether the .env file has an integrity trailer
+func IsFileSigned(envFilePath string) (bool, error) {
+	doc, err := utils.LoadEnvDocument(envFilePath)
+	if err != nil {
+		return false, err
+	}
+	return doc.MAC() != "", nil
+}
+
+// VerifyFile checks the integrity trailer of the .env file
+// encryptionKey: the key the file is encrypted with
+// envFilePath: path to the .env file
+// Returns whether the file is signed, and an error wrapping ErrIntegrity if the trailer doesn't match
+// or is missing from a file that must be signed
+func VerifyFile(encryptionKey, envFilePath string) (bool, error) {
+	doc, err := utils.LoadEnvDocument(envFilePath)
+	if err != nil {
+		return false, fmt.Errorf("failed to read .env file: %w", err)
+	}
+
+	signed, err := verifyDocument(encryptionKey, envFilePath, doc)
+	if err != nil {
+		return signed, fmt.Errorf("%s: %w", envFilePath, err)
+	}
+	return signed, nil
+}
+
+// signDocument computes the integrity trailer over the document's entries and stores it in the document.
+// The file is remembered as signed, so that it can't be loaded without a trailer from now on.
+func signDocument(encryptionKey, envFilePath string, doc *utils.EnvDocument) error {
+	mac, err := utils.SignEnvEntries(doc.Entries(), encryptionKey, ConfiguredKDFParams())
+	if err != nil {
+		return fmt.Errorf("failed to compute file mac: %w", err)
+	}
+	if err := rememberSigned(envFilePath); err != nil {
+		return fmt.Errorf("failed to record signed file: %w", err)
+	}
+	doc.SetMAC(mac)
+	return nil
+}
+
+// verifyDocument checks the document's entries against its integrity trailer
+// Returns whether the document is signed, and ErrIntegrity if the trailer doesn't match,
+// or ErrUnsigned if there is none although the file must be signed
+func verifyDocument(encryptionKey, envFilePath string, doc *utils.EnvDocument) (bool, error) {
+	mac := doc.MAC()
+	if mac == "" {
+		required, err := signatureRequired(envFilePath)
+		if err != nil {
+			return false, err
+		}
+		if required {
+			return false, ErrUnsigned
+		}
+		return false, nil
+	}
+	return true, utils.VerifyEnvEntries(doc.Entries(), encryptionKey, mac)
+}
+
+// signatureRequired reports whether the .env file must have an integrity trailer: because the policy
+// sets require_mac, or because the file was signed before. New files at such a path are signed
+// from the start. If the policy or the state can't be read, the error is returned.
+func signatureRequired(envFilePath string) (bool, error) {
+	policy, err := LoadPolicy()
+	if err != nil {
+		return false, err
+	}
+	if policy.RequireMAC == 1 {
+		return true, nil
+	}
+
+	state, err := loadState()
+	if err != nil {
+		return false, err
+	}
+	return slices.Contains(state.SignedFiles, state.signedFileID(envFilePath)), nil
+}
+
+// rememberSigned records in the state that the .env file has been signed
+func rememberSigned(envFilePath string) error {
+	return updateState(func(state *stateFile) (bool, error) {
+		id := state.signedFileID(envFilePath)
+		if slices.Contains(state.SignedFiles, id) {
+			return false, nil
+		}
+		state.SignedFiles = append(state.SignedFiles, id)
+		return true, nil
+	})
+}
+
+// signedFileID returns the salted hash under which a signed file is remembered, so the
+// state doesn't list the paths of the user's files
+func (s *stateFile) signedFileID(envFilePath string) string {
+	path, err := filepath.Abs(envFilePath)
+	if err != nil {
+		path = envFilePath
+	}
+	if resolved, err := filepath.EvalSymlinks(path); err == nil {
+		path = resolved
+	}
+	return s.tempKeyID("signed-file:" + path)
+}
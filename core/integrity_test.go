@@ -0,0 +1,165 @@
+package core
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestSignAndVerifyFile(t *testing.T) {
+	// Create a temporary directory for testing
+	tempDir, err := os.MkdirTemp("", "keymanager_test")
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	envFilePath := filepath.Join(tempDir, ".env")
+	encryptionKey := "lh-test-key-1234!@u"
+
+	if _, err := StoreAPIKey("sk-first", "FIRST_KEY", encryptionKey, envFilePath); err != nil {
+		t.Fatalf("StoreAPIKey failed: %v", err)
+	}
+
+	// Unsigned files load as before
+	signed, err := VerifyFile(encryptionKey, envFilePath)
+	if err != nil || signed {
+		t.Fatalf("Expected unsigned file to verify, got signed=%v err=%v", signed, err)
+	}
+
+	if err := SignFile(encryptionKey, envFilePath); err != nil {
+		t.Fatalf("SignFile failed: %v", err)
+	}
+	signed, err = VerifyFile(encryptionKey, envFilePath)
+	if err != nil || !signed {
+		t.Fatalf("Expected signed file to verify, got signed=%v err=%v", signed, err)
+	}
+
+	// Storing another key keeps the mac up to date
+	if _, err := StoreAPIKey("sk-second", "SECOND_KEY", encryptionKey, envFilePath); err != nil {
+		t.Fatalf("StoreAPIKey failed: %v", err)
+	}
+	if _, err := LoadAPIKeysForTest(encryptionKey, envFilePath); err != nil {
+		t.Fatalf("Expected file to verify after store, got %v", err)
+	}
+
+	signedContent, err := os.ReadFile(envFilePath)
+	if err != nil {
+		t.Fatalf("Failed to read .env file: %v", err)
+	}
+	lines := strings.Split(string(signedContent), "\n")
+
+	testCases := []struct {
+		name    string
+		content string
+	}{
+		{name: "Injected plaintext line", content: "PATH=/tmp/evil\n" + string(signedContent)},
+		{name: "Deleted line", content: strings.Join(append([]string{lines[1]}, lines[2:]...), "\n")},
+		{name: "Reordered lines", content: strings.Join(append([]string{lines[1], lines[0]}, lines[2:]...), "\n")},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			if err := os.WriteFile(envFilePath, []byte(tc.content), 0600); err != nil {
+				t.Fatalf("Failed to write .env file: %v", err)
+			}
+			_, err := LoadAPIKeysForTest(encryptionKey, envFilePath)
+			if !errors.Is(err, ErrIntegrity) {
+				t.Errorf("Expected ErrIntegrity, got %v", err)
+			}
+
+			// Changes to a tampered file are refused instead of re-signing it
+			if _, err := StoreAPIKey("sk-third", "THIRD_KEY", encryptionKey, envFilePath); !errors.Is(err, ErrIntegrity) {
+				t.Errorf("Expected StoreAPIKey to refuse a tampered file, got %v", err)
+			}
+		})
+	}
+
+	// Rekeying keeps the file signed under the new key
+	if err := os.WriteFile(envFilePath, signedContent, 0600); err != nil {
+		t.Fatalf("Failed to write .env file: %v", err)
+	}
+	newKey := "lh-new-key-5678!@u"
+	if _, err := RekeyFile(encryptionKey, newKey, envFilePath); err != nil {
+		t.Fatalf("RekeyFile failed: %v", err)
+	}
+	signed, err = VerifyFile(newKey, envFilePath)
+	if err != nil || !signed {
+		t.Errorf("Expected rekeyed file to verify with the new key, got signed=%v err=%v", signed, err)
+	}
+}
+
+func TestVerifyFile_StrippedTrailer(t *testing.T) {
+	stateTestDir(t)
+	envFilePath := filepath.Join(t.TempDir(), ".env")
+	encryptionKey := "lh-test-key-1234!@u"
+
+	if _, err := StoreAPIKey("sk-first", "FIRST_KEY", encryptionKey, envFilePath); err != nil {
+		t.Fatalf("StoreAPIKey failed: %v", err)
+	}
+	if err := SignFile(encryptionKey, envFilePath); err != nil {
+		t.Fatalf("SignFile failed: %v", err)
+	}
+	signedContent, err := os.ReadFile(envFilePath)
+	if err != nil {
+		t.Fatalf("Failed to read .env file: %v", err)
+	}
+
+	// Removing the trailer together with an injected line must not turn verification off
+	var stripped []string
+	for _, line := range strings.Split(string(signedContent), "\n") {
+		if !strings.HasPrefix(line, "# lhkm-mac:") {
+			stripped = append(stripped, line)
+		}
+	}
+	content := "LD_PRELOAD=/tmp/evil.so\n" + strings.Join(stripped, "\n")
+	if err := os.WriteFile(envFilePath, []byte(content), 0600); err != nil {
+		t.Fatalf("Failed to write .env file: %v", err)
+	}
+
+	if _, err := LoadAPIKeysForTest(encryptionKey, envFilePath); !errors.Is(err, ErrUnsigned) || !errors.Is(err, ErrIntegrity) {
+		t.Errorf("Expected ErrUnsigned from LoadAPIKeys, got %v", err)
+	}
+	if _, err := GetAPIKey(encryptionKey, "FIRST_KEY", envFilePath); !errors.Is(err, ErrUnsigned) {
+		t.Errorf("Expected ErrUnsigned from GetAPIKey, got %v", err)
+	}
+	if _, err := StoreAPIKey("sk-second", "SECOND_KEY", encryptionKey, envFilePath); !errors.Is(err, ErrUnsigned) {
+		t.Errorf("Expected StoreAPIKey to refuse the unsigned file, got %v", err)
+	}
+
+	// A new file at the same path is signed from the start
+	if err := os.Remove(envFilePath); err != nil {
+		t.Fatalf("Failed to remove .env file: %v", err)
+	}
+	if _, err := StoreAPIKey("sk-third", "THIRD_KEY", encryptionKey, envFilePath); err != nil {
+		t.Fatalf("StoreAPIKey failed for a new file: %v", err)
+	}
+	if signed, err := VerifyFile(encryptionKey, envFilePath); err != nil || !signed {
+		t.Errorf("Expected the new file to be signed, got signed=%v err=%v", signed, err)
+	}
+}
+
+func TestVerifyFile_RequireMACPolicy(t *testing.T) {
+	stateTestDir(t)
+	dir := t.TempDir()
+	envFilePath := filepath.Join(dir, ".env")
+	encryptionKey := "lh-test-key-1234!@u"
+
+	if _, err := StoreAPIKey("sk-first", "FIRST_KEY", encryptionKey, envFilePath); err != nil {
+		t.Fatalf("StoreAPIKey failed: %v", err)
+	}
+
+	t.Setenv("LHKM_POLICY", writePolicy(t, dir, "policy.yml", "security_rules:\n  require_mac: 1\n"))
+	if _, err := LoadAPIKeysForTest(encryptionKey, envFilePath); !errors.Is(err, ErrUnsigned) {
+		t.Errorf("Expected ErrUnsigned for an unsigned file, got %v", err)
+	}
+
+	if err := SignFile(encryptionKey, envFilePath); err != nil {
+		t.Fatalf("SignFile failed: %v", err)
+	}
+	if _, err := LoadAPIKeysForTest(encryptionKey, envFilePath); err != nil {
+		t.Errorf("Expected the signed file to load, got %v", err)
+	}
+}
@@ -1,18 +1,18 @@
 package core
 
 import (
-	"encoding/json"
+	"errors"
 	"fmt"
-	"io"
 	"os"
-	"strconv"
+	"path"
 	"strings"
 
 	"github.com/clh021/lhkeymanager/utils"
 )
 
 // Security rules for encryption keys
-// These values can be overridden at build time using -ldflags
+// These values can be overridden at build time using -ldflags.
+// They form the built-in policy, which policy files can override at runtime (see LoadPolicy).
 
 // MinKeyLength is the minimum length required for encryption keys
 var MinKeyLength = "16"
@@ -32,99 +32,61 @@ var MinSpecialChars = "2"
 // KeyContain is a string that must be contained in the encryption key (empty means no specific string required)
 var KeyContain = "key"
 
+// MinEntropyBits is the minimum estimated entropy of encryption keys in bits (0 disables the check, see EstimateStrength)
+var MinEntropyBits = "0"
+
 // TempKey is a temporary key that is valid for a limited number of uses
 var TempKey = "" // Default: disabled
 
 // TempKeyMaxUsage is the maximum number of times the TempKey can be used
 var TempKeyMaxUsage = "2"
 
-// KeyHint is a hint to be displayed after multiple failed key entries
-var KeyHint = "No hint available."
+// LockoutThreshold is the number of failed key attempts that locks out every key (0 disables the lockout)
+var LockoutThreshold = "0"
 
-// stateFilePath is the path to the file storing usage counts for temporary keys
-const stateFilePath = ".lhkeymanager.state"
+// LockoutMinutes is how long the lockout lasts
+var LockoutMinutes = "15"
 
-// readState reads the usage state from the state file.
-func readState() (map[string]int, error) {
-	state := make(map[string]int)
-	file, err := os.Open(stateFilePath)
-	if err != nil {
-		if os.IsNotExist(err) {
-			return state, nil // File doesn't exist, return empty state
-		}
-		return nil, err
-	}
-	defer file.Close()
-
-	bytes, err := io.ReadAll(file)
-	if err != nil {
-		return nil, err
-	}
-
-	if len(bytes) == 0 {
-		return state, nil // File is empty, return empty state
-	}
+// RequireMAC makes an integrity trailer mandatory for every .env file when set to 1
+var RequireMAC = "0"
 
-	err = json.Unmarshal(bytes, &state)
-	if err != nil {
-		return nil, err
-	}
-	return state, nil
-}
+// KeyHint is a hint to be displayed after multiple failed key entries
+var KeyHint = "No hint available."
 
-// writeState writes the usage state to the state file.
-func writeState(state map[string]int) error {
-	bytes, err := json.Marshal(state)
+// ValidateKey validates the encryption key against the effective policy
+// key: encryption key to validate
+// Returns true if the key is valid, false otherwise. If the policy can't be loaded,
+// every key is rejected.
+func ValidateKey(key string) bool {
+	policy, err := LoadPolicy()
 	if err != nil {
-		return err
+		return false
 	}
-	return os.WriteFile(stateFilePath, bytes, 0600)
-}
 
-// ValidateKey validates the encryption key
-// key: encryption key to validate
-// Returns true if the key is valid, false otherwise
-func ValidateKey(key string) bool {
 	// First, try to validate against the main security rules
-	minKeyLength, _ := strconv.Atoi(MinKeyLength)
-	minSpecialChars, _ := strconv.Atoi(MinSpecialChars)
-	if ValidateKeyWithRules(key, minKeyLength, KeyPrefix, KeySuffix, RequiredChars, minSpecialChars, KeyContain) {
+	if policy.Check(key) {
 		return true
 	}
 
 	// If main validation fails, check for the temporary key
-	if TempKey == "" || key != TempKey {
+	if policy.TempKey == "" || key != policy.TempKey {
 		return false // Temp key is disabled or doesn't match
 	}
 
-	// Temp key matched, now check usage count
-	maxUsage, err := strconv.Atoi(TempKeyMaxUsage)
-	if err != nil {
-		maxUsage = 2 // Fallback to a safe default if parsing fails
-	}
-
-	state, err := readState()
-	if err != nil {
-		// If we can't read the state, we can't validate the temp key.
-		// For security, fail closed.
-		return false
-	}
-
-	usageCount := state[key]
-	if usageCount >= maxUsage {
-		return false // Exceeded max usage
-	}
-
-	// Increment usage count and save state
-	state[key] = usageCount + 1
-	err = writeState(state)
-	if err != nil {
-		// If we can't write the state, we can't guarantee the usage count is tracked.
-		// Fail closed to prevent unlimited use.
-		return false
-	}
+	// Temp key matched, now record the use. If the state can't be read, verified or written,
+	// the usage count can't be enforced, so fail closed.
+	allowed, err := useTempKey(key, policy.TempKeyMaxUsage)
+	return err == nil && allowed
+}
 
-	return true
+// ValidateMainKey validates a key against the main security rules of the effective policy only.
+// Unlike ValidateKey it never accepts the temporary key, so no use of it is recorded; it is meant
+// for keys that are being set, such as the new key of RekeyFile.
+// key: encryption key to validate
+// Returns true if the key satisfies the rules, false otherwise or if the policy can't be loaded
+func ValidateMainKey(key string) bool {
+	policy, err := LoadPolicy()
+	return err == nil && policy.Check(key)
 }
 
 // ValidateKeyWithRules validates the encryption key with custom rules
@@ -138,22 +100,40 @@ func ValidateKey(key string) bool {
 // contain: a string that must be contained in the key (empty means no specific string required)
 // Returns true if the key is valid, false otherwise
 func ValidateKeyWithRules(key string, minLength int, prefix, suffix, requiredChars string, minSpecialChars int, contain string) bool {
+	return len(ExplainKeyWithRules(key, minLength, prefix, suffix, requiredChars, minSpecialChars, contain)) == 0
+}
+
+// Violation describes a rule that a key doesn't satisfy.
+// It never contains the key itself, only counts derived from it.
+type Violation struct {
+	Rule string // the policy rule, e.g. "min_key_length"
+	Want int    // the required count, for min_key_length, min_special_chars and min_entropy_bits
+	Got  int    // the key's count, for min_key_length, min_special_chars and min_entropy_bits
+}
+
+// ExplainKeyWithRules checks the key against custom rules and lists every rule it breaks
+// The parameters are the same as for ValidateKeyWithRules.
+// Returns the violations in rule order, or nil if the key is valid
+func ExplainKeyWithRules(key string, minLength int, prefix, suffix, requiredChars string, minSpecialChars int, contain string) []Violation {
+	var violations []Violation
+
 	// Check minimum length
 	if len(key) < minLength {
-		return false
+		violations = append(violations, Violation{Rule: "min_key_length", Want: minLength, Got: len(key)})
 	}
 
 	// Check prefix if required
 	if prefix != "" && !strings.HasPrefix(key, prefix) {
-		return false
+		violations = append(violations, Violation{Rule: "key_prefix"})
 	}
 
 	// Check suffix if required
 	if suffix != "" && !strings.HasSuffix(key, suffix) {
-		return false
+		violations = append(violations, Violation{Rule: "key_suffix"})
 	}
 
-	// Check required characters if specified
+	// Check required characters if specified; without them minSpecialChars doesn't apply,
+	// which allows users to disable special character requirements
 	if requiredChars != "" {
 		specialCharCount := 0
 		for _, char := range requiredChars {
@@ -162,30 +142,28 @@ func ValidateKeyWithRules(key string, minLength int, prefix, suffix, requiredCha
 			}
 		}
 		if specialCharCount < minSpecialChars {
-			return false
+			violations = append(violations, Violation{Rule: "min_special_chars", Want: minSpecialChars, Got: specialCharCount})
 		}
-	} else {
-		// If no required characters are specified, don't check minSpecialChars
-		// This allows users to disable special character requirements
 	}
 
 	// Check if the key contains the required string
 	if contain != "" && !strings.Contains(key, contain) {
-		return false
+		violations = append(violations, Violation{Rule: "key_contain"})
 	}
 
-	return true
+	return violations
 }
 
 // EncryptValue encrypts a plaintext value and returns the full encrypted string.
+// The ciphertext is bound to name and only decrypts for the same variable name.
 // It does not perform key validation, assuming it's done by the caller.
-func EncryptValue(plaintext, encryptionKey string) (string, error) {
-	encrypted, err := utils.EncryptAES256(plaintext, encryptionKey)
+func EncryptValue(name, plaintext, encryptionKey string) (string, error) {
+	encrypted, err := utils.EncryptAES256KDF(plaintext, encryptionKey, ConfiguredKDFParams(), associatedData(name))
 	if err != nil {
 		return "", fmt.Errorf("encryption failed: %w", err)
 	}
 	// Format the encrypted value
-	encValue := fmt.Sprintf("enc:AES256:%s", encrypted)
+	encValue := EncPrefix + encrypted
 	return encValue, nil
 }
 
@@ -201,66 +179,414 @@ func StoreAPIKey(apiKey, envName, encryptionKey, envFilePath string) (string, er
 		return "", fmt.Errorf("invalid encryption key")
 	}
 
-	encValue, err := EncryptValue(apiKey, encryptionKey)
+	encValue, err := EncryptValue(envName, apiKey, encryptionKey)
 	if err != nil {
 		return "", err
 	}
 
-	// Save to .env file
-	err = utils.SaveToEnvFile(envName, encValue, envFilePath)
+	// A signed file must still verify before it is changed, otherwise re-signing
+	// would bless modifications made by someone else
+	var signed bool
+	doc, err := utils.LoadEnvDocument(envFilePath)
+	switch {
+	case os.IsNotExist(err):
+		// A new file is signed from the start if it has to be
+		doc = utils.NewEnvDocument()
+		signed, err = signatureRequired(envFilePath)
+	case err != nil:
+		return "", fmt.Errorf("failed to read .env file: %w", err)
+	default:
+		signed, err = verifyDocument(encryptionKey, envFilePath, doc)
+	}
 	if err != nil {
+		return "", fmt.Errorf("%s: %w", envFilePath, err)
+	}
+
+	// Update the variable in place, or append it if it's new
+	if err := doc.Set(envName, encValue); err != nil {
+		return "", fmt.Errorf("failed to save to .env file: %w", err)
+	}
+	if signed {
+		if err := signDocument(encryptionKey, envFilePath, doc); err != nil {
+			return "", err
+		}
+	}
+
+	// Save to .env file
+	if err := doc.Save(envFilePath); err != nil {
 		return "", fmt.Errorf("failed to save to .env file: %w", err)
 	}
 
 	return encValue, nil
 }
 
+// FailureReason classifies why a variable could not be decrypted
+type FailureReason string
+
+// Reasons reported in DecryptFailure
+const (
+	ReasonBadEncoding   FailureReason = "bad-encoding"   // the ciphertext is not valid base64
+	ReasonMalformed     FailureReason = "malformed"      // the ciphertext is truncated or its fields are invalid
+	ReasonAuthFailed    FailureReason = "auth-failed"    // wrong key, tampered value, or value moved from another variable
+	ReasonUnknownFormat FailureReason = "unknown-format" // the format version is not supported by this build
+)
+
+// DecryptFailure describes a variable that could not be decrypted
+type DecryptFailure struct {
+	Name   string
+	Line   int
+	Reason FailureReason
+	Err    error
+}
+
+func (f *DecryptFailure) Error() string {
+	return fmt.Sprintf("failed to decrypt %s (line %d): %v", f.Name, f.Line, f.Err)
+}
+
+func (f *DecryptFailure) Unwrap() error {
+	return f.Err
+}
+
+// ErrVariableNotFound is returned when the .env file doesn't define a requested variable
+var ErrVariableNotFound = errors.New("variable not found")
+
+// LoadResult is the outcome of loading an .env file
+type LoadResult struct {
+	// Vars maps environment variable names to decrypted (or plaintext) values
+	Vars map[string]string
+	// Names lists the loaded variables in file order
+	Names []string
+	// Failures lists the variables that were skipped because they could not be decrypted
+	Failures []DecryptFailure
+	// Legacy lists the decrypted variables that still use an outdated format
+	Legacy []string
+}
+
+// Filter keeps only the variables selected by name patterns
+// only: if not empty, a variable must match at least one of these patterns
+// exclude: a variable matching any of these patterns is dropped
+// Patterns use path.Match syntax, e.g. "AWS_*".
+// Returns an error if a pattern is malformed
+func (r *LoadResult) Filter(only, exclude []string) error {
+	for _, pattern := range append(append([]string{}, only...), exclude...) {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return fmt.Errorf("invalid pattern %q: %w", pattern, err)
+		}
+	}
+
+	names := r.Names[:0]
+	for _, name := range r.Names {
+		if (len(only) == 0 || matchAny(only, name)) && !matchAny(exclude, name) {
+			names = append(names, name)
+		} else {
+			delete(r.Vars, name)
+		}
+	}
+	r.Names = names
+	return nil
+}
+
+// matchAny reports whether name matches one of the patterns
+func matchAny(patterns []string, name string) bool {
+	for _, pattern := range patterns {
+		if ok, _ := path.Match(pattern, name); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// classifyFailure maps a decryption error to a FailureReason
+func classifyFailure(err error) FailureReason {
+	switch {
+	case errors.Is(err, utils.ErrBadEncoding):
+		return ReasonBadEncoding
+	case errors.Is(err, ErrUnknownFormat), errors.Is(err, utils.ErrUnsupported):
+		return ReasonUnknownFormat
+	case errors.Is(err, utils.ErrAuthFailed):
+		return ReasonAuthFailed
+	default:
+		return ReasonMalformed
+	}
+}
+
 // LoadAPIKeys loads and decrypts API keys from the .env file
 // encryptionKey: the key to use for decryption
 // envFilePath: path to the .env file
-// Returns a map of environment variable names to decrypted values and an error if the operation fails
-func LoadAPIKeys(encryptionKey, envFilePath string) (map[string]string, error) {
+// Returns the loaded variables together with the ones that failed to decrypt, and an error
+// if the operation fails. If no variable decrypts, the result is returned along with the error
+// so that the failures can still be reported.
+func LoadAPIKeys(encryptionKey, envFilePath string) (*LoadResult, error) {
 	// Validate the encryption key
 	if !ValidateKey(encryptionKey) {
 		return nil, fmt.Errorf("invalid encryption key")
 	}
 
+	return loadAPIKeys(encryptionKey, envFilePath)
+}
+
+// loadAPIKeys implements LoadAPIKeys without validating the key
+func loadAPIKeys(encryptionKey, envFilePath string) (*LoadResult, error) {
 	// Read the .env file
-	envVars, err := utils.ReadEnvFile(envFilePath)
+	doc, err := utils.LoadEnvDocument(envFilePath)
 	if err != nil {
 		return nil, fmt.Errorf("failed to read .env file: %w", err)
 	}
 
 	// Decrypt the encrypted values
-	decryptedVars := make(map[string]string)
+	result := &LoadResult{Vars: make(map[string]string)}
 	decryptionSuccess := false
 
-	for name, value := range envVars {
+	for _, entry := range doc.Entries() {
+		name, value := entry.Name, entry.Value
+		if _, seen := result.Vars[name]; !seen {
+			result.Names = append(result.Names, name)
+		}
+
 		// Check if the value is encrypted
-		if strings.HasPrefix(value, "enc:AES256:") {
-			encData := strings.TrimPrefix(value, "enc:AES256:")
+		if !IsEncryptedValue(value) {
+			// Non-encrypted value
+			result.Vars[name] = value
+			continue
+		}
 
-			// Decrypt
-			decrypted, err := utils.DecryptAES256(encData, encryptionKey)
-			if err != nil {
-				// Skip this variable if decryption fails
-				continue
-			}
+		// Decrypt
+		decrypted, err := DecryptValue(name, value, encryptionKey)
+		if err != nil {
+			// Skip this variable, but report why
+			result.Failures = append(result.Failures, DecryptFailure{
+				Name:   name,
+				Line:   entry.Line,
+				Reason: classifyFailure(err),
+				Err:    err,
+			})
+			continue
+		}
 
-			decryptionSuccess = true
+		decryptionSuccess = true
 
-			// Use the original environment variable name without cleaning
-			decryptedVars[name] = decrypted
-		} else {
-			// Non-encrypted value
-			decryptedVars[name] = value
+		// Use the original environment variable name without cleaning
+		result.Vars[name] = decrypted
+		if IsLegacyValue(value) {
+			result.Legacy = append(result.Legacy, name)
 		}
 	}
 
+	// Drop names that only ever failed to decrypt
+	names := result.Names[:0]
+	for _, name := range result.Names {
+		if _, ok := result.Vars[name]; ok {
+			names = append(names, name)
+		}
+	}
+	result.Names = names
+
 	// If no variables were successfully decrypted, return an error
 	if !decryptionSuccess {
-		return nil, fmt.Errorf("no variables were successfully decrypted")
+		return result, fmt.Errorf("no variables were successfully decrypted")
+	}
+
+	// Refuse to hand out anything from a file that fails its integrity check
+	if _, err := verifyDocument(encryptionKey, envFilePath, doc); err != nil {
+		return nil, fmt.Errorf("%s: %w", envFilePath, err)
+	}
+
+	return result, nil
+}
+
+// GetAPIKey decrypts a single variable of the .env file; the other values are left encrypted
+// encryptionKey: the key to use for decryption
+// name: the environment variable name
+// envFilePath: path to the .env file
+// Returns the value of the variable's last definition. The error wraps ErrVariableNotFound if the file
+// doesn't define it, is a *DecryptFailure if it can't be decrypted, and wraps ErrIntegrity if the file
+// fails its integrity check
+func GetAPIKey(encryptionKey, name, envFilePath string) (string, error) {
+	// Validate the encryption key
+	if !ValidateKey(encryptionKey) {
+		return "", fmt.Errorf("invalid encryption key")
+	}
+
+	doc, err := utils.LoadEnvDocument(envFilePath)
+	if err != nil {
+		return "", fmt.Errorf("failed to read .env file: %w", err)
+	}
+	if _, err := verifyDocument(encryptionKey, envFilePath, doc); err != nil {
+		return "", fmt.Errorf("%s: %w", envFilePath, err)
+	}
+
+	// Later definitions override earlier ones
+	entry, ok := lastEntry(doc, name)
+	if !ok {
+		return "", fmt.Errorf("%w: %s", ErrVariableNotFound, name)
+	}
+	if !IsEncryptedValue(entry.Value) {
+		return entry.Value, nil
 	}
 
-	return decryptedVars, nil
+	decrypted, err := DecryptValue(name, entry.Value, encryptionKey)
+	if err != nil {
+		return "", &DecryptFailure{Name: name, Line: entry.Line, Reason: classifyFailure(err), Err: err}
+	}
+	return decrypted, nil
+}
+
+// RemoveAPIKey removes every definition of a variable from the .env file
+// encryptionKey: the key the file is encrypted with
+// name: the environment variable name
+// envFilePath: path to the .env file
+// force: remove the variable even if its value doesn't decrypt with the key
+// The key is required so that a signed file can be verified before and re-signed after the change;
+// unless forced, the removed value must decrypt with it. The previous content is kept as envFilePath + ".bak".
+// Returns an error wrapping ErrVariableNotFound if the file doesn't define the variable,
+// a *DecryptFailure if its value doesn't decrypt, or an error if the operation fails
+func RemoveAPIKey(encryptionKey, name, envFilePath string, force bool) error {
+	return editEnvFile(encryptionKey, envFilePath, func(doc *utils.EnvDocument) error {
+		entry, ok := lastEntry(doc, name)
+		if !ok {
+			return fmt.Errorf("%w: %s", ErrVariableNotFound, name)
+		}
+		if IsEncryptedValue(entry.Value) && !force {
+			if _, err := DecryptValue(name, entry.Value, encryptionKey); err != nil {
+				return &DecryptFailure{Name: name, Line: entry.Line, Reason: classifyFailure(err), Err: err}
+			}
+		}
+		doc.Delete(name)
+		return nil
+	})
+}
+
+// RenameAPIKey renames a variable in the .env file, keeping its position
+// encryptionKey: the key the file is encrypted with
+// oldName, newName: the current and the new environment variable name
+// envFilePath: path to the .env file
+// An encrypted value is bound to its variable name, so it is decrypted and encrypted again for the new name.
+// The previous content is kept as envFilePath + ".bak".
+// Returns an error wrapping ErrVariableNotFound if the file doesn't define oldName,
+// a *DecryptFailure if its value doesn't decrypt, or an error if newName is invalid or taken
+func RenameAPIKey(encryptionKey, oldName, newName, envFilePath string) error {
+	return editEnvFile(encryptionKey, envFilePath, func(doc *utils.EnvDocument) error {
+		entry, ok := lastEntry(doc, oldName)
+		if !ok {
+			return fmt.Errorf("%w: %s", ErrVariableNotFound, oldName)
+		}
+
+		value := entry.Value
+		if IsEncryptedValue(value) {
+			decrypted, err := DecryptValue(oldName, value, encryptionKey)
+			if err != nil {
+				return &DecryptFailure{Name: oldName, Line: entry.Line, Reason: classifyFailure(err), Err: err}
+			}
+			if value, err = EncryptValue(newName, decrypted, encryptionKey); err != nil {
+				return err
+			}
+		}
+
+		if err := doc.Rename(oldName, newName); err != nil {
+			return err
+		}
+		return doc.Set(newName, value)
+	})
+}
+
+// lastEntry returns the last definition of a variable in the document
+func lastEntry(doc *utils.EnvDocument, name string) (utils.EnvEntry, bool) {
+	var entry utils.EnvEntry
+	found := false
+	for _, e := range doc.Entries() {
+		if e.Name == name {
+			entry, found = e, true
+		}
+	}
+	return entry, found
+}
+
+// editEnvFile applies a change to the .env file after validating the key and verifying the file.
+// A signed file is signed again, the previous content is kept as envFilePath + ".bak",
+// and the file is replaced atomically. Nothing is written if edit fails.
+func editEnvFile(encryptionKey, envFilePath string, edit func(doc *utils.EnvDocument) error) error {
+	if !ValidateKey(encryptionKey) {
+		return fmt.Errorf("invalid encryption key")
+	}
+
+	doc, err := utils.LoadEnvDocument(envFilePath)
+	if err != nil {
+		return fmt.Errorf("failed to read .env file: %w", err)
+	}
+	signed, err := verifyDocument(encryptionKey, envFilePath, doc)
+	if err != nil {
+		return fmt.Errorf("%s: %w", envFilePath, err)
+	}
+
+	if err := edit(doc); err != nil {
+		return err
+	}
+	if signed {
+		if err := signDocument(encryptionKey, envFilePath, doc); err != nil {
+			return err
+		}
+	}
+
+	if err := utils.BackupFile(envFilePath); err != nil {
+		return fmt.Errorf("failed to create backup: %w", err)
+	}
+	if err := doc.Save(envFilePath); err != nil {
+		return fmt.Errorf("failed to save .env file: %w", err)
+	}
+	return nil
+}
+
+// RekeyFile re-encrypts every encrypted value in the .env file with a new key
+// oldKey: the key the values are currently encrypted with
+// newKey: the key to encrypt the values with
+// envFilePath: path to the .env file
+// Plaintext values and comments are left untouched. If any value fails to decrypt,
+// the file is not modified. The previous content is kept as envFilePath + ".bak".
+// Returns the number of re-encrypted values and an error if the operation fails
+func RekeyFile(oldKey, newKey, envFilePath string) (int, error) {
+	// Validate both keys
+	if !ValidateKey(oldKey) {
+		return 0, fmt.Errorf("invalid encryption key")
+	}
+	// The temporary key must not become the encryption key, nor be used up by trying
+	if !ValidateMainKey(newKey) {
+		return 0, fmt.Errorf("invalid new encryption key")
+	}
+
+	doc, err := utils.LoadEnvDocument(envFilePath)
+	if err != nil {
+		return 0, fmt.Errorf("failed to read .env file: %w", err)
+	}
+	signed, err := verifyDocument(oldKey, envFilePath, doc)
+	if err != nil {
+		return 0, fmt.Errorf("%s: %w", envFilePath, err)
+	}
+
+	count, err := doc.Update(func(name, value string) (string, error) {
+		if !IsEncryptedValue(value) {
+			return value, nil
+		}
+		decrypted, err := DecryptValue(name, value, oldKey)
+		if err != nil {
+			return "", err
+		}
+		return EncryptValue(name, decrypted, newKey)
+	})
+	if err != nil {
+		return 0, fmt.Errorf("failed to rekey .env file: %w", err)
+	}
+	if signed {
+		if err := signDocument(newKey, envFilePath, doc); err != nil {
+			return 0, err
+		}
+	}
+
+	// Keep the previous content, then replace the file atomically
+	if err := utils.BackupFile(envFilePath); err != nil {
+		return 0, fmt.Errorf("failed to create backup: %w", err)
+	}
+	if err := doc.Save(envFilePath); err != nil {
+		return 0, fmt.Errorf("failed to save .env file: %w", err)
+	}
+	return count, nil
 }
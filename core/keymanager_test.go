@@ -1,8 +1,10 @@
 package core
 
 import (
+	"errors"
 	"os"
 	"path/filepath"
+	"reflect"
 	"strings"
 	"testing"
 )
@@ -62,11 +64,59 @@ func TestValidateKey(t *testing.T) {
 	}
 }
 
+func TestExplainKeyWithRules(t *testing.T) {
+	testCases := []struct {
+		name     string
+		key      string
+		expected []Violation
+	}{
+		{
+			name: "Valid key",
+			key:  "lh-test-key-1234!@u",
+		},
+		{
+			name: "Too short",
+			key:  "lh-key!@u",
+			expected: []Violation{
+				{Rule: "min_key_length", Want: 14, Got: 9},
+			},
+		},
+		{
+			name: "Every rule broken",
+			key:  "",
+			expected: []Violation{
+				{Rule: "min_key_length", Want: 14},
+				{Rule: "key_prefix"},
+				{Rule: "key_suffix"},
+				{Rule: "min_special_chars", Want: 2},
+				{Rule: "key_contain"},
+			},
+		},
+		{
+			name: "Not enough special characters",
+			key:  "lh-test-key-1234!!u",
+			expected: []Violation{
+				{Rule: "min_special_chars", Want: 2, Got: 1},
+			},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			got := ExplainKeyWithRules(tc.key, 14, "lh-", "u", "!@#", 2, "key")
+			if !reflect.DeepEqual(got, tc.expected) {
+				t.Errorf("Expected %+v, got %+v", tc.expected, got)
+			}
+			if valid := ValidateKeyWithRules(tc.key, 14, "lh-", "u", "!@#", 2, "key"); valid != (len(got) == 0) {
+				t.Errorf("ValidateKeyWithRules = %v, but %d violations", valid, len(got))
+			}
+		})
+	}
+}
+
 func TestValidateKey_TempKey(t *testing.T) {
-	stateFile := ".lhkeymanager.state"
-	// Cleanup state file before and after test
-	os.Remove(stateFile)
-	defer os.Remove(stateFile)
+	// Keep the usage counts out of the user's state directory
+	t.Setenv("XDG_STATE_HOME", t.TempDir())
 
 	// Set test-specific rules
 	originalTempKey := TempKey
@@ -78,6 +128,14 @@ func TestValidateKey_TempKey(t *testing.T) {
 		TempKeyMaxUsage = originalTempKeyMaxUsage
 	}()
 
+	// The temporary key is refused until the owner of the state arms it
+	if ValidateKey(TempKey) {
+		t.Fatalf("Expected the temporary key to be refused before it is armed")
+	}
+	if err := ArmTempKey(testOwnerKey); err != nil {
+		t.Fatalf("ArmTempKey failed: %v", err)
+	}
+
 	// --- Test Cases ---
 
 	// 1. First use of temp key, should pass
@@ -220,3 +278,368 @@ func TestLoadAPIKeys_NonExistentFile(t *testing.T) {
 		t.Errorf("Expected error when loading from non-existent file")
 	}
 }
+
+func TestRekeyFile(t *testing.T) {
+	// Create a temporary directory for testing
+	tempDir, err := os.MkdirTemp("", "keymanager_test")
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	envFilePath := filepath.Join(tempDir, ".env")
+	oldKey := "lh-test-key-1234!@u"
+	newKey := "lh-new-key-5678!@u"
+
+	encValue, err := EncryptValue("API_KEY_TEST", "sk-1234567890abcdef", oldKey)
+	if err != nil {
+		t.Fatalf("EncryptValue failed: %v", err)
+	}
+	content := "# API keys\nAPI_KEY_TEST=" + encValue + "\n\nPLAIN_VAR=plain value\nOLD_FORMAT=" + legacyValue + "\n"
+	if err := os.WriteFile(envFilePath, []byte(content), 0600); err != nil {
+		t.Fatalf("Failed to write .env file: %v", err)
+	}
+
+	// A value encrypted with another key must abort the whole operation
+	t.Run("Wrong old key leaves the file untouched", func(t *testing.T) {
+		if _, err := RekeyFile("lh-wrong-key-1234!@u", newKey, envFilePath); err == nil {
+			t.Fatalf("Expected error when rekeying with wrong old key")
+		}
+		after, _ := os.ReadFile(envFilePath)
+		if string(after) != content {
+			t.Errorf("Expected file to be unchanged, got:\n%s", after)
+		}
+	})
+
+	t.Run("Rekey to new key", func(t *testing.T) {
+		// The legacy value was encrypted with another key, so drop it first
+		noLegacy := strings.Replace(content, "OLD_FORMAT="+legacyValue+"\n", "", 1)
+		if err := os.WriteFile(envFilePath, []byte(noLegacy), 0600); err != nil {
+			t.Fatalf("Failed to write .env file: %v", err)
+		}
+
+		count, err := RekeyFile(oldKey, newKey, envFilePath)
+		if err != nil {
+			t.Fatalf("RekeyFile failed: %v", err)
+		}
+		if count != 1 {
+			t.Errorf("Expected 1 re-encrypted value, got %d", count)
+		}
+
+		// Comments, blank lines and plaintext values are preserved
+		after, _ := os.ReadFile(envFilePath)
+		if !strings.HasPrefix(string(after), "# API keys\nAPI_KEY_TEST=") || !strings.HasSuffix(string(after), "\n\nPLAIN_VAR=plain value\n") {
+			t.Errorf("Unexpected file content:\n%s", after)
+		}
+
+		// The backup holds the previous content
+		backup, err := os.ReadFile(envFilePath + ".bak")
+		if err != nil || string(backup) != noLegacy {
+			t.Errorf("Expected backup with previous content, got %q (%v)", backup, err)
+		}
+
+		decryptedVars, err := LoadAPIKeysForTest(newKey, envFilePath)
+		if err != nil {
+			t.Fatalf("LoadAPIKeysForTest failed: %v", err)
+		}
+		if decryptedVars["API_KEY_TEST"] != "sk-1234567890abcdef" || decryptedVars["PLAIN_VAR"] != "plain value" {
+			t.Errorf("Unexpected decrypted values: %v", decryptedVars)
+		}
+		if _, err := LoadAPIKeysForTest(oldKey, envFilePath); err == nil {
+			t.Errorf("Expected old key to no longer decrypt the file")
+		}
+	})
+
+	t.Run("Invalid new key", func(t *testing.T) {
+		if _, err := RekeyFile(newKey, "weak", envFilePath); err == nil {
+			t.Errorf("Expected error for a new key that fails validation")
+		}
+	})
+
+	t.Run("Temporary key as new key", func(t *testing.T) {
+		stateHome := t.TempDir()
+		t.Setenv("XDG_STATE_HOME", stateHome)
+		originalTempKey := TempKey
+		TempKey = "temp-key-for-test"
+		defer func() { TempKey = originalTempKey }()
+
+		if _, err := RekeyFile(newKey, TempKey, envFilePath); err == nil {
+			t.Errorf("Expected error for the temporary key as new key")
+		}
+		// Trying it must not have recorded a use
+		if _, err := os.Stat(filepath.Join(stateHome, "lhkeymanager", stateFileName)); !os.IsNotExist(err) {
+			t.Errorf("Expected no state to be written, got %v", err)
+		}
+	})
+}
+
+func TestLoadAPIKeys_ReportsFailures(t *testing.T) {
+	// Create a temporary directory for testing
+	tempDir, err := os.MkdirTemp("", "keymanager_test")
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	envFilePath := filepath.Join(tempDir, ".env")
+	encryptionKey := "lh-test-key-1234!@u"
+
+	good, err := EncryptValue("GOOD", "sk-good", encryptionKey)
+	if err != nil {
+		t.Fatalf("EncryptValue failed: %v", err)
+	}
+	otherKey, err := EncryptValue("OTHER_KEY", "sk-other", "lh-other-key-1234!@u")
+	if err != nil {
+		t.Fatalf("EncryptValue failed: %v", err)
+	}
+	moved, err := EncryptValue("SOURCE", "sk-moved", encryptionKey)
+	if err != nil {
+		t.Fatalf("EncryptValue failed: %v", err)
+	}
+
+	content := strings.Join([]string{
+		"GOOD=" + good,
+		"PLAIN=value",
+		"OTHER_KEY=" + otherKey,
+		"MOVED=" + moved,
+		"BAD_BASE64=" + V2EncPrefix + "not base64!",
+		"TRUNCATED=" + V2EncPrefix + "AAEC",
+		"FUTURE=enc:AES256v9:abc",
+	}, "\n") + "\n"
+	if err := os.WriteFile(envFilePath, []byte(content), 0600); err != nil {
+		t.Fatalf("Failed to write .env file: %v", err)
+	}
+
+	result, err := loadAPIKeys(encryptionKey, envFilePath)
+	if err != nil {
+		t.Fatalf("loadAPIKeys failed: %v", err)
+	}
+
+	if strings.Join(result.Names, ",") != "GOOD,PLAIN" {
+		t.Errorf("Expected loaded names GOOD,PLAIN, got %v", result.Names)
+	}
+	if result.Vars["GOOD"] != "sk-good" || result.Vars["PLAIN"] != "value" {
+		t.Errorf("Unexpected values: %v", result.Vars)
+	}
+	if _, ok := result.Vars["FUTURE"]; ok {
+		t.Errorf("Expected value with unknown format not to be used as plaintext")
+	}
+
+	expected := map[string]FailureReason{
+		"OTHER_KEY":  ReasonAuthFailed,
+		"MOVED":      ReasonAuthFailed,
+		"BAD_BASE64": ReasonBadEncoding,
+		"TRUNCATED":  ReasonMalformed,
+		"FUTURE":     ReasonUnknownFormat,
+	}
+	if len(result.Failures) != len(expected) {
+		t.Fatalf("Expected %d failures, got %+v", len(expected), result.Failures)
+	}
+	for _, failure := range result.Failures {
+		if expected[failure.Name] != failure.Reason {
+			t.Errorf("%s: expected reason %s, got %s (%v)", failure.Name, expected[failure.Name], failure.Reason, failure.Err)
+		}
+		if failure.Line == 0 {
+			t.Errorf("%s: expected line number", failure.Name)
+		}
+	}
+
+	// When nothing decrypts, the failures are still returned with the error
+	result, err = loadAPIKeys("lh-wrong-key-1234!@u", envFilePath)
+	if err == nil {
+		t.Fatalf("Expected error when no variable decrypts")
+	}
+	if result == nil || len(result.Failures) != 6 {
+		t.Errorf("Expected failures to be reported with the error, got %+v", result)
+	}
+}
+
+func TestLoadResult_Filter(t *testing.T) {
+	newResult := func() *LoadResult {
+		return &LoadResult{
+			Vars:  map[string]string{"AWS_KEY": "1", "AWS_SECRET": "2", "GITHUB_TOKEN": "3", "DB_PASSWORD": "4"},
+			Names: []string{"AWS_KEY", "AWS_SECRET", "GITHUB_TOKEN", "DB_PASSWORD"},
+		}
+	}
+
+	testCases := []struct {
+		name     string
+		only     []string
+		exclude  []string
+		expected string
+	}{
+		{name: "No filters", expected: "AWS_KEY,AWS_SECRET,GITHUB_TOKEN,DB_PASSWORD"},
+		{name: "Only", only: []string{"AWS_*", "DB_PASSWORD"}, expected: "AWS_KEY,AWS_SECRET,DB_PASSWORD"},
+		{name: "Exclude", exclude: []string{"AWS_SECRET"}, expected: "AWS_KEY,GITHUB_TOKEN,DB_PASSWORD"},
+		{name: "Only and exclude", only: []string{"AWS_*"}, exclude: []string{"*_SECRET"}, expected: "AWS_KEY"},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			result := newResult()
+			if err := result.Filter(tc.only, tc.exclude); err != nil {
+				t.Fatalf("Filter failed: %v", err)
+			}
+			if strings.Join(result.Names, ",") != tc.expected {
+				t.Errorf("Expected %s, got %v", tc.expected, result.Names)
+			}
+			if len(result.Vars) != len(result.Names) {
+				t.Errorf("Expected filtered variables to be removed from Vars, got %v", result.Vars)
+			}
+		})
+	}
+
+	if err := newResult().Filter([]string{"[A-"}, nil); err == nil {
+		t.Errorf("Expected error for malformed pattern")
+	}
+}
+
+func TestGetAPIKey(t *testing.T) {
+	envFilePath := filepath.Join(t.TempDir(), ".env")
+	encryptionKey := "lh-test-key-1234!@u"
+
+	first, err := EncryptValue("API_KEY", "sk-first", encryptionKey)
+	if err != nil {
+		t.Fatalf("EncryptValue failed: %v", err)
+	}
+	second, err := EncryptValue("API_KEY", "sk-second", encryptionKey)
+	if err != nil {
+		t.Fatalf("EncryptValue failed: %v", err)
+	}
+	content := "API_KEY=" + first + "\nPLAIN=value\nAPI_KEY=" + second + "\nMOVED=" + first + "\n"
+	if err := os.WriteFile(envFilePath, []byte(content), 0600); err != nil {
+		t.Fatalf("Failed to write .env file: %v", err)
+	}
+
+	// The last definition wins, as in LoadAPIKeys
+	if value, err := GetAPIKey(encryptionKey, "API_KEY", envFilePath); err != nil || value != "sk-second" {
+		t.Errorf("Expected sk-second, got %q (%v)", value, err)
+	}
+	if value, err := GetAPIKey(encryptionKey, "PLAIN", envFilePath); err != nil || value != "value" {
+		t.Errorf("Expected plaintext value, got %q (%v)", value, err)
+	}
+
+	if _, err := GetAPIKey(encryptionKey, "MISSING", envFilePath); !errors.Is(err, ErrVariableNotFound) {
+		t.Errorf("Expected ErrVariableNotFound, got %v", err)
+	}
+
+	_, err = GetAPIKey(encryptionKey, "MOVED", envFilePath)
+	var failure *DecryptFailure
+	if !errors.As(err, &failure) || failure.Reason != ReasonAuthFailed || failure.Line != 4 {
+		t.Errorf("Expected an auth-failed DecryptFailure on line 4, got %v", err)
+	}
+
+	// A signed file that was changed afterwards hands out nothing
+	if err := SignFile(encryptionKey, envFilePath); err != nil {
+		t.Fatalf("SignFile failed: %v", err)
+	}
+	signed, _ := os.ReadFile(envFilePath)
+	tampered := strings.Replace(string(signed), "PLAIN=value", "PLAIN=changed", 1)
+	if err := os.WriteFile(envFilePath, []byte(tampered), 0600); err != nil {
+		t.Fatalf("Failed to write .env file: %v", err)
+	}
+	if _, err := GetAPIKey(encryptionKey, "API_KEY", envFilePath); !errors.Is(err, ErrIntegrity) {
+		t.Errorf("Expected ErrIntegrity, got %v", err)
+	}
+
+	if _, err := GetAPIKey("short", "API_KEY", envFilePath); err == nil {
+		t.Errorf("Expected error for an invalid key")
+	}
+}
+
+// writeEditTestFile writes an .env file with comments around an encrypted and a plaintext variable
+func writeEditTestFile(t *testing.T, encryptionKey string) string {
+	t.Helper()
+	encrypted, err := EncryptValue("API_KEY", "sk-secret", encryptionKey)
+	if err != nil {
+		t.Fatalf("EncryptValue failed: %v", err)
+	}
+	content := "# header\nAPI_KEY=" + encrypted + " # inline\nexport PLAIN=value\n\n# footer\n"
+	envFilePath := filepath.Join(t.TempDir(), ".env")
+	if err := os.WriteFile(envFilePath, []byte(content), 0600); err != nil {
+		t.Fatalf("Failed to write .env file: %v", err)
+	}
+	return envFilePath
+}
+
+func TestRemoveAPIKey(t *testing.T) {
+	encryptionKey := "lh-test-key-1234!@u"
+	envFilePath := writeEditTestFile(t, encryptionKey)
+	original, _ := os.ReadFile(envFilePath)
+
+	if err := RemoveAPIKey(encryptionKey, "MISSING", envFilePath, false); !errors.Is(err, ErrVariableNotFound) {
+		t.Errorf("Expected ErrVariableNotFound, got %v", err)
+	}
+	var failure *DecryptFailure
+	if err := RemoveAPIKey("lh-other-key-1234!@u", "API_KEY", envFilePath, false); !errors.As(err, &failure) {
+		t.Errorf("Expected a DecryptFailure for the wrong key, got %v", err)
+	}
+	if content, _ := os.ReadFile(envFilePath); string(content) != string(original) {
+		t.Fatalf("Expected the file to be unchanged after failures")
+	}
+
+	if err := RemoveAPIKey(encryptionKey, "API_KEY", envFilePath, false); err != nil {
+		t.Fatalf("RemoveAPIKey failed: %v", err)
+	}
+	content, _ := os.ReadFile(envFilePath)
+	if string(content) != "# header\nexport PLAIN=value\n\n# footer\n" {
+		t.Errorf("Unexpected content after rm:\n%s", content)
+	}
+	if backup, _ := os.ReadFile(envFilePath + ".bak"); string(backup) != string(original) {
+		t.Errorf("Expected the backup to hold the original content")
+	}
+
+	// A plaintext variable needs no decryption
+	if err := RemoveAPIKey(encryptionKey, "PLAIN", envFilePath, false); err != nil {
+		t.Fatalf("RemoveAPIKey failed: %v", err)
+	}
+
+	// --force removes a value that doesn't decrypt
+	forced := writeEditTestFile(t, "lh-other-key-1234!@u")
+	if err := RemoveAPIKey(encryptionKey, "API_KEY", forced, true); err != nil {
+		t.Errorf("Expected a forced remove to succeed, got %v", err)
+	}
+}
+
+func TestRenameAPIKey(t *testing.T) {
+	encryptionKey := "lh-test-key-1234!@u"
+	envFilePath := writeEditTestFile(t, encryptionKey)
+	if err := SignFile(encryptionKey, envFilePath); err != nil {
+		t.Fatalf("SignFile failed: %v", err)
+	}
+
+	if err := RenameAPIKey(encryptionKey, "MISSING", "OTHER", envFilePath); !errors.Is(err, ErrVariableNotFound) {
+		t.Errorf("Expected ErrVariableNotFound, got %v", err)
+	}
+	if err := RenameAPIKey(encryptionKey, "API_KEY", "PLAIN", envFilePath); err == nil {
+		t.Errorf("Expected error for a taken name")
+	}
+	if err := RenameAPIKey(encryptionKey, "API_KEY", "1NVALID NAME", envFilePath); err == nil {
+		t.Errorf("Expected error for an invalid name")
+	}
+
+	if err := RenameAPIKey(encryptionKey, "API_KEY", "OPENAI_API_KEY", envFilePath); err != nil {
+		t.Fatalf("RenameAPIKey failed: %v", err)
+	}
+
+	// The value was encrypted again for the new name, and the file is still signed and valid
+	if value, err := GetAPIKey(encryptionKey, "OPENAI_API_KEY", envFilePath); err != nil || value != "sk-secret" {
+		t.Errorf("Expected the renamed value to decrypt, got %q (%v)", value, err)
+	}
+	if signed, err := VerifyFile(encryptionKey, envFilePath); !signed || err != nil {
+		t.Errorf("Expected a valid signature after rename, got signed=%v err=%v", signed, err)
+	}
+	content, _ := os.ReadFile(envFilePath)
+	lines := strings.Split(string(content), "\n")
+	if lines[0] != "# header" || !strings.HasPrefix(lines[1], "OPENAI_API_KEY="+EncPrefix) || lines[2] != "export PLAIN=value" {
+		t.Errorf("Expected the variable to keep its position, got:\n%s", content)
+	}
+
+	// Plaintext values are renamed as they are
+	if err := RenameAPIKey(encryptionKey, "PLAIN", "DEBUG", envFilePath); err != nil {
+		t.Fatalf("RenameAPIKey failed: %v", err)
+	}
+	if value, _ := GetAPIKey(encryptionKey, "DEBUG", envFilePath); value != "value" {
+		t.Errorf("Expected plaintext value, got %q", value)
+	}
+}
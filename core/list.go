@@ -0,0 +1,101 @@
+package core
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/clh021/lhkeymanager/utils"
+)
+
+// Kinds of values reported in EntryInfo
+const (
+	KindPlaintext = "plaintext" // not encrypted
+	KindCurrent   = "current"   // encrypted with the current format
+	KindLegacy    = "legacy"    // encrypted with an outdated format that should be re-encrypted
+	KindUnknown   = "unknown"   // encrypted with a format version this build doesn't support
+)
+
+// EntryInfo describes a variable of an .env file without its value
+type EntryInfo struct {
+	Name   string `json:"name"`
+	Line   int    `json:"line"`   // 1-based line number in the file
+	Kind   string `json:"kind"`   // KindPlaintext, KindCurrent, KindLegacy or KindUnknown
+	Format string `json:"format"` // format prefix such as "enc:AES256v4", "" for plaintext
+	Length int    `json:"length"` // length of the value without the format prefix
+
+	// Decrypts reports whether the value decrypts with the key given to VerifyEntries;
+	// nil if it wasn't checked, as for plaintext values
+	Decrypts *bool `json:"decrypts,omitempty"`
+	// Reason is why the value failed to decrypt
+	Reason FailureReason `json:"reason,omitempty"`
+}
+
+// ListEntries describes the variables of the .env file in file order, including duplicates.
+// Nothing is decrypted, so no key is needed.
+// envFilePath: path to the .env file
+// Returns the entries and an error if the file can't be read
+func ListEntries(envFilePath string) ([]EntryInfo, error) {
+	entries, err := utils.ReadEnvEntries(envFilePath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read .env file: %w", err)
+	}
+
+	infos := make([]EntryInfo, 0, len(entries))
+	for _, entry := range entries {
+		infos = append(infos, describeEntry(entry))
+	}
+	return infos, nil
+}
+
+// describeEntry classifies a variable by the format of its value
+func describeEntry(entry utils.EnvEntry) EntryInfo {
+	info := EntryInfo{Name: entry.Name, Line: entry.Line, Length: len(entry.Value)}
+	if !IsEncryptedValue(entry.Value) {
+		info.Kind = KindPlaintext
+		return info
+	}
+
+	info.Format = FormatName(entry.Value)
+	info.Length = len(strings.TrimPrefix(entry.Value, info.Format+":"))
+	f, ok := lookupFormat(entry.Value)
+	switch {
+	case !ok:
+		info.Kind = KindUnknown
+	case f.legacy:
+		info.Kind = KindLegacy
+	default:
+		info.Kind = KindCurrent
+	}
+	return info
+}
+
+// VerifyEntries describes the variables of the .env file like ListEntries and tries to decrypt
+// every encrypted value, setting Decrypts and Reason. The decrypted values are discarded.
+// encryptionKey: the key to check the values with
+// envFilePath: path to the .env file
+// Returns the entries and an error if the key is invalid or the file can't be read
+func VerifyEntries(encryptionKey, envFilePath string) ([]EntryInfo, error) {
+	if !ValidateKey(encryptionKey) {
+		return nil, fmt.Errorf("invalid encryption key")
+	}
+
+	entries, err := utils.ReadEnvEntries(envFilePath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read .env file: %w", err)
+	}
+
+	infos := make([]EntryInfo, 0, len(entries))
+	for _, entry := range entries {
+		info := describeEntry(entry)
+		if info.Kind != KindPlaintext {
+			_, err := DecryptValue(entry.Name, entry.Value, encryptionKey)
+			ok := err == nil
+			info.Decrypts = &ok
+			if err != nil {
+				info.Reason = classifyFailure(err)
+			}
+		}
+		infos = append(infos, info)
+	}
+	return infos, nil
+}
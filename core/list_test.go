@@ -0,0 +1,105 @@
+package core
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/clh021/lhkeymanager/utils"
+)
+
+// writeListTestFile writes an .env file with one value of each kind and returns its path
+func writeListTestFile(t *testing.T, encryptionKey string) string {
+	t.Helper()
+	current, err := EncryptValue("API_KEY", "sk-current", encryptionKey)
+	if err != nil {
+		t.Fatalf("EncryptValue failed: %v", err)
+	}
+	v3, err := utils.EncryptAES256KDF("sk-v3", encryptionKey, ConfiguredKDFParams(), nil)
+	if err != nil {
+		t.Fatalf("EncryptAES256KDF failed: %v", err)
+	}
+	// MOVED_KEY holds API_KEY's ciphertext, which is bound to the other name
+	content := "# comment\n" +
+		"API_KEY=" + current + "\n" +
+		"DEBUG=true\n" +
+		"OLD_KEY=" + V3EncPrefix + v3 + "\n" +
+		"NEW_KEY=enc:AES256v9:abc\n" +
+		"MOVED_KEY=" + current + "\n"
+
+	path := filepath.Join(t.TempDir(), ".env")
+	if err := os.WriteFile(path, []byte(content), 0600); err != nil {
+		t.Fatalf("Failed to write env file: %v", err)
+	}
+	return path
+}
+
+func TestListEntries(t *testing.T) {
+	path := writeListTestFile(t, "lh-test-key-1234!@u")
+	infos, err := ListEntries(path)
+	if err != nil {
+		t.Fatalf("ListEntries failed: %v", err)
+	}
+
+	expected := []struct {
+		name, kind, format string
+		line               int
+	}{
+		{"API_KEY", KindCurrent, "enc:AES256v4", 2},
+		{"DEBUG", KindPlaintext, "", 3},
+		{"OLD_KEY", KindLegacy, "enc:AES256v3", 4},
+		{"NEW_KEY", KindUnknown, "enc:AES256v9", 5},
+		{"MOVED_KEY", KindCurrent, "enc:AES256v4", 6},
+	}
+	if len(infos) != len(expected) {
+		t.Fatalf("Expected %d entries, got %+v", len(expected), infos)
+	}
+	for i, want := range expected {
+		got := infos[i]
+		if got.Name != want.name || got.Kind != want.kind || got.Format != want.format || got.Line != want.line {
+			t.Errorf("Entry %d: expected %+v, got %+v", i, want, got)
+		}
+		if got.Decrypts != nil {
+			t.Errorf("%s: expected no decryption status without a key", got.Name)
+		}
+	}
+	if infos[1].Length != len("true") || infos[3].Length != len("abc") {
+		t.Errorf("Unexpected lengths: %d, %d", infos[1].Length, infos[3].Length)
+	}
+
+	if _, err := ListEntries(filepath.Join(t.TempDir(), "missing.env")); err == nil {
+		t.Errorf("Expected error for a missing file")
+	}
+}
+
+func TestVerifyEntries(t *testing.T) {
+	encryptionKey := "lh-test-key-1234!@u"
+	path := writeListTestFile(t, encryptionKey)
+
+	infos, err := VerifyEntries(encryptionKey, path)
+	if err != nil {
+		t.Fatalf("VerifyEntries failed: %v", err)
+	}
+	expected := map[string]FailureReason{
+		"API_KEY":   "",
+		"OLD_KEY":   "",
+		"NEW_KEY":   ReasonUnknownFormat,
+		"MOVED_KEY": ReasonAuthFailed,
+	}
+	for _, info := range infos {
+		reason, encrypted := expected[info.Name]
+		if !encrypted {
+			if info.Decrypts != nil {
+				t.Errorf("%s: expected plaintext to be unchecked", info.Name)
+			}
+			continue
+		}
+		if info.Decrypts == nil || *info.Decrypts != (reason == "") || info.Reason != reason {
+			t.Errorf("%s: expected reason %q, got %+v", info.Name, reason, info)
+		}
+	}
+
+	if _, err := VerifyEntries("short", path); err == nil {
+		t.Errorf("Expected error for an invalid key")
+	}
+}
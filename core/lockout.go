@@ -0,0 +1,196 @@
+package core
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// Rejected keys are counted in the state file, so starting the program again doesn't reset the count.
+// After freeAttempts failures every further attempt has to wait twice as long as the previous one,
+// up to maxBackoff, and with a lockout_threshold set the key is refused for lockout_minutes once
+// that many failures have accumulated. Each attempt reserves the next slot before the key is checked,
+// so processes started in parallel can't try more keys than a single one could.
+// The state file belongs to the user and its location follows $XDG_STATE_HOME, so whoever starts
+// the program can reset the count; this only slows down casual retries and doesn't stop guessing.
+
+// freeAttempts is the number of failures before delays start; it matches one interactive prompt
+const freeAttempts = 3
+
+// maxBackoff caps the delay between two attempts
+const maxBackoff = 5 * time.Minute
+
+// auditLogName is the audit log in StateDir
+const auditLogName = "audit.log"
+
+// Audit log events
+const (
+	AuditFailure = "failure"
+	AuditSuccess = "success"
+	AuditLockout = "lockout"
+	AuditRevoke  = "revoke"
+)
+
+// failureState is the record of rejected keys in the state file
+type failureState struct {
+	Count        int       `json:"count"`         // failures since the last success or lockout
+	SinceSuccess int       `json:"since_success"` // failures since the last success
+	NextAttempt  time.Time `json:"next_attempt"`  // no key is checked before this time
+	LockedUntil  time.Time `json:"locked_until"`  // every key is refused before this time
+}
+
+// LockoutError is returned while keys are locked out after too many failures
+type LockoutError struct {
+	Until time.Time
+}
+
+func (e *LockoutError) Error() string {
+	return fmt.Sprintf("too many failed key attempts, locked until %s", e.Until.Format(time.RFC3339))
+}
+
+// BackoffError is returned when the next key attempt has to wait
+type BackoffError struct {
+	Wait time.Duration
+}
+
+func (e *BackoffError) Error() string {
+	return fmt.Sprintf("too many failed key attempts, retry in %v", e.Wait)
+}
+
+// AuditEvent is one line of the audit log. It never contains a key.
+type AuditEvent struct {
+	Time     time.Time `json:"time"`
+	Event    string    `json:"event"` // AuditFailure, AuditSuccess, AuditLockout or AuditRevoke
+	Command  string    `json:"command,omitempty"`
+	Source   string    `json:"source,omitempty"`   // where the key came from, e.g. "prompt" or "--key-file path"
+	TempKey  string    `json:"temp_key,omitempty"` // name of the temporary key used, if any
+	Failures int       `json:"failures,omitempty"` // failures since the last success
+	PID      int       `json:"pid"`
+}
+
+// backoffDelay returns how long to wait after the given number of consecutive failures
+func backoffDelay(failures int) time.Duration {
+	if failures < freeAttempts {
+		return 0
+	}
+	shift := failures - freeAttempts
+	if shift > 16 {
+		return maxBackoff
+	}
+	return min(time.Second<<shift, maxBackoff)
+}
+
+// BeginKeyAttempt checks whether a key may be tried now, and if so reserves the attempt:
+// until it is recorded as a success, the next attempt waits as if this one failed.
+// Returns a *LockoutError or *BackoffError if the key must not be checked yet
+func BeginKeyAttempt() error {
+	now := time.Now()
+	return updateState(func(state *stateFile) (bool, error) {
+		f := &state.Failures
+		if now.Before(f.LockedUntil) {
+			return false, &LockoutError{Until: f.LockedUntil}
+		}
+		if now.Before(f.NextAttempt) {
+			return false, &BackoffError{Wait: f.NextAttempt.Sub(now)}
+		}
+		if delay := backoffDelay(f.Count + 1); delay > 0 {
+			f.NextAttempt = now.Add(delay)
+			return true, nil
+		}
+		return false, nil
+	})
+}
+
+// RecordKeyFailure counts a rejected key, starts a lockout if the policy's threshold is reached,
+// and writes the failure to the audit log
+// event: the command and source of the attempt
+func RecordKeyFailure(policy *Policy, event AuditEvent) error {
+	now := time.Now()
+	var lockedUntil time.Time
+	err := updateState(func(state *stateFile) (bool, error) {
+		f := &state.Failures
+		f.Count++
+		f.SinceSuccess++
+		f.NextAttempt = now.Add(backoffDelay(f.Count))
+		if policy.LockoutThreshold > 0 && f.Count >= policy.LockoutThreshold {
+			f.LockedUntil = now.Add(time.Duration(policy.LockoutMinutes) * time.Minute)
+			f.NextAttempt = f.LockedUntil
+			f.Count = 0
+			lockedUntil = f.LockedUntil
+		}
+		event.Failures = f.SinceSuccess
+		return true, nil
+	})
+	if err != nil {
+		return err
+	}
+
+	event.Time, event.Event = now, AuditFailure
+	if err := AppendAuditLog(event); err != nil {
+		return err
+	}
+	if !lockedUntil.IsZero() {
+		event.Event = AuditLockout
+		return AppendAuditLog(event)
+	}
+	return nil
+}
+
+// RecordKeySuccess resets the failure count and writes the success to the audit log
+// event: the command and source of the attempt
+// Returns the number of failed attempts since the previous success
+func RecordKeySuccess(event AuditEvent) (int, error) {
+	failures := 0
+	err := updateState(func(state *stateFile) (bool, error) {
+		failures = state.Failures.SinceSuccess
+		changed := state.Failures != failureState{}
+		state.Failures = failureState{}
+		return changed, nil
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	event.Time, event.Event, event.Failures = time.Now(), AuditSuccess, failures
+	return failures, AppendAuditLog(event)
+}
+
+// AuditLogPath returns the path of the audit log, a file with one JSON object per line
+func AuditLogPath() (string, error) {
+	dir, err := StateDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, auditLogName), nil
+}
+
+// AppendAuditLog adds an event to the audit log, creating it with permissions 0600
+func AppendAuditLog(event AuditEvent) error {
+	path, err := AuditLogPath()
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return err
+	}
+	if event.PID == 0 {
+		event.PID = os.Getpid()
+	}
+	line, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return err
+	}
+	// A single write of a short line is appended in one piece, even by concurrent processes
+	_, err = f.Write(append(line, '\n'))
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
@@ -0,0 +1,174 @@
+package core
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"os"
+	"testing"
+	"time"
+)
+
+// readAuditLog returns the events in the audit log
+func readAuditLog(t *testing.T) []AuditEvent {
+	t.Helper()
+	path, err := AuditLogPath()
+	if err != nil {
+		t.Fatalf("AuditLogPath failed: %v", err)
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatalf("Failed to open audit log: %v", err)
+	}
+	defer f.Close()
+
+	var events []AuditEvent
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		var e AuditEvent
+		if err := json.Unmarshal(scanner.Bytes(), &e); err != nil {
+			t.Fatalf("Invalid audit log line %q: %v", scanner.Text(), err)
+		}
+		events = append(events, e)
+	}
+	return events
+}
+
+func TestBackoffDelay(t *testing.T) {
+	testCases := []struct {
+		failures int
+		want     time.Duration
+	}{
+		{0, 0},
+		{freeAttempts - 1, 0},
+		{freeAttempts, time.Second},
+		{freeAttempts + 1, 2 * time.Second},
+		{freeAttempts + 4, 16 * time.Second},
+		{freeAttempts + 20, maxBackoff},
+		{1000, maxBackoff},
+	}
+	for _, tc := range testCases {
+		if got := backoffDelay(tc.failures); got != tc.want {
+			t.Errorf("backoffDelay(%d) = %v, expected %v", tc.failures, got, tc.want)
+		}
+	}
+}
+
+func TestKeyAttempts_Backoff(t *testing.T) {
+	stateTestDir(t)
+	policy := &Policy{}
+	event := AuditEvent{Command: "load", Source: "prompt"}
+
+	// The first attempts are free
+	for i := 0; i < freeAttempts; i++ {
+		if err := BeginKeyAttempt(); err != nil {
+			t.Fatalf("Attempt %d: unexpected error %v", i+1, err)
+		}
+		if err := RecordKeyFailure(policy, event); err != nil {
+			t.Fatalf("RecordKeyFailure failed: %v", err)
+		}
+	}
+
+	var backoff *BackoffError
+	if err := BeginKeyAttempt(); !errors.As(err, &backoff) {
+		t.Fatalf("Expected a BackoffError, got %v", err)
+	}
+	if backoff.Wait <= 0 || backoff.Wait > time.Second {
+		t.Errorf("Expected a wait of up to 1s, got %v", backoff.Wait)
+	}
+
+	// A success reports the failures and resets the count
+	failures, err := RecordKeySuccess(event)
+	if err != nil {
+		t.Fatalf("RecordKeySuccess failed: %v", err)
+	}
+	if failures != freeAttempts {
+		t.Errorf("Expected %d failures since the last success, got %d", freeAttempts, failures)
+	}
+	if err := BeginKeyAttempt(); err != nil {
+		t.Errorf("Expected no wait after a success, got %v", err)
+	}
+	if failures, _ := RecordKeySuccess(event); failures != 0 {
+		t.Errorf("Expected 0 failures after a success, got %d", failures)
+	}
+
+	events := readAuditLog(t)
+	if len(events) != freeAttempts+2 {
+		t.Fatalf("Expected %d audit events, got %+v", freeAttempts+2, events)
+	}
+	for i, e := range events[:freeAttempts] {
+		if e.Event != AuditFailure || e.Failures != i+1 || e.Command != "load" || e.Source != "prompt" || e.PID != os.Getpid() {
+			t.Errorf("Unexpected failure event %d: %+v", i, e)
+		}
+	}
+	if e := events[freeAttempts]; e.Event != AuditSuccess || e.Failures != freeAttempts {
+		t.Errorf("Unexpected success event: %+v", e)
+	}
+}
+
+func TestKeyAttempts_ReserveAttempt(t *testing.T) {
+	stateTestDir(t)
+	policy := &Policy{}
+	for i := 0; i < freeAttempts-1; i++ {
+		if err := RecordKeyFailure(policy, AuditEvent{}); err != nil {
+			t.Fatalf("RecordKeyFailure failed: %v", err)
+		}
+	}
+
+	// The next failure would start the backoff, so a second process has to wait for the first
+	if err := BeginKeyAttempt(); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	var backoff *BackoffError
+	if err := BeginKeyAttempt(); !errors.As(err, &backoff) {
+		t.Errorf("Expected a concurrent attempt to wait, got %v", err)
+	}
+}
+
+func TestKeyAttempts_Lockout(t *testing.T) {
+	stateTestDir(t)
+	policy := &Policy{LockoutThreshold: 2, LockoutMinutes: 10}
+
+	for i := 0; i < 2; i++ {
+		if err := RecordKeyFailure(policy, AuditEvent{Source: "LHKM_KEY"}); err != nil {
+			t.Fatalf("RecordKeyFailure failed: %v", err)
+		}
+	}
+
+	var lockout *LockoutError
+	if err := BeginKeyAttempt(); !errors.As(err, &lockout) {
+		t.Fatalf("Expected a LockoutError, got %v", err)
+	}
+	if wait := time.Until(lockout.Until); wait < 9*time.Minute || wait > 10*time.Minute {
+		t.Errorf("Expected a lockout of 10 minutes, got %v", wait)
+	}
+
+	events := readAuditLog(t)
+	if len(events) != 3 || events[2].Event != AuditLockout || events[2].Failures != 2 {
+		t.Errorf("Expected the lockout in the audit log, got %+v", events)
+	}
+
+	// The count starts over after a lockout, but the failures since the last success are kept
+	state, err := loadState()
+	if err != nil {
+		t.Fatalf("loadState failed: %v", err)
+	}
+	if state.Failures.Count != 0 || state.Failures.SinceSuccess != 2 {
+		t.Errorf("Unexpected failure state: %+v", state.Failures)
+	}
+}
+
+func TestAppendAuditLog_Permissions(t *testing.T) {
+	stateTestDir(t)
+	if err := AppendAuditLog(AuditEvent{Event: AuditFailure}); err != nil {
+		t.Fatalf("AppendAuditLog failed: %v", err)
+	}
+	path, _ := AuditLogPath()
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatalf("Failed to stat audit log: %v", err)
+	}
+	if perm := info.Mode().Perm(); perm != 0600 && os.PathSeparator == '/' {
+		t.Errorf("Expected permissions 0600, got %o", perm)
+	}
+}
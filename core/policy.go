@@ -0,0 +1,406 @@
+package core
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// SystemPolicyDir holds the system-wide policy file. It is a variable only so that tests can move it.
+var SystemPolicyDir = "/etc/lhkeymanager"
+
+// SourceBuiltin is the source of rules that come from the values compiled into the binary
+const SourceBuiltin = "built-in"
+
+// policyFileNames are the accepted names of a policy file in a policy directory, in order of preference
+var policyFileNames = []string{"policy.yml", "policy.yaml", "policy.json"}
+
+// Policy holds the rules that encryption keys must satisfy
+type Policy struct {
+	MinKeyLength     int
+	KeyPrefix        string
+	KeySuffix        string
+	RequiredChars    string
+	MinSpecialChars  int
+	KeyContain       string
+	MinEntropyBits   int
+	TempKey          string
+	TempKeyMaxUsage  int
+	LockoutThreshold int
+	LockoutMinutes   int
+	RequireMAC       int
+	KeyHint          string
+
+	// Sources maps each rule's file key (e.g. "min_key_length") to the file it was read from,
+	// or SourceBuiltin
+	Sources map[string]string
+	// Ignored lists the rules of the user policy that were weaker than the system policy
+	Ignored []PolicyRule
+}
+
+// PolicyRule is one rule of the effective policy, prepared for display
+type PolicyRule struct {
+	Key    string // name in the policy file
+	Value  string // for secret rules "" if unset and "*" if set
+	Secret bool   // the value must not be displayed
+	Source string // SourceBuiltin or the path of the policy file
+}
+
+// policyFile is the layout of a policy file; it matches build_config.yml
+type policyFile struct {
+	SecurityRules policyRules `yaml:"security_rules" json:"security_rules"`
+}
+
+// policyRules are the rules set by a policy file. Absent fields keep the value from the previous layer.
+type policyRules struct {
+	MinKeyLength     *int    `yaml:"min_key_length" json:"min_key_length"`
+	KeyPrefix        *string `yaml:"key_prefix" json:"key_prefix"`
+	KeySuffix        *string `yaml:"key_suffix" json:"key_suffix"`
+	RequiredChars    *string `yaml:"required_chars" json:"required_chars"`
+	MinSpecialChars  *int    `yaml:"min_special_chars" json:"min_special_chars"`
+	KeyContain       *string `yaml:"key_contain" json:"key_contain"`
+	MinEntropyBits   *int    `yaml:"min_entropy_bits" json:"min_entropy_bits"`
+	TempKey          *string `yaml:"temp_key" json:"temp_key"`
+	TempKeyMaxUsage  *int    `yaml:"temp_key_max_usage" json:"temp_key_max_usage"`
+	LockoutThreshold *int    `yaml:"lockout_threshold" json:"lockout_threshold"`
+	LockoutMinutes   *int    `yaml:"lockout_minutes" json:"lockout_minutes"`
+	RequireMAC       *int    `yaml:"require_mac" json:"require_mac"`
+	KeyHint          *string `yaml:"key_hint" json:"key_hint"`
+}
+
+// BuiltinPolicy returns the policy compiled into the binary through -ldflags
+// Returns an error if a numeric value is not a valid number
+func BuiltinPolicy() (*Policy, error) {
+	p := &Policy{
+		KeyPrefix:     KeyPrefix,
+		KeySuffix:     KeySuffix,
+		RequiredChars: RequiredChars,
+		KeyContain:    KeyContain,
+		TempKey:       TempKey,
+		KeyHint:       KeyHint,
+		Sources:       make(map[string]string),
+	}
+
+	numbers := []struct {
+		name  string
+		value string
+		dst   *int
+	}{
+		{"MinKeyLength", MinKeyLength, &p.MinKeyLength},
+		{"MinSpecialChars", MinSpecialChars, &p.MinSpecialChars},
+		{"MinEntropyBits", MinEntropyBits, &p.MinEntropyBits},
+		{"TempKeyMaxUsage", TempKeyMaxUsage, &p.TempKeyMaxUsage},
+		{"LockoutThreshold", LockoutThreshold, &p.LockoutThreshold},
+		{"LockoutMinutes", LockoutMinutes, &p.LockoutMinutes},
+		{"RequireMAC", RequireMAC, &p.RequireMAC},
+	}
+	for _, n := range numbers {
+		v, err := strconv.Atoi(strings.TrimSpace(n.value))
+		if err != nil {
+			return nil, fmt.Errorf("invalid built-in %s %q: not a number", n.name, n.value)
+		}
+		*n.dst = v
+	}
+
+	for _, rule := range p.Rules() {
+		p.Sources[rule.Key] = SourceBuiltin
+	}
+	return p, nil
+}
+
+// PolicyFiles returns the policy files that are applied on top of the built-in policy, in order:
+// the system policy in /etc/lhkeymanager, then the user policy, which is $LHKM_POLICY if set and
+// otherwise the policy in the user config directory (e.g. ~/.config/lhkeymanager).
+// Files that don't exist are skipped when loading, except $LHKM_POLICY.
+func PolicyFiles() []string {
+	files := []string{findPolicyFile(SystemPolicyDir)}
+	if path := os.Getenv("LHKM_POLICY"); path != "" {
+		return append(files, path)
+	}
+	if dir, err := os.UserConfigDir(); err == nil {
+		files = append(files, findPolicyFile(filepath.Join(dir, "lhkeymanager")))
+	}
+	return files
+}
+
+// findPolicyFile returns the first existing policy file in dir, or the default name if there is none
+func findPolicyFile(dir string) string {
+	for _, name := range policyFileNames {
+		path := filepath.Join(dir, name)
+		if _, err := os.Stat(path); err == nil {
+			return path
+		}
+	}
+	return filepath.Join(dir, policyFileNames[0])
+}
+
+// LoadPolicy returns the effective policy. The built-in policy and the system policy file, both set by
+// the administrator, form a floor: the user policy can only make rules stricter, and its weaker rules
+// are listed in Ignored instead of being applied.
+// Returns an error if the built-in values or a policy file are invalid; callers must then fail closed
+func LoadPolicy() (*Policy, error) {
+	p, err := BuiltinPolicy()
+	if err != nil {
+		return nil, err
+	}
+
+	files := PolicyFiles()
+	if err := p.applyFile(files[0]); err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	if err := p.Validate(); err != nil {
+		return nil, err
+	}
+
+	if len(files) > 1 {
+		path := files[1]
+		user := p.clone()
+		err := user.applyFile(path)
+		if os.IsNotExist(err) && os.Getenv("LHKM_POLICY") == "" {
+			return p, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		if err := user.Validate(); err != nil {
+			return nil, fmt.Errorf("%s: %w", path, err)
+		}
+		p.tighten(user, path)
+	}
+
+	if err := p.Validate(); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+// clone returns a copy of the policy with its own Sources
+func (p *Policy) clone() *Policy {
+	c := *p
+	c.Sources = make(map[string]string, len(p.Sources))
+	for key, source := range p.Sources {
+		c.Sources[key] = source
+	}
+	c.Ignored = nil
+	return &c
+}
+
+// tighten applies the rules that the user policy file at path sets, where they are at least as strict
+// as the current ones. A prefix, suffix or contained string is stricter if it extends the current one,
+// and required_chars if it is a subset of the current characters.
+func (p *Policy) tighten(user *Policy, path string) {
+	rules := make(map[string]PolicyRule)
+	for _, rule := range user.Rules() {
+		rules[rule.Key] = rule
+	}
+	adopt := func(key string, stricter bool, apply func()) {
+		if user.Sources[key] != path {
+			return
+		}
+		if !stricter {
+			p.Ignored = append(p.Ignored, rules[key])
+			return
+		}
+		apply()
+		p.Sources[key] = path
+	}
+
+	u := user
+	adopt("min_key_length", u.MinKeyLength >= p.MinKeyLength, func() { p.MinKeyLength = u.MinKeyLength })
+	adopt("key_prefix", strings.HasPrefix(u.KeyPrefix, p.KeyPrefix), func() { p.KeyPrefix = u.KeyPrefix })
+	adopt("key_suffix", strings.HasSuffix(u.KeySuffix, p.KeySuffix), func() { p.KeySuffix = u.KeySuffix })
+	adopt("required_chars", p.RequiredChars == "" || (u.RequiredChars != "" && isSubset(u.RequiredChars, p.RequiredChars)),
+		func() { p.RequiredChars = u.RequiredChars })
+	adopt("min_special_chars", u.MinSpecialChars >= p.MinSpecialChars, func() { p.MinSpecialChars = u.MinSpecialChars })
+	adopt("key_contain", strings.Contains(u.KeyContain, p.KeyContain), func() { p.KeyContain = u.KeyContain })
+	adopt("min_entropy_bits", u.MinEntropyBits >= p.MinEntropyBits, func() { p.MinEntropyBits = u.MinEntropyBits })
+	adopt("temp_key", u.TempKey == "" || u.TempKey == p.TempKey, func() { p.TempKey = u.TempKey })
+	adopt("temp_key_max_usage", u.TempKeyMaxUsage <= p.TempKeyMaxUsage, func() { p.TempKeyMaxUsage = u.TempKeyMaxUsage })
+	// 0 disables the lockout, so it is the weakest threshold
+	adopt("lockout_threshold", u.LockoutThreshold == p.LockoutThreshold || (u.LockoutThreshold > 0 && (p.LockoutThreshold == 0 || u.LockoutThreshold < p.LockoutThreshold)),
+		func() { p.LockoutThreshold = u.LockoutThreshold })
+	adopt("lockout_minutes", u.LockoutMinutes >= p.LockoutMinutes, func() { p.LockoutMinutes = u.LockoutMinutes })
+	adopt("require_mac", u.RequireMAC >= p.RequireMAC, func() { p.RequireMAC = u.RequireMAC })
+	// The hint is not a rule
+	adopt("key_hint", true, func() { p.KeyHint = u.KeyHint })
+}
+
+// isSubset reports whether every character of s is in set
+func isSubset(s, set string) bool {
+	for _, r := range s {
+		if !strings.ContainsRune(set, r) {
+			return false
+		}
+	}
+	return true
+}
+
+// applyFile overrides the rules set in a policy file
+func (p *Policy) applyFile(path string) error {
+	info, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+	// A file others can write to could be used to weaken the rules
+	if runtime.GOOS != "windows" && info.Mode().Perm()&0022 != 0 {
+		return fmt.Errorf("%s: policy file must not be writable by group or others", path)
+	}
+
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+
+	var f policyFile
+	if strings.HasSuffix(path, ".json") {
+		dec := json.NewDecoder(bytes.NewReader(content))
+		dec.DisallowUnknownFields()
+		err = dec.Decode(&f)
+	} else {
+		dec := yaml.NewDecoder(bytes.NewReader(content))
+		dec.KnownFields(true)
+		err = dec.Decode(&f)
+		if errors.Is(err, io.EOF) {
+			err = nil // Empty file
+		}
+	}
+	if err != nil {
+		return fmt.Errorf("%s: %w", path, err)
+	}
+
+	r := f.SecurityRules
+	// The temporary key is a secret: only its owner, or root and the group it chose, may read it
+	if r.TempKey != nil && *r.TempKey != "" && runtime.GOOS != "windows" {
+		if perm := info.Mode().Perm(); perm&0077 != 0 && !(ownedByRoot(info) && perm&0004 == 0) {
+			return fmt.Errorf("%s: a policy file that sets temp_key must not be readable by others, use chmod 600", path)
+		}
+	}
+	p.setInt("min_key_length", &p.MinKeyLength, r.MinKeyLength, path)
+	p.setString("key_prefix", &p.KeyPrefix, r.KeyPrefix, path)
+	p.setString("key_suffix", &p.KeySuffix, r.KeySuffix, path)
+	p.setString("required_chars", &p.RequiredChars, r.RequiredChars, path)
+	p.setInt("min_special_chars", &p.MinSpecialChars, r.MinSpecialChars, path)
+	p.setString("key_contain", &p.KeyContain, r.KeyContain, path)
+	p.setInt("min_entropy_bits", &p.MinEntropyBits, r.MinEntropyBits, path)
+	p.setString("temp_key", &p.TempKey, r.TempKey, path)
+	p.setInt("temp_key_max_usage", &p.TempKeyMaxUsage, r.TempKeyMaxUsage, path)
+	p.setInt("lockout_threshold", &p.LockoutThreshold, r.LockoutThreshold, path)
+	p.setInt("lockout_minutes", &p.LockoutMinutes, r.LockoutMinutes, path)
+	p.setInt("require_mac", &p.RequireMAC, r.RequireMAC, path)
+	p.setString("key_hint", &p.KeyHint, r.KeyHint, path)
+	return nil
+}
+
+// setInt overrides a numeric rule if the file sets it
+func (p *Policy) setInt(key string, dst *int, value *int, source string) {
+	if value != nil {
+		*dst = *value
+		p.Sources[key] = source
+	}
+}
+
+// setString overrides a text rule if the file sets it. As in build_config.yml,
+// "empty" stands for an empty value.
+func (p *Policy) setString(key string, dst *string, value *string, source string) {
+	if value != nil {
+		*dst = *value
+		if *dst == "empty" {
+			*dst = ""
+		}
+		p.Sources[key] = source
+	}
+}
+
+// Validate checks that the rules are consistent and can be satisfied
+func (p *Policy) Validate() error {
+	if p.MinKeyLength < 0 {
+		return fmt.Errorf("min_key_length must not be negative")
+	}
+	if p.MinSpecialChars < 0 {
+		return fmt.Errorf("min_special_chars must not be negative")
+	}
+	if p.MinEntropyBits < 0 {
+		return fmt.Errorf("min_entropy_bits must not be negative")
+	}
+	if p.TempKeyMaxUsage < 0 {
+		return fmt.Errorf("temp_key_max_usage must not be negative")
+	}
+	if p.LockoutThreshold < 0 {
+		return fmt.Errorf("lockout_threshold must not be negative")
+	}
+	if p.LockoutThreshold > 0 && p.LockoutMinutes <= 0 {
+		return fmt.Errorf("lockout_minutes must be positive when lockout_threshold is set")
+	}
+	if p.RequireMAC != 0 && p.RequireMAC != 1 {
+		return fmt.Errorf("require_mac must be 0 or 1")
+	}
+	if distinct := countDistinct(p.RequiredChars); p.RequiredChars != "" && p.MinSpecialChars > distinct {
+		return fmt.Errorf("min_special_chars %d can never be met with %d distinct required_chars", p.MinSpecialChars, distinct)
+	}
+	return nil
+}
+
+// countDistinct returns the number of distinct characters in s
+func countDistinct(s string) int {
+	seen := make(map[rune]bool)
+	for _, r := range s {
+		seen[r] = true
+	}
+	return len(seen)
+}
+
+// Rules lists the rules with their sources in a fixed order. Secret values are masked.
+func (p *Policy) Rules() []PolicyRule {
+	tempKey := ""
+	if p.TempKey != "" {
+		tempKey = "*"
+	}
+
+	rules := []PolicyRule{
+		{Key: "min_key_length", Value: strconv.Itoa(p.MinKeyLength)},
+		{Key: "key_prefix", Value: strconv.Quote(p.KeyPrefix)},
+		{Key: "key_suffix", Value: strconv.Quote(p.KeySuffix)},
+		{Key: "required_chars", Value: strconv.Quote(p.RequiredChars)},
+		{Key: "min_special_chars", Value: strconv.Itoa(p.MinSpecialChars)},
+		{Key: "key_contain", Value: strconv.Quote(p.KeyContain)},
+		{Key: "min_entropy_bits", Value: strconv.Itoa(p.MinEntropyBits)},
+		{Key: "temp_key", Value: tempKey, Secret: true},
+		{Key: "temp_key_max_usage", Value: strconv.Itoa(p.TempKeyMaxUsage)},
+		{Key: "lockout_threshold", Value: strconv.Itoa(p.LockoutThreshold)},
+		{Key: "lockout_minutes", Value: strconv.Itoa(p.LockoutMinutes)},
+		{Key: "require_mac", Value: strconv.Itoa(p.RequireMAC)},
+		{Key: "key_hint", Value: strconv.Quote(p.KeyHint)},
+	}
+	for i := range rules {
+		rules[i].Source = p.Sources[rules[i].Key]
+	}
+	return rules
+}
+
+// Check reports whether a key satisfies the rules; the temporary key is not considered
+func (p *Policy) Check(key string) bool {
+	return len(p.Explain(key)) == 0
+}
+
+// Explain lists the rules a key breaks; the temporary key is not considered
+// The result reveals the policy, so it should only be shown on request or to someone creating a key.
+func (p *Policy) Explain(key string) []Violation {
+	violations := ExplainKeyWithRules(key, p.MinKeyLength, p.KeyPrefix, p.KeySuffix, p.RequiredChars, p.MinSpecialChars, p.KeyContain)
+
+	// The structural rules say nothing about guessability: "lh-key!!aaaaaaaaau" satisfies them all
+	if p.MinEntropyBits > 0 {
+		if bits := int(EstimateStrength(key).Bits); bits < p.MinEntropyBits {
+			violations = append(violations, Violation{Rule: "min_entropy_bits", Want: p.MinEntropyBits, Got: bits})
+		}
+	}
+	return violations
+}
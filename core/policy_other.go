@@ -0,0 +1,10 @@
+//go:build !unix
+
+package core
+
+import "os"
+
+// ownedByRoot reports whether a file belongs to root, which is never the case on this platform
+func ownedByRoot(info os.FileInfo) bool {
+	return false
+}
@@ -0,0 +1,294 @@
+package core
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// writePolicy writes a policy file with permissions 0600 and returns its path
+func writePolicy(t *testing.T, dir, name, content string) string {
+	t.Helper()
+	path := filepath.Join(dir, name)
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		t.Fatalf("Failed to create dir: %v", err)
+	}
+	if err := os.WriteFile(path, []byte(content), 0600); err != nil {
+		t.Fatalf("Failed to write policy: %v", err)
+	}
+	return path
+}
+
+func TestBuiltinPolicy(t *testing.T) {
+	policy, err := BuiltinPolicy()
+	if err != nil {
+		t.Fatalf("BuiltinPolicy failed: %v", err)
+	}
+	if policy.MinKeyLength != 16 || policy.KeyPrefix != "lh-" || policy.MinSpecialChars != 2 {
+		t.Errorf("Unexpected built-in policy: %+v", policy)
+	}
+	if policy.Sources["min_key_length"] != SourceBuiltin {
+		t.Errorf("Expected built-in source, got %q", policy.Sources["min_key_length"])
+	}
+
+	// Junk in the ldflags values is reported instead of silently becoming 0
+	original := MinKeyLength
+	MinKeyLength = "sixteen"
+	defer func() { MinKeyLength = original }()
+	if _, err := BuiltinPolicy(); err == nil {
+		t.Errorf("Expected error for a non-numeric MinKeyLength")
+	}
+	if ValidateKey("lh-test-key-1234!@u") {
+		t.Errorf("Expected every key to be rejected with an invalid policy")
+	}
+}
+
+// useSystemPolicyDir points SystemPolicyDir at dir for the duration of the test
+func useSystemPolicyDir(t *testing.T, dir string) {
+	t.Helper()
+	original := SystemPolicyDir
+	SystemPolicyDir = dir
+	t.Cleanup(func() { SystemPolicyDir = original })
+}
+
+func TestLoadPolicy_File(t *testing.T) {
+	dir := t.TempDir()
+	useSystemPolicyDir(t, dir)
+	path := writePolicy(t, dir, "policy.yml", `security_rules:
+  min_key_length: 8
+  key_prefix: "empty"
+  key_suffix: ""
+  temp_key: "temporary"
+`)
+	t.Setenv("LHKM_POLICY", "")
+	t.Setenv("XDG_CONFIG_HOME", t.TempDir())
+
+	policy, err := LoadPolicy()
+	if err != nil {
+		t.Fatalf("LoadPolicy failed: %v", err)
+	}
+	if policy.MinKeyLength != 8 || policy.KeyPrefix != "" || policy.KeySuffix != "" || policy.TempKey != "temporary" {
+		t.Errorf("Unexpected policy: %+v", policy)
+	}
+	if policy.KeyContain != "key" {
+		t.Errorf("Expected unset rules to keep the built-in value, got %q", policy.KeyContain)
+	}
+	if policy.Sources["min_key_length"] != path || policy.Sources["key_contain"] != SourceBuiltin {
+		t.Errorf("Unexpected sources: %v", policy.Sources)
+	}
+
+	// The system policy may relax the built-in rules, and they apply to ValidateKey
+	if !ValidateKey("my-key!@x") {
+		t.Errorf("Expected key to satisfy the relaxed policy")
+	}
+	if ValidateKey("key!@x") {
+		t.Errorf("Expected key shorter than 8 characters to be rejected")
+	}
+}
+
+func TestLoadPolicy_UserCannotRelax(t *testing.T) {
+	useSystemPolicyDir(t, t.TempDir())
+	userPath := writePolicy(t, t.TempDir(), "user.yml", `security_rules:
+  min_key_length: 8
+  key_prefix: "empty"
+  key_suffix: "xu"
+  required_chars: "!@#"
+  lockout_threshold: 0
+  temp_key: "temporary"
+  key_hint: "ask the team"
+`)
+	// $LHKM_POLICY and the file in the user config directory are both only a user layer
+	for _, explicit := range []bool{true, false} {
+		if explicit {
+			t.Setenv("LHKM_POLICY", userPath)
+		} else {
+			configDir := t.TempDir()
+			data, err := os.ReadFile(userPath)
+			if err != nil {
+				t.Fatalf("Failed to read policy: %v", err)
+			}
+			userPath = writePolicy(t, configDir, "lhkeymanager/policy.yml", string(data))
+			t.Setenv("LHKM_POLICY", "")
+			t.Setenv("XDG_CONFIG_HOME", configDir)
+			t.Setenv("HOME", configDir) // os.UserConfigDir on macOS
+		}
+
+		policy, err := LoadPolicy()
+		if err != nil {
+			t.Fatalf("LoadPolicy failed: %v", err)
+		}
+		if policy.MinKeyLength != 16 || policy.KeyPrefix != "lh-" || policy.TempKey != "" {
+			t.Errorf("Expected weaker user rules to be ignored, got %+v", policy)
+		}
+		if policy.KeySuffix != "xu" || policy.RequiredChars != "!@#" || policy.KeyHint != "ask the team" {
+			t.Errorf("Expected stricter user rules to apply, got %+v", policy)
+		}
+		if policy.Sources["key_suffix"] != userPath || policy.Sources["min_key_length"] != SourceBuiltin {
+			t.Errorf("Unexpected sources: %v", policy.Sources)
+		}
+
+		var ignored []string
+		for _, rule := range policy.Ignored {
+			ignored = append(ignored, rule.Key)
+		}
+		if strings.Join(ignored, ",") != "min_key_length,key_prefix,temp_key" {
+			t.Errorf("Unexpected ignored rules: %v", ignored)
+		}
+		if ValidateKey("temporary") {
+			t.Errorf("Expected the ignored temporary key to be rejected")
+		}
+	}
+}
+
+func TestLoadPolicy_UserTightensSystem(t *testing.T) {
+	dir := t.TempDir()
+	useSystemPolicyDir(t, dir)
+	writePolicy(t, dir, "policy.yml", "security_rules:\n  lockout_threshold: 10\n  min_key_length: 20\n")
+
+	testCases := []struct {
+		name      string
+		content   string
+		threshold int
+		length    int
+	}{
+		{name: "Lower threshold", content: "security_rules:\n  lockout_threshold: 3\n", threshold: 3, length: 20},
+		{name: "Disabled lockout", content: "security_rules:\n  lockout_threshold: 0\n", threshold: 10, length: 20},
+		{name: "Higher threshold", content: "security_rules:\n  lockout_threshold: 20\n", threshold: 10, length: 20},
+		{name: "Longer key", content: "security_rules:\n  min_key_length: 24\n", threshold: 10, length: 24},
+		{name: "Below the system but above the built-in", content: "security_rules:\n  min_key_length: 18\n", threshold: 10, length: 20},
+	}
+
+	for i, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			t.Setenv("LHKM_POLICY", writePolicy(t, t.TempDir(), strings.Repeat("u", i+1)+".yml", tc.content))
+			policy, err := LoadPolicy()
+			if err != nil {
+				t.Fatalf("LoadPolicy failed: %v", err)
+			}
+			if policy.LockoutThreshold != tc.threshold || policy.MinKeyLength != tc.length {
+				t.Errorf("Expected threshold %d and length %d, got %d and %d",
+					tc.threshold, tc.length, policy.LockoutThreshold, policy.MinKeyLength)
+			}
+		})
+	}
+}
+
+func TestLoadPolicy_JSON(t *testing.T) {
+	useSystemPolicyDir(t, t.TempDir())
+	path := writePolicy(t, t.TempDir(), "policy.json", `{"security_rules": {"min_key_length": 30, "key_hint": "ask the team"}}`)
+	t.Setenv("LHKM_POLICY", path)
+
+	policy, err := LoadPolicy()
+	if err != nil {
+		t.Fatalf("LoadPolicy failed: %v", err)
+	}
+	if policy.MinKeyLength != 30 || policy.KeyHint != "ask the team" {
+		t.Errorf("Unexpected policy: %+v", policy)
+	}
+}
+
+func TestLoadPolicy_UserConfig(t *testing.T) {
+	dir := t.TempDir()
+	useSystemPolicyDir(t, t.TempDir())
+	writePolicy(t, dir, "lhkeymanager/policy.yml", "security_rules:\n  min_key_length: 24\n")
+	t.Setenv("LHKM_POLICY", "")
+	t.Setenv("XDG_CONFIG_HOME", dir)
+	t.Setenv("HOME", dir) // os.UserConfigDir on macOS
+
+	files := PolicyFiles()
+	if len(files) != 2 || !strings.HasPrefix(files[0], SystemPolicyDir) {
+		t.Fatalf("Expected system and user policy files, got %v", files)
+	}
+
+	policy, err := LoadPolicy()
+	if err != nil {
+		t.Fatalf("LoadPolicy failed: %v", err)
+	}
+	if policy.MinKeyLength != 24 {
+		t.Errorf("Expected the user policy to apply, got %d", policy.MinKeyLength)
+	}
+}
+
+func TestLoadPolicy_Errors(t *testing.T) {
+	dir := t.TempDir()
+	testCases := []struct {
+		name    string
+		content string
+		perm    os.FileMode
+	}{
+		{name: "Unknown field", content: "security_rules:\n  min_len: 4\n", perm: 0600},
+		{name: "Wrong type", content: "security_rules:\n  min_key_length: many\n", perm: 0600},
+		{name: "Negative", content: "security_rules:\n  min_key_length: -1\n", perm: 0600},
+		{name: "Impossible", content: "security_rules:\n  required_chars: \"!!\"\n  min_special_chars: 2\n", perm: 0600},
+		{name: "Lockout without duration", content: "security_rules:\n  lockout_threshold: 5\n  lockout_minutes: 0\n", perm: 0600},
+		{name: "Require MAC not a flag", content: "security_rules:\n  require_mac: 2\n", perm: 0600},
+		{name: "Writable by others", content: "security_rules:\n  min_key_length: 1\n", perm: 0666},
+	}
+
+	for i, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			path := writePolicy(t, dir, strings.Repeat("p", i+1)+".yml", tc.content)
+			if err := os.Chmod(path, tc.perm); err != nil {
+				t.Fatalf("Failed to chmod: %v", err)
+			}
+			t.Setenv("LHKM_POLICY", path)
+			if _, err := LoadPolicy(); err == nil {
+				t.Errorf("Expected error")
+			}
+		})
+	}
+
+	// An explicitly named policy file must exist
+	t.Setenv("LHKM_POLICY", filepath.Join(dir, "missing.yml"))
+	if _, err := LoadPolicy(); err == nil {
+		t.Errorf("Expected error for a missing explicit policy file")
+	}
+}
+
+func TestLoadPolicy_TempKeyFilePermissions(t *testing.T) {
+	testCases := []struct {
+		name    string
+		content string
+		perm    os.FileMode
+		ok      bool
+	}{
+		{name: "Private with temp key", content: "security_rules:\n  temp_key: \"temporary\"\n", perm: 0600, ok: true},
+		{name: "World-readable with temp key", content: "security_rules:\n  temp_key: \"temporary\"\n", perm: 0644},
+		{name: "World-readable without temp key", content: "security_rules:\n  min_key_length: 30\n", perm: 0644, ok: true},
+		{name: "World-readable clearing temp key", content: "security_rules:\n  temp_key: \"\"\n", perm: 0644, ok: true},
+		// Only a root-owned file may share the temporary key with its group
+		{name: "Group-readable with temp key", content: "security_rules:\n  temp_key: \"temporary\"\n", perm: 0640, ok: os.Getuid() == 0},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			dir := t.TempDir()
+			useSystemPolicyDir(t, dir)
+			path := writePolicy(t, dir, "policy.yml", tc.content)
+			if err := os.Chmod(path, tc.perm); err != nil {
+				t.Fatalf("Failed to chmod: %v", err)
+			}
+			if _, err := LoadPolicy(); (err == nil) != tc.ok {
+				t.Errorf("LoadPolicy() error = %v, expected ok=%v", err, tc.ok)
+			}
+		})
+	}
+}
+
+func TestPolicyRules_HidesTempKey(t *testing.T) {
+	policy, err := BuiltinPolicy()
+	if err != nil {
+		t.Fatalf("BuiltinPolicy failed: %v", err)
+	}
+	policy.TempKey = "super-secret"
+
+	for _, rule := range policy.Rules() {
+		if strings.Contains(rule.Value, "super-secret") {
+			t.Errorf("Rule %s reveals the temporary key", rule.Key)
+		}
+		if rule.Key == "temp_key" && (!rule.Secret || rule.Value == "") {
+			t.Errorf("Expected temp_key to be marked secret and set, got %+v", rule)
+		}
+	}
+}
@@ -0,0 +1,311 @@
+package core
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strconv"
+
+	"github.com/clh021/lhkeymanager/utils"
+)
+
+// The state file records how often each temporary key has been used, the named temporary keys
+// created with AddTempKey, the count of rejected keys, and which .env files were signed. It never contains a key:
+// entries are looked up by a salted hash, and each usage count carries an HMAC keyed with the
+// owner secret, which is derived from the encryption key when the state is first claimed.
+// A temporary key without a count isn't accepted, so deleting its entry or the whole file uses
+// it up instead of resetting it.
+//
+// This is not tamper protection. Redeeming a temporary key has to update its count without the
+// encryption key, so the owner secret is stored in plaintext next to the MACs. Anyone who can
+// write the state file can compute a valid MAC for any count; the MAC only catches edits made
+// without reading the file, such as a count changed by hand or copied from another entry.
+// The counts are enforced by lhkeymanager and by the permissions of the state directory.
+
+// stateVersion identifies the layout of the state file
+const stateVersion = 1
+
+// stateFileName and stateLockName are the state file and its lock file in StateDir
+const (
+	stateFileName = "state.json"
+	stateLockName = "state.lock"
+)
+
+// Errors of the state file
+var (
+	// ErrStateTampered is returned when a usage count in the state file doesn't match its HMAC
+	ErrStateTampered = errors.New("temporary key state was modified")
+	// ErrNotOwner is returned when a key other than the one the state was set up with tries to change it
+	ErrNotOwner = errors.New("the state belongs to another encryption key")
+	// ErrNoTempKey is returned by ArmTempKey when the policy doesn't set a temporary key
+	ErrNoTempKey = errors.New("the policy sets no temporary key")
+)
+
+// stateFile is the layout of the state file
+type stateFile struct {
+	Version  int                     `json:"version"`
+	Salt     string                  `json:"salt"`      // base64 salt of the key hashes
+	TempKeys map[string]tempKeyEntry `json:"temp_keys"` // by tempKeyID
+
+	// Owner holds the secret that authenticates the temporary key entries, see claimOwner
+	Owner *ownerRecord `json:"owner,omitempty"`
+
+	// NamedKeys are the temporary keys created with AddTempKey, in creation order
+	NamedKeys []namedTempKeyEntry `json:"named_keys,omitempty"`
+
+	// Failures counts rejected keys for the backoff and lockout, see BeginKeyAttempt
+	Failures failureState `json:"failures"`
+
+	// SignedFiles are the .env files that were signed, by signedFileID; they must stay signed
+	SignedFiles []string `json:"signed_files,omitempty"`
+}
+
+// tempKeyEntry is the usage record of one temporary key
+type tempKeyEntry struct {
+	Uses int    `json:"uses"`
+	MAC  string `json:"mac"` // hex HMAC of the ID and the count, see entryMAC
+}
+
+// ownerRecord is the owner secret and how it was derived from the encryption key
+type ownerRecord struct {
+	KDF    string `json:"kdf"`    // Argon2id cost settings
+	Salt   string `json:"salt"`   // base64
+	Secret string `json:"secret"` // base64 HMAC key in plaintext, see deriveOwnerSecret
+}
+
+// StateDir returns the directory for lhkeymanager's state: $XDG_STATE_HOME/lhkeymanager,
+// ~/.local/state/lhkeymanager if that is unset, or %LOCALAPPDATA%\lhkeymanager on Windows
+func StateDir() (string, error) {
+	if dir := os.Getenv("XDG_STATE_HOME"); dir != "" {
+		return filepath.Join(dir, "lhkeymanager"), nil
+	}
+	if runtime.GOOS == "windows" {
+		if dir := os.Getenv("LOCALAPPDATA"); dir != "" {
+			return filepath.Join(dir, "lhkeymanager"), nil
+		}
+	}
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return "", fmt.Errorf("cannot determine state directory: %w", err)
+	}
+	return filepath.Join(home, ".local", "state", "lhkeymanager"), nil
+}
+
+// useTempKey records one use of a temporary key, unless it has been used maxUsage times already
+// or has no usage record, see ArmTempKey.
+// The state file is locked for the whole read-check-write, so concurrent calls can't both take the last use.
+// Returns whether the use is allowed, or an error if the state can't be read, verified or written;
+// callers must then treat the key as invalid
+func useTempKey(key string, maxUsage int) (bool, error) {
+	allowed := false
+	err := updateState(func(state *stateFile) (bool, error) {
+		id := state.tempKeyID(key)
+		entry, ok := state.TempKeys[id]
+		if !ok {
+			return false, nil
+		}
+		secret, ok := state.ownerSecret()
+		if !ok || !hmac.Equal([]byte(entry.MAC), []byte(entryMAC(secret, id, entry.Uses))) {
+			return false, ErrStateTampered
+		}
+		if entry.Uses >= maxUsage {
+			return false, nil
+		}
+
+		allowed = true
+		state.TempKeys[id] = tempKeyEntry{Uses: entry.Uses + 1, MAC: entryMAC(secret, id, entry.Uses+1)}
+		return true, nil
+	})
+	return allowed, err
+}
+
+// ArmTempKey resets the usage count of the policy's temporary key, which is only accepted while it has one
+// encryptionKey: the key the state belongs to, see claimOwner; never the temporary key itself
+// Returns ErrNoTempKey if the policy sets no temporary key, or ErrNotOwner for another encryption key
+func ArmTempKey(encryptionKey string) error {
+	policy, err := LoadPolicy()
+	if err != nil {
+		return err
+	}
+	if policy.TempKey == "" {
+		return ErrNoTempKey
+	}
+	return armTempKey(encryptionKey, policy.TempKey)
+}
+
+// armTempKey implements ArmTempKey for any temporary key
+func armTempKey(encryptionKey, tempKey string) error {
+	if encryptionKey == tempKey {
+		return fmt.Errorf("invalid encryption key")
+	}
+	return updateState(func(state *stateFile) (bool, error) {
+		secret, err := state.claimOwner(encryptionKey)
+		if err != nil {
+			return false, err
+		}
+		id := state.tempKeyID(tempKey)
+		state.TempKeys[id] = tempKeyEntry{Uses: 0, MAC: entryMAC(secret, id, 0)}
+		return true, nil
+	})
+}
+
+// updateState locks the state file, reads it and passes it to fn, which reports whether it changed the state.
+// A changed state is written back before the lock is released.
+func updateState(fn func(state *stateFile) (bool, error)) error {
+	dir, err := StateDir()
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return err
+	}
+
+	unlock, err := utils.LockFile(filepath.Join(dir, stateLockName))
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	path := filepath.Join(dir, stateFileName)
+	state, err := readStateFile(path)
+	if err != nil {
+		return err
+	}
+	changed, err := fn(state)
+	if err != nil || !changed {
+		return err
+	}
+	return writeStateFile(path, state)
+}
+
+// loadState reads the state file without locking it; the file is only ever replaced atomically
+func loadState() (*stateFile, error) {
+	dir, err := StateDir()
+	if err != nil {
+		return nil, err
+	}
+	return readStateFile(filepath.Join(dir, stateFileName))
+}
+
+// readStateFile reads the state file, or returns a new state with a fresh salt if it doesn't exist
+func readStateFile(path string) (*stateFile, error) {
+	content, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		salt := make([]byte, 16)
+		if _, err := rand.Read(salt); err != nil {
+			return nil, err
+		}
+		return &stateFile{
+			Version:  stateVersion,
+			Salt:     base64.StdEncoding.EncodeToString(salt),
+			TempKeys: make(map[string]tempKeyEntry),
+		}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var state stateFile
+	if err := json.Unmarshal(content, &state); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	if state.Version != stateVersion {
+		return nil, fmt.Errorf("%s: unsupported state version %d", path, state.Version)
+	}
+	if _, err := base64.StdEncoding.DecodeString(state.Salt); err != nil || state.Salt == "" {
+		return nil, fmt.Errorf("%s: invalid salt", path)
+	}
+	if state.TempKeys == nil {
+		state.TempKeys = make(map[string]tempKeyEntry)
+	}
+	return &state, nil
+}
+
+// writeStateFile writes the state file atomically with permissions 0600
+func writeStateFile(path string, state *stateFile) error {
+	content, err := json.MarshalIndent(state, "", "  ")
+	if err != nil {
+		return err
+	}
+	return utils.WriteFileAtomic(path, append(content, '\n'), 0600)
+}
+
+// tempKeyID returns the salted hash under which a temporary key's usage is stored
+func (s *stateFile) tempKeyID(key string) string {
+	salt, _ := base64.StdEncoding.DecodeString(s.Salt) // Checked by readStateFile
+	h := hmac.New(sha256.New, salt)
+	h.Write([]byte(key))
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// entryMAC authenticates a usage count with the owner secret
+func entryMAC(secret []byte, id string, uses int) string {
+	h := hmac.New(sha256.New, secret)
+	h.Write([]byte("lhkm-state-v" + strconv.Itoa(stateVersion) + ":" + id + ":" + strconv.Itoa(uses)))
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// deriveOwnerSecret derives the owner secret from the encryption key
+func deriveOwnerSecret(encryptionKey string, salt []byte, params utils.KDFParams) []byte {
+	h := hmac.New(sha256.New, utils.DeriveKey(encryptionKey, salt, params))
+	h.Write([]byte("lhkeymanager state owner"))
+	return h.Sum(nil)
+}
+
+// claimOwner checks that the encryption key is the one the state belongs to, or makes the state
+// belong to it if no key has claimed it yet. Only keys that satisfy the main policy rules are accepted.
+// Returns the owner secret, or ErrNotOwner for another key
+func (s *stateFile) claimOwner(encryptionKey string) ([]byte, error) {
+	if !ValidateMainKey(encryptionKey) {
+		return nil, fmt.Errorf("invalid encryption key")
+	}
+
+	if s.Owner == nil {
+		params := ConfiguredKDFParams()
+		salt := make([]byte, 16)
+		if _, err := rand.Read(salt); err != nil {
+			return nil, err
+		}
+		secret := deriveOwnerSecret(encryptionKey, salt, params)
+		s.Owner = &ownerRecord{
+			KDF:    params.String(),
+			Salt:   base64.StdEncoding.EncodeToString(salt),
+			Secret: base64.StdEncoding.EncodeToString(secret),
+		}
+		return secret, nil
+	}
+
+	params, err := utils.ParseKDFParams(s.Owner.KDF)
+	if err != nil {
+		return nil, fmt.Errorf("invalid owner record: %w", err)
+	}
+	salt, err := base64.StdEncoding.DecodeString(s.Owner.Salt)
+	if err != nil {
+		return nil, fmt.Errorf("invalid owner record: %w", err)
+	}
+	stored, ok := s.ownerSecret()
+	if !ok {
+		return nil, fmt.Errorf("invalid owner record")
+	}
+	if secret := deriveOwnerSecret(encryptionKey, salt, params); !hmac.Equal(secret, stored) {
+		return nil, ErrNotOwner
+	}
+	return stored, nil
+}
+
+// ownerSecret returns the stored owner secret, or false if no key has claimed the state
+func (s *stateFile) ownerSecret() ([]byte, bool) {
+	if s.Owner == nil {
+		return nil, false
+	}
+	secret, err := base64.StdEncoding.DecodeString(s.Owner.Secret)
+	return secret, err == nil && len(secret) == sha256.Size
+}
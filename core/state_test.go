@@ -0,0 +1,249 @@
+package core
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// TestMain keeps every test out of the user's state directory; signing a file records it there
+// TestMain keeps the tests away from the state, policies and home directory of the machine they run on
+func TestMain(m *testing.M) {
+	dir, err := os.MkdirTemp("", "lhkm-test")
+	if err != nil {
+		panic(err)
+	}
+	os.Setenv("XDG_STATE_HOME", filepath.Join(dir, "state"))
+	os.Setenv("XDG_CONFIG_HOME", filepath.Join(dir, "config"))
+	os.Setenv("HOME", filepath.Join(dir, "home"))
+	os.Unsetenv("LHKM_POLICY")
+	SystemPolicyDir = filepath.Join(dir, "system")
+	code := m.Run()
+	os.RemoveAll(dir)
+	os.Exit(code)
+}
+
+// stateTestDir points the state directory to a temporary directory and returns the state file path
+func stateTestDir(t *testing.T) string {
+	t.Helper()
+	dir := t.TempDir()
+	t.Setenv("XDG_STATE_HOME", dir)
+	return filepath.Join(dir, "lhkeymanager", stateFileName)
+}
+
+// chdirTemp changes into a temporary directory for the rest of the test
+func chdirTemp(t *testing.T) {
+	t.Helper()
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatalf("Failed to get working directory: %v", err)
+	}
+	if err := os.Chdir(t.TempDir()); err != nil {
+		t.Fatalf("Failed to change directory: %v", err)
+	}
+	t.Cleanup(func() { os.Chdir(wd) })
+}
+
+func TestStateDir(t *testing.T) {
+	t.Setenv("XDG_STATE_HOME", "/tmp/state-home")
+	dir, err := StateDir()
+	if err != nil || dir != filepath.Join("/tmp/state-home", "lhkeymanager") {
+		t.Errorf("Expected $XDG_STATE_HOME/lhkeymanager, got %q (%v)", dir, err)
+	}
+
+	t.Setenv("XDG_STATE_HOME", "")
+	t.Setenv("HOME", "/home/someone")
+	dir, err = StateDir()
+	if err != nil || dir != filepath.Join("/home/someone", ".local", "state", "lhkeymanager") {
+		t.Errorf("Expected ~/.local/state/lhkeymanager, got %q (%v)", dir, err)
+	}
+}
+
+// testOwnerKey satisfies the built-in policy; tests use it to claim the state
+const testOwnerKey = "lh-test-key-1234!@u"
+
+// readTestState reads the state file at path
+func readTestState(t *testing.T, path string) *stateFile {
+	t.Helper()
+	content, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("Failed to read state file: %v", err)
+	}
+	var state stateFile
+	if err := json.Unmarshal(content, &state); err != nil {
+		t.Fatalf("Failed to parse state: %v", err)
+	}
+	return &state
+}
+
+// writeTestState replaces the state file at path
+func writeTestState(t *testing.T, path string, state *stateFile) {
+	t.Helper()
+	content, _ := json.Marshal(state)
+	if err := os.WriteFile(path, content, 0600); err != nil {
+		t.Fatalf("Failed to write state: %v", err)
+	}
+}
+
+func TestUseTempKey_StoresOnlyHash(t *testing.T) {
+	path := stateTestDir(t)
+	key := "temp-key-for-test"
+
+	if err := armTempKey(testOwnerKey, key); err != nil {
+		t.Fatalf("armTempKey failed: %v", err)
+	}
+	if ok, err := useTempKey(key, 2); !ok || err != nil {
+		t.Fatalf("Expected first use to be allowed, got %v (%v)", ok, err)
+	}
+
+	content, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("Failed to read state file: %v", err)
+	}
+	if strings.Contains(string(content), key) || strings.Contains(string(content), testOwnerKey) {
+		t.Errorf("State file contains a key: %s", content)
+	}
+	info, _ := os.Stat(path)
+	if info.Mode().Perm() != 0600 {
+		t.Errorf("Expected permissions 0600, got %v", info.Mode().Perm())
+	}
+
+	// The count follows the key, not the working directory
+	chdirTemp(t)
+	if ok, _ := useTempKey(key, 2); !ok {
+		t.Errorf("Expected second use to be allowed")
+	}
+	if ok, _ := useTempKey(key, 2); ok {
+		t.Errorf("Expected third use to be refused after changing directory")
+	}
+}
+
+func TestUseTempKey_Tampered(t *testing.T) {
+	path := stateTestDir(t)
+	key := "temp-key-for-test"
+
+	armTempKey(testOwnerKey, key)
+	useTempKey(key, 1)
+	if ok, _ := useTempKey(key, 1); ok {
+		t.Fatalf("Expected the key to be used up")
+	}
+
+	// Resetting the count is detected, also when the HMAC is recomputed with the temporary key
+	state := readTestState(t, path)
+	for id := range state.TempKeys {
+		forged := hmac.New(sha256.New, []byte(key))
+		forged.Write([]byte("lhkeymanager temp key state"))
+		h := hmac.New(sha256.New, forged.Sum(nil))
+		h.Write([]byte("lhkm-state-v1:" + id + ":0"))
+		state.TempKeys[id] = tempKeyEntry{Uses: 0, MAC: hex.EncodeToString(h.Sum(nil))}
+	}
+	writeTestState(t, path, state)
+	if ok, err := useTempKey(key, 1); ok || err != ErrStateTampered {
+		t.Errorf("Expected ErrStateTampered, got %v (%v)", ok, err)
+	}
+
+	// So is a count without an owner
+	state.Owner = nil
+	writeTestState(t, path, state)
+	if ok, err := useTempKey(key, 1); ok || err != ErrStateTampered {
+		t.Errorf("Expected ErrStateTampered without an owner, got %v (%v)", ok, err)
+	}
+
+	// A corrupt file fails closed
+	os.WriteFile(path, []byte("{"), 0600)
+	if ok, err := useTempKey(key, 1); ok || err == nil {
+		t.Errorf("Expected an error for a corrupt state file, got %v", ok)
+	}
+}
+
+func TestUseTempKey_Deleted(t *testing.T) {
+	path := stateTestDir(t)
+	key := "temp-key-for-test"
+
+	// A key that was never armed has no uses
+	if ok, err := useTempKey(key, 2); ok || err != nil {
+		t.Errorf("Expected an unarmed key to be refused, got %v (%v)", ok, err)
+	}
+
+	// Deleting the entry uses the key up instead of resetting it
+	armTempKey(testOwnerKey, key)
+	useTempKey(key, 2)
+	state := readTestState(t, path)
+	state.TempKeys = nil
+	writeTestState(t, path, state)
+	if ok, err := useTempKey(key, 2); ok || err != nil {
+		t.Errorf("Expected the key to be refused without its entry, got %v (%v)", ok, err)
+	}
+
+	// So does deleting the whole file
+	armTempKey(testOwnerKey, key)
+	if err := os.Remove(path); err != nil {
+		t.Fatalf("Failed to remove state file: %v", err)
+	}
+	if ok, err := useTempKey(key, 2); ok || err != nil {
+		t.Errorf("Expected the key to be refused without the state file, got %v (%v)", ok, err)
+	}
+}
+
+func TestArmTempKey(t *testing.T) {
+	stateTestDir(t)
+	originalTempKey := TempKey
+	defer func() { TempKey = originalTempKey }()
+
+	TempKey = ""
+	if err := ArmTempKey(testOwnerKey); !errors.Is(err, ErrNoTempKey) {
+		t.Errorf("Expected ErrNoTempKey, got %v", err)
+	}
+
+	TempKey = "temp-key-for-test"
+	if err := ArmTempKey(TempKey); err == nil {
+		t.Errorf("Expected the temporary key to be refused as the encryption key")
+	}
+	if err := ArmTempKey("weak"); err == nil {
+		t.Errorf("Expected a key breaking the policy to be refused")
+	}
+	if err := ArmTempKey(testOwnerKey); err != nil {
+		t.Fatalf("ArmTempKey failed: %v", err)
+	}
+
+	// Once claimed, the state can only be changed with the same key
+	if err := ArmTempKey("lh-other-key-1234!@u"); !errors.Is(err, ErrNotOwner) {
+		t.Errorf("Expected ErrNotOwner, got %v", err)
+	}
+	if err := ArmTempKey(testOwnerKey); err != nil {
+		t.Errorf("Expected the owner to arm the key again, got %v", err)
+	}
+}
+
+func TestUseTempKey_Concurrent(t *testing.T) {
+	stateTestDir(t)
+	armTempKey(testOwnerKey, "temp-key-for-test")
+
+	// With one use left, exactly one of many concurrent callers gets it
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	allowed := 0
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if ok, err := useTempKey("temp-key-for-test", 1); ok && err == nil {
+				mu.Lock()
+				allowed++
+				mu.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+
+	if allowed != 1 {
+		t.Errorf("Expected exactly one allowed use, got %d", allowed)
+	}
+}
@@ -0,0 +1,441 @@
+package core
+
+import (
+	_ "embed"
+	"math"
+	"strings"
+	"sync"
+	"unicode"
+)
+
+// The strength estimate follows the approach of zxcvbn: the key is split into the cheapest
+// sequence of guessable patterns (dictionary words, keyboard walks, repeats, sequences, years),
+// with brute force for whatever is left. The cost of a pattern is the number of bits an attacker
+// who knows the pattern needs to guess it, so "password1" scores far lower than its length suggests.
+
+//go:embed wordlist.txt
+var wordlistData string
+
+// Pattern names used in StrengthMatch
+const (
+	PatternDictionary = "dictionary"
+	PatternKeyboard   = "keyboard"
+	PatternRepeat     = "repeat"
+	PatternSequence   = "sequence"
+	PatternYear       = "year"
+	PatternBruteForce = "bruteforce"
+)
+
+// minPatternLength is the shortest token that is matched against a pattern
+const minPatternLength = 3
+
+// maxEstimateLength caps the number of runes searched for patterns; the rest of a longer key
+// is scored as brute force, which keeps the estimate fast for keys of any length
+const maxEstimateLength = 256
+
+// Strength is the estimated guessing entropy of a key
+type Strength struct {
+	Bits    float64         // estimated entropy in bits
+	Matches []StrengthMatch // the cheapest split of the key, in key order
+}
+
+// StrengthMatch is a part of the key and the pattern it was guessed with.
+// It holds positions rather than the text, so it can be shown without revealing the key.
+type StrengthMatch struct {
+	Pattern    string  // one of the Pattern constants
+	Start, End int     // rune offsets of the part, End exclusive
+	Bits       float64 // entropy of this part
+}
+
+var (
+	wordRanks     map[string]int
+	maxWordLength int // in runes
+	wordRanksOnce sync.Once
+)
+
+// dictionary returns the bundled word list as a map from word to frequency rank, starting at 1,
+// and the length of its longest word in runes
+func dictionary() (map[string]int, int) {
+	wordRanksOnce.Do(func() {
+		wordRanks = make(map[string]int)
+		for _, line := range strings.Split(wordlistData, "\n") {
+			word := strings.TrimSpace(line)
+			if word == "" || strings.HasPrefix(word, "#") {
+				continue
+			}
+			if _, ok := wordRanks[word]; !ok {
+				wordRanks[word] = len(wordRanks) + 1
+				maxWordLength = max(maxWordLength, len([]rune(word)))
+			}
+		}
+	})
+	return wordRanks, maxWordLength
+}
+
+// EstimateStrength estimates how many bits of entropy a key has against a guessing attack
+// key: the key or passphrase to score
+// Returns the estimate with the patterns that were found
+func EstimateStrength(key string) Strength {
+	runes := []rune(key)
+	if len(runes) == 0 {
+		return Strength{}
+	}
+	// Only the start of a long key is searched for patterns
+	rest := runes[min(len(runes), maxEstimateLength):]
+	runes = runes[:len(runes)-len(rest)]
+	n := len(runes)
+
+	// candidates[j] holds the matches that end at rune j (exclusive)
+	candidates := make([][]StrengthMatch, n+1)
+	for _, m := range findMatches(runes) {
+		candidates[m.End] = append(candidates[m.End], m)
+	}
+	charBits := math.Log2(float64(cardinality(runes)))
+
+	// best[j] is the cheapest split of runes[:j]; each pattern costs one extra bit
+	// for the choice of pattern, which keeps many tiny matches from looking cheap
+	best := make([]float64, n+1)
+	from := make([]StrengthMatch, n+1)
+	for j := 1; j <= n; j++ {
+		best[j] = best[j-1] + charBits
+		from[j] = StrengthMatch{Pattern: PatternBruteForce, Start: j - 1, End: j, Bits: charBits}
+		for _, m := range candidates[j] {
+			if cost := best[m.Start] + m.Bits + 1; cost < best[j] {
+				best[j] = cost
+				from[j] = m
+			}
+		}
+	}
+
+	// Walk back through the split, merging adjacent brute force characters
+	var matches []StrengthMatch
+	for j := n; j > 0; {
+		m := from[j]
+		if m.Pattern == PatternBruteForce && len(matches) > 0 && matches[0].Pattern == PatternBruteForce {
+			matches[0].Start = m.Start
+			matches[0].Bits += m.Bits
+		} else {
+			matches = append([]StrengthMatch{m}, matches...)
+		}
+		j = m.Start
+	}
+
+	bits := best[n]
+	if len(rest) > 0 {
+		restBits := float64(len(rest)) * math.Log2(float64(cardinality(rest)))
+		if last := &matches[len(matches)-1]; last.Pattern == PatternBruteForce {
+			last.End += len(rest)
+			last.Bits += restBits
+		} else {
+			matches = append(matches, StrengthMatch{Pattern: PatternBruteForce, Start: n, End: n + len(rest), Bits: restBits})
+		}
+		bits += restBits
+	}
+	return Strength{Bits: bits, Matches: matches}
+}
+
+// findMatches returns every pattern match in the key
+func findMatches(runes []rune) []StrengthMatch {
+	var matches []StrengthMatch
+	matches = append(matches, dictionaryMatches(runes)...)
+	matches = append(matches, keyboardMatches(runes)...)
+	matches = append(matches, repeatMatches(runes)...)
+	matches = append(matches, sequenceMatches(runes)...)
+	matches = append(matches, yearMatches(runes)...)
+	return matches
+}
+
+// leetSubstitutions maps common character substitutions back to letters
+var leetSubstitutions = map[rune]rune{
+	'4': 'a', '@': 'a', '8': 'b', '(': 'c', '3': 'e', '6': 'g', '1': 'i', '!': 'i',
+	'|': 'l', '0': 'o', '$': 's', '5': 's', '7': 't', '+': 't', '2': 'z',
+}
+
+// dictionaryMatches finds words from the bundled list, also when reversed, capitalized or written in l33t.
+// Only tokens up to the length of the longest word are looked up.
+func dictionaryMatches(runes []rune) []StrengthMatch {
+	dict, longest := dictionary()
+	var matches []StrengthMatch
+	for i := 0; i < len(runes); i++ {
+		for j := i + minPatternLength; j <= min(len(runes), i+longest); j++ {
+			token := runes[i:j]
+
+			word, extra := strings.ToLower(string(token)), 0.0
+			rank, ok := dict[word]
+			if !ok {
+				rank, ok = dict[reverse(word)]
+				extra = 1
+			}
+			if !ok {
+				word, extra = unleet(token)
+				rank, ok = dict[word]
+			}
+			if !ok {
+				continue
+			}
+			bits := math.Log2(float64(rank)) + extra + caseBits(token)
+			matches = append(matches, StrengthMatch{Pattern: PatternDictionary, Start: i, End: j, Bits: bits})
+		}
+	}
+	return matches
+}
+
+// unleet lowercases a token and undoes l33t substitutions
+// Returns the plain word and one bit for every substituted character
+func unleet(token []rune) (string, float64) {
+	var b strings.Builder
+	extra := 0.0
+	for _, r := range token {
+		if plain, ok := leetSubstitutions[r]; ok {
+			r = plain
+			extra++
+		}
+		b.WriteRune(unicode.ToLower(r))
+	}
+	return b.String(), extra
+}
+
+// caseBits returns the extra bits for the capitalization of a word. Lowercase costs nothing,
+// a capitalized or all-caps word one bit, and other mixes one bit per uppercase letter.
+func caseBits(token []rune) float64 {
+	upper, letters := 0, 0
+	for _, r := range token {
+		if unicode.IsLetter(r) {
+			letters++
+			if unicode.IsUpper(r) {
+				upper++
+			}
+		}
+	}
+	switch {
+	case upper == 0:
+		return 0
+	case upper == letters || (upper == 1 && unicode.IsUpper(token[0])):
+		return 1
+	default:
+		return float64(upper)
+	}
+}
+
+// reverse returns s with its runes in reverse order
+func reverse(s string) string {
+	runes := []rune(s)
+	for i, j := 0, len(runes)-1; i < j; i, j = i+1, j-1 {
+		runes[i], runes[j] = runes[j], runes[i]
+	}
+	return string(runes)
+}
+
+// keyboardRows is a US QWERTY layout, unshifted and shifted, with the horizontal offset of each row
+var keyboardRows = []struct {
+	offset            float64
+	keys, shiftedKeys string
+}{
+	{0, "`1234567890-=", "~!@#$%^&*()_+"},
+	{1.5, "qwertyuiop[]\\", "QWERTYUIOP{}|"},
+	{1.75, "asdfghjkl;'", "ASDFGHJKL:\""},
+	{2.25, "zxcvbnm,./", "ZXCVBNM<>?"},
+}
+
+// keyPosition is the place of a key on the keyboard
+type keyPosition struct {
+	row     int
+	x       float64
+	shifted bool
+}
+
+var (
+	keyPositions     map[rune]keyPosition
+	keyPositionsOnce sync.Once
+)
+
+// keyboard returns the position of every key on the keyboard
+func keyboard() map[rune]keyPosition {
+	keyPositionsOnce.Do(func() {
+		keyPositions = make(map[rune]keyPosition)
+		for row, r := range keyboardRows {
+			for i, c := range r.keys {
+				keyPositions[c] = keyPosition{row: row, x: r.offset + float64(i)}
+			}
+			for i, c := range r.shiftedKeys {
+				keyPositions[c] = keyPosition{row: row, x: r.offset + float64(i), shifted: true}
+			}
+		}
+	})
+	return keyPositions
+}
+
+// keyDirection returns the direction from key a to an adjacent key b, or -1 if they aren't adjacent
+func keyDirection(a, b keyPosition) int {
+	dx := b.x - a.x
+	switch b.row - a.row {
+	case 0:
+		if dx == 1 {
+			return 0
+		} else if dx == -1 {
+			return 1
+		}
+	case -1, 1:
+		if math.Abs(dx) < 1 {
+			d := 2
+			if b.row > a.row {
+				d += 2
+			}
+			if dx > 0 {
+				d++
+			}
+			return d
+		}
+	}
+	return -1
+}
+
+// keyboardMatches finds walks over adjacent keys, like "qwerty" or "zaq1"
+func keyboardMatches(runes []rune) []StrengthMatch {
+	keys := keyboard()
+	// Starting key and direction; a change of direction costs as much as a new start
+	startBits := math.Log2(float64(len(keys) / 2))
+	turnBits := math.Log2(6)
+
+	var matches []StrengthMatch
+	for i := 0; i < len(runes); i++ {
+		prev, ok := keys[runes[i]]
+		if !ok {
+			continue
+		}
+		turns, shifted, direction := 0, 0, -1
+		if prev.shifted {
+			shifted++
+		}
+		for j := i + 1; j < len(runes); j++ {
+			pos, ok := keys[runes[j]]
+			if !ok {
+				break
+			}
+			d := keyDirection(prev, pos)
+			if d < 0 {
+				break
+			}
+			if d != direction {
+				turns++
+				direction = d
+			}
+			if pos.shifted {
+				shifted++
+			}
+			prev = pos
+
+			if length := j + 1 - i; length >= minPatternLength {
+				bits := startBits + math.Log2(float64(length)) + float64(turns)*turnBits
+				if shifted > 0 {
+					bits++
+				}
+				matches = append(matches, StrengthMatch{Pattern: PatternKeyboard, Start: i, End: j + 1, Bits: bits})
+			}
+		}
+	}
+	return matches
+}
+
+// repeatMatches finds runs of the same character, like "aaaa"; only the longest run at each place is a match
+func repeatMatches(runes []rune) []StrengthMatch {
+	var matches []StrengthMatch
+	for i := 0; i < len(runes); {
+		j := i + 1
+		for j < len(runes) && runes[j] == runes[i] {
+			j++
+		}
+		if length := j - i; length >= minPatternLength {
+			bits := math.Log2(float64(cardinality(runes[i:i+1]))) + math.Log2(float64(length))
+			matches = append(matches, StrengthMatch{Pattern: PatternRepeat, Start: i, End: j, Bits: bits})
+		}
+		i = j
+	}
+	return matches
+}
+
+// sequenceMatches finds runs of letters or digits in order, like "abcd" or "9876";
+// only the longest run at each place is a match
+func sequenceMatches(runes []rune) []StrengthMatch {
+	var matches []StrengthMatch
+	for i := 0; i < len(runes)-1; {
+		delta := runes[i+1] - runes[i]
+		if delta != 1 && delta != -1 {
+			i++
+			continue
+		}
+		j := i + 1
+		for j < len(runes) && runes[j]-runes[j-1] == delta && sameClass(runes[j], runes[i]) {
+			j++
+		}
+		if length := j - i; length >= minPatternLength {
+			bits := math.Log2(float64(cardinality(runes[i:i+1]))) + math.Log2(float64(length))
+			if delta < 0 {
+				bits++
+			}
+			matches = append(matches, StrengthMatch{Pattern: PatternSequence, Start: i, End: j, Bits: bits})
+		}
+		// The last character may start a run in the other direction
+		i = max(j-1, i+1)
+	}
+	return matches
+}
+
+// sameClass reports whether two characters are both lowercase letters, uppercase letters or digits
+func sameClass(a, b rune) bool {
+	return (unicode.IsLower(a) && unicode.IsLower(b)) || (unicode.IsUpper(a) && unicode.IsUpper(b)) ||
+		(unicode.IsDigit(a) && unicode.IsDigit(b))
+}
+
+// yearMatches finds four-digit years from 1900 to 2099
+func yearMatches(runes []rune) []StrengthMatch {
+	var matches []StrengthMatch
+	for i := 0; i+4 <= len(runes); i++ {
+		s := string(runes[i : i+4])
+		if (strings.HasPrefix(s, "19") || strings.HasPrefix(s, "20")) && isDigits(s) {
+			matches = append(matches, StrengthMatch{Pattern: PatternYear, Start: i, End: i + 4, Bits: math.Log2(200)})
+		}
+	}
+	return matches
+}
+
+// isDigits reports whether s consists of ASCII digits only
+func isDigits(s string) bool {
+	for _, r := range s {
+		if r < '0' || r > '9' {
+			return false
+		}
+	}
+	return true
+}
+
+// cardinality returns the size of the smallest alphabet that contains every character of the key,
+// built from lowercase letters, uppercase letters, digits, ASCII symbols and other characters
+func cardinality(runes []rune) int {
+	var lower, upper, digit, symbol, other bool
+	for _, r := range runes {
+		switch {
+		case r >= 'a' && r <= 'z':
+			lower = true
+		case r >= 'A' && r <= 'Z':
+			upper = true
+		case r >= '0' && r <= '9':
+			digit = true
+		case r > ' ' && r < 0x7f:
+			symbol = true
+		default:
+			other = true
+		}
+	}
+
+	size := 0
+	for _, class := range []struct {
+		present bool
+		size    int
+	}{{lower, 26}, {upper, 26}, {digit, 10}, {symbol, 33}, {other, 100}} {
+		if class.present {
+			size += class.size
+		}
+	}
+	return size
+}
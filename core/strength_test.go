@@ -0,0 +1,128 @@
+package core
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestEstimateStrength_Patterns(t *testing.T) {
+	testCases := []struct {
+		name    string
+		key     string
+		pattern string
+	}{
+		{name: "Common password", key: "password", pattern: PatternDictionary},
+		{name: "Capitalized l33t word", key: "P@ssw0rd", pattern: PatternDictionary},
+		{name: "Reversed word", key: "drowssap", pattern: PatternDictionary},
+		{name: "Keyboard walk", key: "zxcvbnm,./", pattern: PatternKeyboard},
+		{name: "Keyboard walk with turns", key: "3edcvfr4", pattern: PatternKeyboard},
+		{name: "Repeat", key: "aaaaaaaaaa", pattern: PatternRepeat},
+		{name: "Sequence", key: "lmnopqrs", pattern: PatternSequence},
+		{name: "Year", key: "1987", pattern: PatternYear},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			s := EstimateStrength(tc.key)
+			if len(s.Matches) != 1 || s.Matches[0].Pattern != tc.pattern {
+				t.Fatalf("Expected a single %s match, got %+v", tc.pattern, s.Matches)
+			}
+			if m := s.Matches[0]; m.Start != 0 || m.End != len([]rune(tc.key)) {
+				t.Errorf("Expected the match to cover the key, got %d-%d", m.Start, m.End)
+			}
+			if s.Bits >= 20 {
+				t.Errorf("Expected a weak score, got %.1f bits", s.Bits)
+			}
+		})
+	}
+}
+
+func TestEstimateStrength_Ordering(t *testing.T) {
+	// Structurally valid keys that differ in how guessable they are
+	weak := EstimateStrength("lh-key!!aaaaaaaaau")
+	strong := EstimateStrength("lh-Xq7#vL9p!key2mZu")
+	if weak.Bits >= strong.Bits {
+		t.Errorf("Expected the repetitive key to score lower: %.1f >= %.1f", weak.Bits, strong.Bits)
+	}
+
+	// Random characters are scored as brute force over their alphabet
+	random := EstimateStrength("x7#Qv")
+	if random.Bits < 30 || len(random.Matches) != 1 || random.Matches[0].Pattern != PatternBruteForce {
+		t.Errorf("Expected brute force for random characters, got %+v", random)
+	}
+
+	if s := EstimateStrength(""); s.Bits != 0 || s.Matches != nil {
+		t.Errorf("Expected an empty key to score 0, got %+v", s)
+	}
+}
+
+func TestEstimateStrength_MatchesCoverKey(t *testing.T) {
+	for _, key := range []string{"lh-test-key-1234!@u", "correct horse battery staple", "密钥-key-2024!"} {
+		s := EstimateStrength(key)
+		pos := 0
+		total := 0.0
+		for _, m := range s.Matches {
+			if m.Start != pos || m.End <= m.Start {
+				t.Fatalf("%q: matches don't split the key in order: %+v", key, s.Matches)
+			}
+			pos = m.End
+			total += m.Bits
+		}
+		if pos != len([]rune(key)) {
+			t.Errorf("%q: matches end at %d, expected %d", key, pos, len([]rune(key)))
+		}
+		if total > s.Bits {
+			t.Errorf("%q: match bits %.1f exceed the total %.1f", key, total, s.Bits)
+		}
+	}
+}
+
+func TestEstimateStrength_LongKey(t *testing.T) {
+	// As long as the largest key main accepts, and full of overlapping patterns
+	key := strings.Repeat("Password1987aaaabcdeqwerty!", 160)[:4096]
+
+	start := time.Now()
+	s := EstimateStrength(key)
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Errorf("Estimating a %d byte key took %v", len(key), elapsed)
+	}
+
+	if last := s.Matches[len(s.Matches)-1]; last.End != len(key) || last.Pattern != PatternBruteForce {
+		t.Errorf("Expected the tail to be scored as brute force up to %d, got %+v", len(key), last)
+	}
+	if short := EstimateStrength(key[:maxEstimateLength]); s.Bits <= short.Bits {
+		t.Errorf("Expected the whole key to score above its start: %.1f <= %.1f", s.Bits, short.Bits)
+	}
+}
+
+func TestPolicy_MinEntropyBits(t *testing.T) {
+	dir := t.TempDir()
+	t.Setenv("LHKM_POLICY", writePolicy(t, dir, "policy.yml", "security_rules:\n  min_entropy_bits: 60\n"))
+
+	policy, err := LoadPolicy()
+	if err != nil {
+		t.Fatalf("LoadPolicy failed: %v", err)
+	}
+	if policy.MinEntropyBits != 60 {
+		t.Fatalf("Expected min_entropy_bits 60, got %d", policy.MinEntropyBits)
+	}
+
+	// Passes every structural rule, but is easy to guess
+	weak := "lh-key!@aaaaaaaaau"
+	violations := policy.Explain(weak)
+	if len(violations) != 1 || violations[0].Rule != "min_entropy_bits" || violations[0].Want != 60 {
+		t.Errorf("Expected a min_entropy_bits violation, got %+v", violations)
+	}
+	if ValidateKey(weak) {
+		t.Errorf("Expected ValidateKey to enforce min_entropy_bits")
+	}
+	if !ValidateKey("lh-Xq7#vL9p!key2mZu") {
+		t.Errorf("Expected a strong key to be accepted")
+	}
+
+	t.Setenv("LHKM_POLICY", writePolicy(t, dir, "negative.yml", "security_rules:\n  min_entropy_bits: -1\n"))
+	if _, err := LoadPolicy(); err == nil {
+		t.Errorf("Expected error for a negative min_entropy_bits")
+	}
+}
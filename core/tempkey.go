@@ -0,0 +1,330 @@
+package core
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"path"
+	"path/filepath"
+	"regexp"
+	"time"
+
+	"github.com/clh021/lhkeymanager/utils"
+)
+
+// A named temporary key gives someone else limited access to some variables without telling them
+// the encryption key. When it is created, the whitelisted variables of one .env file are decrypted
+// and stored in the state file as a snapshot, encrypted with the temporary key; the encryption key
+// itself is never stored. The snapshot is only decrypted while the temporary key is neither expired,
+// used up nor revoked, and the entry is authenticated with the owner secret (see claimOwner).
+// These limits are enforced by lhkeymanager: anyone who can read the state file and knows the
+// temporary key can decrypt the snapshot without it, but gets nothing beyond the whitelisted values.
+
+// TempKeyPrefix starts every generated temporary key
+const TempKeyPrefix = "lhkm-tmp-"
+
+// Errors returned for named temporary keys
+var (
+	ErrTempKeyNotFound = errors.New("temporary key not found")
+	ErrTempKeyExists   = errors.New("temporary key already exists")
+	ErrTempKeyExpired  = errors.New("temporary key has expired")
+	ErrTempKeyUsedUp   = errors.New("temporary key has no uses left")
+)
+
+// tempKeyNamePattern restricts names to characters that are safe to print and type
+var tempKeyNamePattern = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9._-]{0,63}$`)
+
+// NamedTempKey describes a named temporary key. It never contains the key itself.
+type NamedTempKey struct {
+	Name      string    `json:"name"`
+	Created   time.Time `json:"created"`
+	ExpiresAt time.Time `json:"expires_at"` // zero if the key doesn't expire
+	MaxUses   int       `json:"max_uses"`   // 0 if the number of uses is unlimited
+	Uses      int       `json:"uses"`
+	Only      []string  `json:"only,omitempty"` // patterns of the variables the key may load; empty for all
+	File      string    `json:"file"`           // absolute path of the .env file the snapshot was taken from
+}
+
+// Expired reports whether the key has expired at the given time
+func (k *NamedTempKey) Expired(now time.Time) bool {
+	return !k.ExpiresAt.IsZero() && !now.Before(k.ExpiresAt)
+}
+
+// UsesLeft returns the number of remaining uses, or -1 if they are unlimited
+func (k *NamedTempKey) UsesLeft() int {
+	if k.MaxUses == 0 {
+		return -1
+	}
+	return max(k.MaxUses-k.Uses, 0)
+}
+
+// Allows reports whether the key may load the variable, according to its whitelist
+func (k *NamedTempKey) Allows(name string) bool {
+	return len(k.Only) == 0 || matchAny(k.Only, name)
+}
+
+// TempKeyGrant is a redeemed temporary key: its description after the use, and its snapshot
+type TempKeyGrant struct {
+	NamedTempKey
+	vars []tempKeyVar
+}
+
+// Result returns the variables of the snapshot in file order
+func (g *TempKeyGrant) Result() *LoadResult {
+	result := &LoadResult{Vars: make(map[string]string, len(g.vars))}
+	for _, v := range g.vars {
+		result.Names = append(result.Names, v.Name)
+		result.Vars[v.Name] = v.Value
+	}
+	return result
+}
+
+// Get returns the value of one variable of the snapshot
+// Returns an error wrapping ErrVariableNotFound if the snapshot doesn't contain it
+func (g *TempKeyGrant) Get(name string) (string, error) {
+	for _, v := range g.vars {
+		if v.Name == name {
+			return v.Value, nil
+		}
+	}
+	return "", fmt.Errorf("%w: %s", ErrVariableNotFound, name)
+}
+
+// tempKeyVar is one variable of a snapshot
+type tempKeyVar struct {
+	Name  string `json:"name"`
+	Value string `json:"value"`
+}
+
+// namedTempKeyEntry is a named temporary key as stored in the state file
+type namedTempKeyEntry struct {
+	NamedTempKey
+	ID     string `json:"id"`     // salted hash of the temporary key, see tempKeyID
+	Values string `json:"values"` // the snapshot, encrypted with the temporary key
+	MAC    string `json:"mac"`    // HMAC of all other fields, keyed with the owner secret
+}
+
+// mac authenticates every field of the entry with the owner secret
+func (e namedTempKeyEntry) mac(secret []byte) string {
+	e.MAC = ""
+	message, _ := json.Marshal(e) // Can't fail for this type
+
+	h := hmac.New(sha256.New, secret)
+	h.Write([]byte("lhkm-tempkey-v2:"))
+	h.Write(message)
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// tempKeyAD binds the snapshot to the name of the temporary key
+func tempKeyAD(name string) []byte {
+	return []byte("lhkm-tempkey:" + name)
+}
+
+// takeSnapshot decrypts the variables of the .env file that the temporary key may load
+// Returns an error if one of them can't be decrypted or none is left
+func takeSnapshot(encryptionKey, envFilePath string, spec NamedTempKey) ([]tempKeyVar, error) {
+	result, err := loadAPIKeys(encryptionKey, envFilePath)
+	if err != nil {
+		return nil, err
+	}
+	for _, failure := range result.Failures {
+		if spec.Allows(failure.Name) {
+			return nil, &failure
+		}
+	}
+	if err := result.Filter(spec.Only, nil); err != nil {
+		return nil, err
+	}
+	if len(result.Names) == 0 {
+		return nil, fmt.Errorf("%s has no variables the temporary key may load", envFilePath)
+	}
+
+	vars := make([]tempKeyVar, 0, len(result.Names))
+	for _, name := range result.Names {
+		vars = append(vars, tempKeyVar{Name: name, Value: result.Vars[name]})
+	}
+	return vars, nil
+}
+
+// AddTempKey creates a named temporary key for a snapshot of the variables it may load
+// encryptionKey: the key of the .env file; the state must belong to it, see claimOwner
+// envFilePath: the .env file to take the snapshot from
+// spec: the name and limits; Created, Uses and File are ignored
+// Returns the generated temporary key, which is shown once and can't be recovered,
+// ErrTempKeyExists if the name is taken, or ErrNotOwner for another encryption key
+func AddTempKey(encryptionKey, envFilePath string, spec NamedTempKey) (string, error) {
+	if !tempKeyNamePattern.MatchString(spec.Name) {
+		return "", fmt.Errorf("invalid temporary key name %q", spec.Name)
+	}
+	if spec.MaxUses < 0 {
+		return "", fmt.Errorf("max uses must not be negative")
+	}
+	for _, pattern := range spec.Only {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return "", fmt.Errorf("invalid pattern %q: %w", pattern, err)
+		}
+	}
+
+	if !ValidateMainKey(encryptionKey) {
+		return "", fmt.Errorf("invalid encryption key")
+	}
+	file, err := filepath.Abs(envFilePath)
+	if err != nil {
+		return "", err
+	}
+
+	vars, err := takeSnapshot(encryptionKey, envFilePath, spec)
+	if err != nil {
+		return "", err
+	}
+	snapshot, err := json.Marshal(vars)
+	if err != nil {
+		return "", err
+	}
+	defer clear(snapshot)
+
+	random := make([]byte, 24)
+	if _, err := rand.Read(random); err != nil {
+		return "", err
+	}
+	key := TempKeyPrefix + base64.RawURLEncoding.EncodeToString(random)
+
+	values, err := utils.EncryptAES256KDF(string(snapshot), key, ConfiguredKDFParams(), tempKeyAD(spec.Name))
+	if err != nil {
+		return "", err
+	}
+
+	err = updateState(func(state *stateFile) (bool, error) {
+		secret, err := state.claimOwner(encryptionKey)
+		if err != nil {
+			return false, err
+		}
+		for _, e := range state.NamedKeys {
+			if e.Name == spec.Name {
+				return false, fmt.Errorf("%w: %s", ErrTempKeyExists, spec.Name)
+			}
+		}
+
+		entry := namedTempKeyEntry{NamedTempKey: spec, ID: state.tempKeyID(key), Values: values}
+		entry.Created = time.Now().UTC().Truncate(time.Second)
+		entry.ExpiresAt = entry.ExpiresAt.UTC()
+		entry.Uses = 0
+		entry.File = file
+		entry.MAC = entry.mac(secret)
+		state.NamedKeys = append(state.NamedKeys, entry)
+		return true, nil
+	})
+	if err != nil {
+		return "", err
+	}
+	return key, nil
+}
+
+// ListTempKeys returns the named temporary keys in creation order, including expired and used up ones
+func ListTempKeys() ([]NamedTempKey, error) {
+	state, err := loadState()
+	if err != nil {
+		return nil, err
+	}
+	keys := make([]NamedTempKey, 0, len(state.NamedKeys))
+	for _, e := range state.NamedKeys {
+		keys = append(keys, e.NamedTempKey)
+	}
+	return keys, nil
+}
+
+// RevokeTempKey deletes a named temporary key, so it can no longer be used, and writes the revocation
+// to the audit log
+// encryptionKey: the key the state belongs to, see claimOwner
+// Returns ErrTempKeyNotFound if there is no key with that name, or ErrNotOwner for another encryption key
+func RevokeTempKey(encryptionKey, name string) error {
+	err := updateState(func(state *stateFile) (bool, error) {
+		for i, e := range state.NamedKeys {
+			if e.Name != name {
+				continue
+			}
+			if _, err := state.claimOwner(encryptionKey); err != nil {
+				return false, err
+			}
+			state.NamedKeys = append(state.NamedKeys[:i], state.NamedKeys[i+1:]...)
+			return true, nil
+		}
+		return false, fmt.Errorf("%w: %s", ErrTempKeyNotFound, name)
+	})
+	if err != nil {
+		return err
+	}
+
+	event := AuditEvent{Time: time.Now(), Event: AuditRevoke, Command: "tempkey revoke", TempKey: name}
+	if err := AppendAuditLog(event); err != nil {
+		return fmt.Errorf("revoked %s, but failed to write the audit log: %w", name, err)
+	}
+	return nil
+}
+
+// FindTempKey looks up the named temporary key a key belongs to, without using it
+// Returns nil if the key is not a named temporary key
+func FindTempKey(key string) (*NamedTempKey, error) {
+	state, err := loadState()
+	if err != nil {
+		return nil, err
+	}
+	id := state.tempKeyID(key)
+	for _, e := range state.NamedKeys {
+		if hmac.Equal([]byte(e.ID), []byte(id)) {
+			tk := e.NamedTempKey
+			return &tk, nil
+		}
+	}
+	return nil, nil
+}
+
+// RedeemTempKey records one use of a named temporary key and returns the snapshot it stands for
+// Returns ErrTempKeyNotFound, ErrTempKeyExpired or ErrTempKeyUsedUp if the key can't be used,
+// and ErrStateTampered if its entry was modified
+func RedeemTempKey(key string) (*TempKeyGrant, error) {
+	var grant *TempKeyGrant
+	err := updateState(func(state *stateFile) (bool, error) {
+		id := state.tempKeyID(key)
+		for i, e := range state.NamedKeys {
+			if !hmac.Equal([]byte(e.ID), []byte(id)) {
+				continue
+			}
+			secret, ok := state.ownerSecret()
+			if !ok || !hmac.Equal([]byte(e.MAC), []byte(e.mac(secret))) {
+				return false, ErrStateTampered
+			}
+			if e.Expired(time.Now()) {
+				return false, fmt.Errorf("%w: %s", ErrTempKeyExpired, e.Name)
+			}
+			if e.UsesLeft() == 0 {
+				return false, fmt.Errorf("%w: %s", ErrTempKeyUsedUp, e.Name)
+			}
+
+			snapshot, err := utils.DecryptAES256KDF(e.Values, key, tempKeyAD(e.Name))
+			if err != nil {
+				return false, fmt.Errorf("failed to decrypt the snapshot: %w", err)
+			}
+			var vars []tempKeyVar
+			if err := json.Unmarshal([]byte(snapshot), &vars); err != nil {
+				return false, fmt.Errorf("invalid snapshot: %w", err)
+			}
+
+			e.Uses++
+			e.MAC = e.mac(secret)
+			state.NamedKeys[i] = e
+			grant = &TempKeyGrant{NamedTempKey: e.NamedTempKey, vars: vars}
+			return true, nil
+		}
+		return false, ErrTempKeyNotFound
+	})
+	if err != nil {
+		return nil, err
+	}
+	return grant, nil
+}
@@ -0,0 +1,213 @@
+package core
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/clh021/lhkeymanager/utils"
+)
+
+// writeTempKeyEnv writes a .env file with three encrypted variables and a plaintext one, and returns its path
+func writeTempKeyEnv(t *testing.T) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), ".env")
+	for name, value := range map[string]string{"API_KEY": "api-value", "API_SECRET": "secret-value", "DB_PASSWORD": "db-value"} {
+		if _, err := StoreAPIKeyForTest(value, name, testOwnerKey, path); err != nil {
+			t.Fatalf("Failed to store %s: %v", name, err)
+		}
+	}
+	if err := utils.SaveToEnvFile("PLAIN", "plain-value", path); err != nil {
+		t.Fatalf("Failed to store PLAIN: %v", err)
+	}
+	return path
+}
+
+func TestAddAndRedeemTempKey(t *testing.T) {
+	path := stateTestDir(t)
+	envFilePath := writeTempKeyEnv(t)
+
+	tempKey, err := AddTempKey(testOwnerKey, envFilePath, NamedTempKey{
+		Name:      "contractor",
+		ExpiresAt: time.Now().Add(time.Hour),
+		MaxUses:   2,
+		Only:      []string{"API_*"},
+	})
+	if err != nil {
+		t.Fatalf("AddTempKey failed: %v", err)
+	}
+	if !strings.HasPrefix(tempKey, TempKeyPrefix) {
+		t.Errorf("Expected prefix %q, got %q", TempKeyPrefix, tempKey)
+	}
+
+	// Neither key nor any value is stored in the state file
+	content, _ := os.ReadFile(path)
+	for _, secret := range []string{tempKey, testOwnerKey, "api-value", "db-value"} {
+		if strings.Contains(string(content), secret) {
+			t.Errorf("State file contains %q: %s", secret, content)
+		}
+	}
+
+	if _, err := AddTempKey(testOwnerKey, envFilePath, NamedTempKey{Name: "contractor", MaxUses: 1}); !errors.Is(err, ErrTempKeyExists) {
+		t.Errorf("Expected ErrTempKeyExists, got %v", err)
+	}
+
+	tk, err := FindTempKey(tempKey)
+	if err != nil || tk == nil || tk.Name != "contractor" || tk.Uses != 0 || tk.File != envFilePath {
+		t.Fatalf("Expected to find the key without using it, got %+v (%v)", tk, err)
+	}
+	if tk, _ := FindTempKey(testOwnerKey); tk != nil {
+		t.Errorf("Expected the encryption key not to be a temporary key")
+	}
+
+	for i := 1; i <= 2; i++ {
+		grant, err := RedeemTempKey(tempKey)
+		if err != nil {
+			t.Fatalf("Use %d failed: %v", i, err)
+		}
+		if grant.Uses != i || grant.UsesLeft() != 2-i || len(grant.Only) != 1 {
+			t.Errorf("Unexpected grant after use %d: %+v", i, grant.NamedTempKey)
+		}
+
+		// The grant holds the whitelisted values, never the encryption key
+		result := grant.Result()
+		if strings.Join(result.Names, ",") != "API_KEY,API_SECRET" || result.Vars["API_SECRET"] != "secret-value" {
+			t.Errorf("Unexpected snapshot: %v %v", result.Names, result.Vars)
+		}
+		if value, err := grant.Get("API_KEY"); err != nil || value != "api-value" {
+			t.Errorf("Expected API_KEY from the snapshot, got %q (%v)", value, err)
+		}
+		if _, err := grant.Get("DB_PASSWORD"); !errors.Is(err, ErrVariableNotFound) {
+			t.Errorf("Expected DB_PASSWORD to be missing from the snapshot, got %v", err)
+		}
+	}
+	if _, err := RedeemTempKey(tempKey); !errors.Is(err, ErrTempKeyUsedUp) {
+		t.Errorf("Expected ErrTempKeyUsedUp, got %v", err)
+	}
+
+	// Only the owner of the state can revoke, and revoking is audited
+	if err := RevokeTempKey("lh-other-key-1234!@u", "contractor"); !errors.Is(err, ErrNotOwner) {
+		t.Errorf("Expected ErrNotOwner, got %v", err)
+	}
+	if err := RevokeTempKey(testOwnerKey, "contractor"); err != nil {
+		t.Fatalf("RevokeTempKey failed: %v", err)
+	}
+	if _, err := RedeemTempKey(tempKey); !errors.Is(err, ErrTempKeyNotFound) {
+		t.Errorf("Expected ErrTempKeyNotFound after revoking, got %v", err)
+	}
+	if err := RevokeTempKey(testOwnerKey, "contractor"); !errors.Is(err, ErrTempKeyNotFound) {
+		t.Errorf("Expected ErrTempKeyNotFound, got %v", err)
+	}
+	logPath, _ := AuditLogPath()
+	if log, _ := os.ReadFile(logPath); !strings.Contains(string(log), `"event":"revoke"`) || !strings.Contains(string(log), "contractor") {
+		t.Errorf("Expected the revocation in the audit log, got %s", log)
+	}
+}
+
+func TestRedeemTempKey_Expired(t *testing.T) {
+	stateTestDir(t)
+
+	tempKey, err := AddTempKey(testOwnerKey, writeTempKeyEnv(t), NamedTempKey{Name: "old", ExpiresAt: time.Now().Add(-time.Minute)})
+	if err != nil {
+		t.Fatalf("AddTempKey failed: %v", err)
+	}
+	if _, err := RedeemTempKey(tempKey); !errors.Is(err, ErrTempKeyExpired) {
+		t.Errorf("Expected ErrTempKeyExpired, got %v", err)
+	}
+
+	keys, err := ListTempKeys()
+	if err != nil || len(keys) != 1 || !keys[0].Expired(time.Now()) || keys[0].UsesLeft() != -1 {
+		t.Errorf("Expected one expired key with unlimited uses, got %+v (%v)", keys, err)
+	}
+}
+
+func TestRedeemTempKey_Tampered(t *testing.T) {
+	path := stateTestDir(t)
+
+	tempKey, err := AddTempKey(testOwnerKey, writeTempKeyEnv(t), NamedTempKey{Name: "contractor", MaxUses: 1})
+	if err != nil {
+		t.Fatalf("AddTempKey failed: %v", err)
+	}
+
+	// Raising the limit is detected, also when the HMAC is recomputed with the temporary key
+	state := readTestState(t, path)
+	state.NamedKeys[0].MaxUses = 100
+	forged := hmac.New(sha256.New, []byte(tempKey))
+	forged.Write([]byte("lhkeymanager temp key state"))
+	state.NamedKeys[0].MAC = state.NamedKeys[0].mac(forged.Sum(nil))
+	writeTestState(t, path, state)
+	if _, err := RedeemTempKey(tempKey); !errors.Is(err, ErrStateTampered) {
+		t.Errorf("Expected ErrStateTampered, got %v", err)
+	}
+
+	// So is an entry without an owner
+	state.Owner = nil
+	writeTestState(t, path, state)
+	if _, err := RedeemTempKey(tempKey); !errors.Is(err, ErrStateTampered) {
+		t.Errorf("Expected ErrStateTampered without an owner, got %v", err)
+	}
+
+	// Deleting the state file doesn't bring the key back
+	os.Remove(path)
+	if _, err := RedeemTempKey(tempKey); !errors.Is(err, ErrTempKeyNotFound) {
+		t.Errorf("Expected ErrTempKeyNotFound without the state file, got %v", err)
+	}
+}
+
+func TestAddTempKey_Invalid(t *testing.T) {
+	stateTestDir(t)
+	envFilePath := writeTempKeyEnv(t)
+
+	testCases := []struct {
+		name string
+		key  string
+		spec NamedTempKey
+	}{
+		{name: "Empty name", spec: NamedTempKey{MaxUses: 1}},
+		{name: "Name with spaces", spec: NamedTempKey{Name: "a b", MaxUses: 1}},
+		{name: "Negative uses", spec: NamedTempKey{Name: "a", MaxUses: -1}},
+		{name: "Bad pattern", spec: NamedTempKey{Name: "a", MaxUses: 1, Only: []string{"["}}},
+		{name: "Nothing whitelisted", spec: NamedTempKey{Name: "a", MaxUses: 1, Only: []string{"NOPE_*"}}},
+		{name: "Wrong key", key: "lh-other-key-1234!@u", spec: NamedTempKey{Name: "a", MaxUses: 1}},
+		{name: "Key breaking the policy", key: "weak", spec: NamedTempKey{Name: "a", MaxUses: 1}},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			key := tc.key
+			if key == "" {
+				key = testOwnerKey
+			}
+			if _, err := AddTempKey(key, envFilePath, tc.spec); err == nil {
+				t.Errorf("Expected error for %+v", tc.spec)
+			}
+		})
+	}
+
+	// Once the state belongs to a key, another one can't add temporary keys
+	if _, err := AddTempKey(testOwnerKey, envFilePath, NamedTempKey{Name: "a", MaxUses: 1}); err != nil {
+		t.Fatalf("AddTempKey failed: %v", err)
+	}
+	otherPath := filepath.Join(t.TempDir(), ".env")
+	StoreAPIKeyForTest("value", "API_KEY", "lh-other-key-1234!@u", otherPath)
+	if _, err := AddTempKey("lh-other-key-1234!@u", otherPath, NamedTempKey{Name: "b", MaxUses: 1}); !errors.Is(err, ErrNotOwner) {
+		t.Errorf("Expected ErrNotOwner, got %v", err)
+	}
+}
+
+func TestNamedTempKey_Allows(t *testing.T) {
+	all := &NamedTempKey{}
+	if !all.Allows("ANYTHING") {
+		t.Errorf("Expected a key without whitelist to allow every variable")
+	}
+	some := &NamedTempKey{Only: []string{"API_*", "SENTRY_DSN"}}
+	for name, want := range map[string]bool{"API_KEY": true, "SENTRY_DSN": true, "DB_PASSWORD": false} {
+		if got := some.Allows(name); got != want {
+			t.Errorf("Allows(%q) = %v, expected %v", name, got, want)
+		}
+	}
+}
@@ -4,9 +4,9 @@ go 1.23.0
 
 toolchain go1.23.8
 
-require golang.org/x/term v0.30.0
-
 require (
-	golang.org/x/sys v0.31.0 // indirect
-	gopkg.in/yaml.v3 v3.0.1 // indirect
+	golang.org/x/crypto v0.36.0
+	golang.org/x/sys v0.31.0
+	golang.org/x/term v0.30.0
+	gopkg.in/yaml.v3 v3.0.1
 )
@@ -2,12 +2,25 @@ package main
 
 import (
 	"bufio"
+	"encoding/json"
+	"errors"
+	"flag"
 	"fmt"
+	"io"
 	"os"
 	"os/exec"
+	"os/signal"
+	"path/filepath"
+	"runtime"
+	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"syscall"
+	"text/tabwriter"
+	"time"
 
+	"github.com/clh021/lhkeymanager/agent"
 	"github.com/clh021/lhkeymanager/core"
 	"github.com/clh021/lhkeymanager/utils"
 
@@ -30,17 +43,311 @@ func main() {
 		os.Exit(1)
 	}
 
+	// Parse the command's flags; they may appear anywhere after the command
+	opts := options{command: choice}
+	var args []string
+	if choice == "run" {
+		// Everything after the first positional argument belongs to the child command
+		fs := newFlagSet(choice, &opts)
+		fs.Parse(os.Args[2:])
+		args = fs.Args()
+		envFilePath = opts.file
+	} else {
+		args = parseFlags(newFlagSet(choice, &opts), os.Args[2:])
+	}
+
 	// 检查可选的文件路径参数
-	if len(os.Args) > 2 {
-		envFilePath = os.Args[2]
+	if len(args) > 0 && choice != "run" {
+		envFilePath = args[0]
 	}
 
-	var key string
+	// Refuse to start a session inside another one unless forced
+	if choice == "load" && os.Getenv(sessionVar) != "" && !opts.force {
+		fmt.Fprintf(os.Stderr, "错误: 当前已处于 lhkeymanager 会话中 (%s)。请先退出该会话，或使用 --force 强制嵌套\n", os.Getenv(sessionVar))
+		os.Exit(1)
+	}
+
+	// Reject an unknown export format before asking for the key
+	if choice == "export" {
+		if _, ok := utils.LookupExportFormatter(opts.format); !ok {
+			fmt.Fprintf(os.Stderr, "错误: 未知的导出格式 '%s'. 可用格式: %s\n", opts.format, strings.Join(utils.ExportFormatNames(), ", "))
+			os.Exit(1)
+		}
+	}
+
+	// These commands take variable names first, so the file follows them
+	if cmd, ok := nameCommands[choice]; ok {
+		if len(args) < cmd.names || len(args) > cmd.names+1 {
+			fmt.Fprintf(os.Stderr, "用法: ./lhkeymanager %s\n", cmd.usage)
+			os.Exit(1)
+		}
+		envFilePath = ".env"
+		if len(args) > cmd.names {
+			envFilePath = args[cmd.names]
+		}
+	}
+
+	// Check the arguments of set before asking for the key
+	if choice == "set" {
+		checkSetArgs(args, opts)
+		envFilePath = opts.file
+	}
+
+	// Commands that don't need the encryption key
+	switch choice {
+	case "kdf-bench":
+		benchmarkKDF(args)
+		return
+	case "policy":
+		policyCommand(args)
+		return
+	case "check-key":
+		checkKeyCommand(opts)
+		return
+	case "list":
+		if !opts.verify {
+			listEntries("", envFilePath, opts)
+			return
+		}
+	}
+
+	// Without a valid policy no key can be accepted, so say why before prompting
+	if _, err := core.LoadPolicy(); err != nil {
+		fmt.Fprintf(os.Stderr, "错误: 安全策略无效: %v\n", err)
+		os.Exit(1)
+	}
+
+	switch choice {
+	case "agent":
+		agentCommand(args, opts)
+		return
+	case "tempkey":
+		tempKeyCommand(args, opts)
+		return
+	}
+
+	key, grant := obtainKey(opts)
+	opts.grant = grant
+	if grant != nil {
+		// A temporary key reads the snapshot of the file it was created for
+		envFilePath = grant.File
+	}
 	// 清理内存中的敏感数据
 	defer clearString(&key)
+	defer utils.ClearKDFCache()
+
+	switch choice {
+	case "store":
+		storeKey(reader, key, envFilePath)
+	case "set":
+		setKey(key, args[0], envFilePath, opts)
+	case "load":
+		loadKeysToNewShell(key, envFilePath, opts)
+	case "export":
+		exportKeys(key, envFilePath, opts)
+	case "run":
+		if len(args) == 0 {
+			fmt.Fprintln(os.Stderr, "用法: ./lhkeymanager run [--file path] [--only names] [--exclude names] [--strict] -- <command> [args...]")
+			os.Exit(1)
+		}
+		runCommand(key, envFilePath, args, opts)
+	case "list":
+		listEntries(key, envFilePath, opts)
+	case "get":
+		getCommand(key, args[0], envFilePath, opts)
+	case "rm":
+		removeKey(key, args[0], envFilePath, opts)
+	case "rename":
+		renameKey(key, args[0], args[1], envFilePath)
+	case "edit":
+		editFile(reader, key, envFilePath)
+	case "rekey":
+		rekeyFile(key, envFilePath)
+	case "sign":
+		signFile(key, envFilePath)
+	case "encrypt-file":
+		if len(args) != 2 {
+			fmt.Fprintln(os.Stderr, "用法: ./lhkeymanager encrypt-file [--mac] <input_path> <output_path>")
+			os.Exit(1)
+		}
+		inputFile, outputFile := args[0], args[1]
+		encryptFile(key, inputFile, outputFile, opts.mac)
+	case "decrypt-file":
+		if len(args) != 2 {
+			fmt.Fprintln(os.Stderr, "用法: ./lhkeymanager decrypt-file [--strict] <input_path> <output_path>")
+			os.Exit(1)
+		}
+		inputFile, outputFile := args[0], args[1]
+		decryptFile(key, inputFile, outputFile, opts)
+	default:
+		fmt.Fprintf(os.Stderr, "错误: 未知命令 '%s'. 可用命令: store, set, load, export, run, get, list, edit, rm, rename, agent, tempkey, policy, check-key, rekey, sign, encrypt-file, decrypt-file, kdf-bench\n", choice)
+		fmt.Fprintln(os.Stderr, "用法: ./lhkeymanager <command> [args...]")
+		os.Exit(1)
+	}
+}
+
+// keyEnvVar is the environment variable that may hold the encryption key
+const keyEnvVar = "LHKM_KEY"
+
+// obtainKey returns the validated encryption key from the first available source:
+// --key-fd, --key-file, $LHKM_KEY, a running agent, then the interactive prompt.
+// A key from a non-interactive source can't be retried, so an invalid one exits the program.
+// Returns the encryption key, and the grant if a named temporary key was given.
+func obtainKey(opts options) (string, *core.TempKeyGrant) {
+	var key, source string
+	var err error
+	switch {
+	case opts.keyFD >= 0:
+		source = fmt.Sprintf("--key-fd %d", opts.keyFD)
+		key, err = readKeyFD(opts.keyFD)
+	case opts.keyFile != "":
+		source = "--key-file " + opts.keyFile
+		key, err = readKeyFile(opts.keyFile)
+	case os.Getenv(keyEnvVar) != "":
+		source = keyEnvVar
+		key = os.Getenv(keyEnvVar)
+		// Programs started by run and load must not inherit the key
+		os.Unsetenv(keyEnvVar)
+		fmt.Fprintf(os.Stderr, "警告: 正在从环境变量 %s 读取密钥，同一用户的其他进程可能读取到它。建议改用 --key-fd 或 --key-file\n", keyEnvVar)
+	default:
+		// Ask a running agent for the key before prompting
+		if key = agentKey(); key != "" {
+			return key, nil
+		}
+		return promptKey(opts)
+	}
+
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "错误: 从 %s 读取密钥失败: %v\n", source, err)
+		os.Exit(1)
+	}
+	waitForKeyAttempt()
+	encryptionKey, grant, ok := acceptKey(key, source, opts)
+	if !ok {
+		fmt.Fprintf(os.Stderr, "错误: 来自 %s 的密钥验证失败。\n", source)
+		if opts.explain {
+			printViolations(key)
+		}
+		clearString(&key)
+		printKeyHint()
+		os.Exit(1)
+	}
+	if grant != nil {
+		clearString(&key)
+	}
+	return encryptionKey, grant
+}
+
+// maxKeySize limits how much is read from a key file or descriptor
+const maxKeySize = 4096
+
+// readKeyFD reads the key from an open file descriptor, e.g. a pipe set up by the caller
+// A single trailing newline is removed.
+func readKeyFD(fd int) (string, error) {
+	file := os.NewFile(uintptr(fd), fmt.Sprintf("fd %d", fd))
+	if file == nil {
+		return "", fmt.Errorf("invalid file descriptor")
+	}
+	defer file.Close()
+	return readKeyFrom(file)
+}
+
+// readKeyFile reads the key from a file that only its owner can access
+// A single trailing newline is removed.
+func readKeyFile(path string) (string, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return "", err
+	}
+	if !info.Mode().IsRegular() {
+		return "", fmt.Errorf("%s is not a regular file", path)
+	}
+	// Windows doesn't report Unix permission bits
+	if runtime.GOOS != "windows" && info.Mode().Perm()&0077 != 0 {
+		return "", fmt.Errorf("permissions %o of %s are too open, use chmod 600", info.Mode().Perm(), path)
+	}
+
+	file, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+	return readKeyFrom(file)
+}
+
+// readKeyFrom reads a key of at most maxKeySize bytes and removes a single trailing newline
+func readKeyFrom(r io.Reader) (string, error) {
+	data, err := io.ReadAll(io.LimitReader(r, maxKeySize+1))
+	if err != nil {
+		return "", err
+	}
+	if len(data) > maxKeySize {
+		return "", fmt.Errorf("key is longer than %d bytes", maxKeySize)
+	}
+	key := strings.TrimSuffix(strings.TrimSuffix(string(data), "\n"), "\r")
+	if key == "" {
+		return "", fmt.Errorf("key is empty")
+	}
+	return key, nil
+}
+
+// printViolations lists the policy rules a key breaks
+func printViolations(key string) {
+	policy, err := core.LoadPolicy()
+	if err != nil {
+		return
+	}
+	for _, v := range policy.Explain(key) {
+		fmt.Fprintf(os.Stderr, "  - %s\n", violationText(v, policy))
+	}
+}
 
+// violationText describes a broken rule for the user
+func violationText(v core.Violation, policy *core.Policy) string {
+	switch v.Rule {
+	case "min_key_length":
+		return fmt.Sprintf("密钥太短: 至少需要 %d 个字符，当前 %d 个", v.Want, v.Got)
+	case "key_prefix":
+		return fmt.Sprintf("密钥必须以 %q 开头", policy.KeyPrefix)
+	case "key_suffix":
+		return fmt.Sprintf("密钥必须以 %q 结尾", policy.KeySuffix)
+	case "min_special_chars":
+		return fmt.Sprintf("特殊字符不足: 需要包含 %q 中至少 %d 种字符，当前 %d 种", policy.RequiredChars, v.Want, v.Got)
+	case "key_contain":
+		return fmt.Sprintf("密钥必须包含 %q", policy.KeyContain)
+	case "min_entropy_bits":
+		return fmt.Sprintf("密钥太容易猜测: 估计熵至少需要 %d 比特，当前 %d 比特", v.Want, v.Got)
+	default:
+		return v.Rule
+	}
+}
+
+// printKeyHint prints the configured key hint, if any
+func printKeyHint() {
+	policy, err := core.LoadPolicy()
+	if err != nil {
+		return
+	}
+	if policy.KeyHint != "" && policy.KeyHint != "No hint available." {
+		fmt.Fprintf(os.Stderr, "密钥提示: %s\n", policy.KeyHint)
+	}
+}
+
+// promptKey asks for the encryption key until it passes validation, at most 3 times
+// Returns the encryption key, and the grant if a named temporary key was entered.
+// Exits the program after the last failed attempt
+func promptKey(opts options) (string, *core.TempKeyGrant) {
+	// Without a terminal the key can't be typed; say how to pass it instead
+	if !term.IsTerminal(int(os.Stdin.Fd())) {
+		fmt.Fprintf(os.Stderr, "错误: 标准输入不是终端，无法输入密钥。请使用 --key-fd、--key-file 或环境变量 %s 提供密钥\n", keyEnvVar)
+		os.Exit(1)
+	}
+
+	var key string
 	maxAttempts := 3
 	for i := 0; i < maxAttempts; i++ {
+		waitForKeyAttempt()
+
 		// 获取加密密钥（不显示输入）
 		fmt.Fprint(os.Stderr, "请输入加密密钥: ")
 		bytePassword, err := term.ReadPassword(int(syscall.Stdin))
@@ -52,48 +359,266 @@ func main() {
 		key = string(bytePassword)
 
 		// Validate the encryption key
-		if core.ValidateKey(key) {
-			break // Key is valid, exit loop
+		if encryptionKey, grant, ok := acceptKey(key, "prompt", opts); ok {
+			if grant != nil {
+				clearString(&key)
+			}
+			return encryptionKey, grant
 		}
 
-		// Invalidate the key in memory after a failed attempt
-		clearString(&key)
-
 		if i < maxAttempts-1 {
 			fmt.Fprintf(os.Stderr, "错误: 密钥验证失败。您还有 %d 次机会。\n", maxAttempts-1-i)
 		} else {
 			fmt.Fprintln(os.Stderr, "错误: 密钥验证失败。已达到最大尝试次数。")
-			if core.KeyHint != "" && core.KeyHint != "No hint available." {
-				fmt.Fprintf(os.Stderr, "密钥提示: %s\n", core.KeyHint)
-			}
+		}
+		if opts.explain {
+			printViolations(key)
+		}
+
+		// Invalidate the key in memory after a failed attempt
+		clearString(&key)
+	}
+	printKeyHint()
+	os.Exit(1)
+	return "", nil
+}
+
+// tempKeyCommands are the commands that accept a named temporary key; they only read variables
+var tempKeyCommands = map[string]bool{"load": true, "export": true, "run": true, "get": true}
+
+// waitForKeyAttempt waits until the next key may be tried after earlier failures.
+// Exits the program while keys are locked out.
+func waitForKeyAttempt() {
+	for {
+		err := core.BeginKeyAttempt()
+		var backoff *core.BackoffError
+		var lockout *core.LockoutError
+		switch {
+		case err == nil:
+			return
+		case errors.As(err, &lockout):
+			fmt.Fprintf(os.Stderr, "错误: 密钥验证失败次数过多，已锁定至 %s\n", lockout.Until.Local().Format("2006-01-02 15:04:05"))
 			os.Exit(1)
+		case errors.As(err, &backoff):
+			wait := backoff.Wait.Round(time.Second)
+			fmt.Fprintf(os.Stderr, "密钥验证失败次数过多，请等待 %v 后再试...\n", max(wait, time.Second))
+			time.Sleep(backoff.Wait)
+		default:
+			fmt.Fprintf(os.Stderr, "警告: 无法读取失败尝试记录: %v\n", err)
+			return
 		}
 	}
+}
 
-	switch choice {
-	case "store":
-		storeKey(reader, key, envFilePath)
-	case "load":
-		loadKeysToNewBash(key, envFilePath)
-	case "export":
-		exportKeys(key, envFilePath)
-	case "encrypt-file":
-		if len(os.Args) != 4 {
-			fmt.Fprintln(os.Stderr, "用法: ./lhkeymanager encrypt-file <input_path> <output_path>")
+// acceptKey checks a key entered by the user and records the attempt for the backoff and the audit log.
+// A named temporary key is redeemed for the encryption key it stands for, if the command accepts temporary keys.
+// source: where the key came from, for the audit log
+// Returns the encryption key and the grant of a temporary key, or ok=false if the key is invalid.
+// Exits the program if a temporary key can't be used.
+func acceptKey(key, source string, opts options) (string, *core.TempKeyGrant, bool) {
+	event := core.AuditEvent{Command: opts.command, Source: source}
+	encryptionKey, grant, ok := checkKey(key, opts)
+	if !ok {
+		if policy, err := core.LoadPolicy(); err == nil {
+			if err := core.RecordKeyFailure(policy, event); err != nil {
+				fmt.Fprintf(os.Stderr, "警告: 无法记录失败的尝试: %v\n", err)
+			}
+		}
+		return "", nil, false
+	}
+
+	if grant != nil {
+		event.TempKey = grant.Name
+	}
+	failures, err := core.RecordKeySuccess(event)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "警告: 无法记录成功的尝试: %v\n", err)
+	}
+	if failures > 0 {
+		fmt.Fprintf(os.Stderr, "注意: 自上次成功验证以来有 %d 次失败的尝试%s\n", failures, auditLogText())
+	}
+	return encryptionKey, grant, true
+}
+
+// auditLogText points to the audit log for details, or returns "" if its path is unknown
+func auditLogText() string {
+	path, err := core.AuditLogPath()
+	if err != nil {
+		return ""
+	}
+	return fmt.Sprintf("，详见 %s", path)
+}
+
+// checkKey validates a key, or redeems it if it is a named temporary key
+// Returns the encryption key, or an empty key and the grant of a temporary key, or ok=false if the key is invalid.
+// Exits the program if a temporary key can't be used.
+func checkKey(key string, opts options) (string, *core.TempKeyGrant, bool) {
+	// An unreadable state file only affects temporary keys; the key may still be the encryption key
+	tk, err := core.FindTempKey(key)
+	if err != nil || tk == nil {
+		valid := core.ValidateKey(key)
+		if !valid {
+			tempKeyArmHint(key)
+		}
+		return key, nil, valid
+	}
+
+	if !tempKeyCommands[opts.command] {
+		fmt.Fprintf(os.Stderr, "错误: 临时密钥 %s 只能用于 load、export、run 和 get 命令\n", tk.Name)
+		os.Exit(1)
+	}
+
+	grant, err := core.RedeemTempKey(key)
+	if err != nil {
+		switch {
+		case errors.Is(err, core.ErrTempKeyExpired):
+			fmt.Fprintf(os.Stderr, "错误: 临时密钥 %s 已过期\n", tk.Name)
+		case errors.Is(err, core.ErrTempKeyUsedUp):
+			fmt.Fprintf(os.Stderr, "错误: 临时密钥 %s 的使用次数已用完\n", tk.Name)
+		default:
+			fmt.Fprintf(os.Stderr, "错误: 无法使用临时密钥 %s: %v\n", tk.Name, err)
+		}
+		os.Exit(1)
+	}
+
+	fmt.Fprintf(os.Stderr, "正在使用临时密钥 %s (%s 在创建时的变量快照): %s，%s\n",
+		grant.Name, grant.File, usesLeftText(&grant.NamedTempKey), expiryText(&grant.NamedTempKey, time.Now()))
+	return "", grant, true
+}
+
+// tempKeyArmHint explains a rejected policy temporary key: it has used up its uses, or has never
+// been armed, which is the case for every temporary key set up before "tempkey arm" existed
+func tempKeyArmHint(key string) {
+	policy, err := core.LoadPolicy()
+	if err != nil || policy.TempKey == "" || key != policy.TempKey {
+		return
+	}
+	fmt.Fprintln(os.Stderr, "提示: 策略中的临时密钥尚未启用或使用次数已用完，请运行 ./lhkeymanager tempkey arm 授予使用次数")
+}
+
+// usesLeftText describes the remaining uses of a temporary key
+func usesLeftText(tk *core.NamedTempKey) string {
+	if left := tk.UsesLeft(); left >= 0 {
+		return fmt.Sprintf("剩余 %d 次使用", left)
+	}
+	return "使用次数不限"
+}
+
+// expiryText describes when a temporary key expires
+func expiryText(tk *core.NamedTempKey, now time.Time) string {
+	switch {
+	case tk.ExpiresAt.IsZero():
+		return "永不过期"
+	case tk.Expired(now):
+		return "已过期"
+	default:
+		return fmt.Sprintf("剩余时间 %v", tk.ExpiresAt.Sub(now).Round(time.Minute))
+	}
+}
+
+// loadVariables loads the variables for load, export and run: the snapshot of a temporary key,
+// or the decrypted .env file. The derived keys aren't needed after this and are wiped.
+func loadVariables(key, envFilePath string, opts options) (*core.LoadResult, error) {
+	if opts.grant != nil {
+		return opts.grant.Result(), nil
+	}
+	defer utils.ClearKDFCache()
+	return core.LoadAPIKeys(key, envFilePath)
+}
+
+// agentKey returns the key held by a running agent, or "" if there is none or it is no longer valid
+func agentKey() string {
+	key, err := agent.GetKey(agent.SocketPath())
+	if err != nil {
+		if !errors.Is(err, agent.ErrNotRunning) && !errors.Is(err, agent.ErrUnsupported) {
+			fmt.Fprintf(os.Stderr, "警告: 无法从密钥代理获取密钥: %v\n", err)
+		}
+		return ""
+	}
+	if !core.ValidateKey(key) {
+		clearString(&key)
+		return ""
+	}
+	return key
+}
+
+// agentCommand implements "agent [start|status|lock]"
+func agentCommand(args []string, opts options) {
+	sub := "start"
+	if len(args) > 0 {
+		sub = args[0]
+	}
+	socketPath := agent.SocketPath()
+
+	switch sub {
+	case "start":
+		if status, err := agent.GetStatus(socketPath); err == nil {
+			fmt.Fprintf(os.Stderr, "密钥代理已在运行 (PID %d)\n", status.PID)
+			return
+		}
+
+		key, _ := obtainKey(opts) // Temporary keys are refused for agent
+		defer clearString(&key)
+
+		exe, err := os.Executable()
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "错误: 无法确定程序路径: %v\n", err)
 			os.Exit(1)
 		}
-		inputFile, outputFile := os.Args[2], os.Args[3]
-		encryptFile(key, inputFile, outputFile)
-	case "decrypt-file":
-		if len(os.Args) != 4 {
-			fmt.Fprintln(os.Stderr, "用法: ./lhkeymanager decrypt-file <input_path> <output_path>")
+		serveArgs := []string{"agent", "serve", "--ttl", opts.ttl.String(), "--max-lifetime", opts.maxLifetime.String()}
+		if err := agent.Spawn(exe, serveArgs, key); err != nil {
+			fmt.Fprintf(os.Stderr, "错误: 启动密钥代理失败: %v\n", err)
+			os.Exit(1)
+		}
+
+		// Wait until the agent answers
+		for i := 0; i < 50; i++ {
+			if status, err := agent.GetStatus(socketPath); err == nil {
+				fmt.Fprintf(os.Stderr, "密钥代理已启动 (PID %d)，套接字: %s\n", status.PID, socketPath)
+				fmt.Fprintf(os.Stderr, "空闲 %v 或运行 %v 后将自动清除密钥\n", opts.ttl, opts.maxLifetime)
+				return
+			}
+			time.Sleep(100 * time.Millisecond)
+		}
+		fmt.Fprintln(os.Stderr, "错误: 密钥代理未能在 5 秒内启动")
+		os.Exit(1)
+
+	case "serve":
+		// Internal: run by "agent start" with the key on standard input
+		keyBytes, err := io.ReadAll(os.Stdin)
+		if err != nil || len(keyBytes) == 0 {
+			os.Exit(1)
+		}
+		l, err := agent.Listen(socketPath)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "错误: %v\n", err)
+			os.Exit(1)
+		}
+		server := agent.NewServer(keyBytes, opts.ttl, opts.maxLifetime)
+		if err := server.Serve(l); err != nil {
+			os.Exit(1)
+		}
+
+	case "status":
+		status, err := agent.GetStatus(socketPath)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "密钥代理未运行: %v\n", err)
+			os.Exit(1)
+		}
+		fmt.Printf("密钥代理正在运行 (PID %d)\n", status.PID)
+		fmt.Printf("套接字: %s\n", socketPath)
+		fmt.Printf("启动时间: %s\n", status.Started.Format(time.DateTime))
+		fmt.Printf("密钥过期时间: %s (空闲超时 %v，最长 %v)\n", status.ExpiresAt.Format(time.DateTime), status.IdleTimeout, status.MaxLifetime)
+
+	case "lock":
+		if err := agent.Lock(socketPath); err != nil {
+			fmt.Fprintf(os.Stderr, "错误: 锁定密钥代理失败: %v\n", err)
 			os.Exit(1)
 		}
-		inputFile, outputFile := os.Args[2], os.Args[3]
-		decryptFile(key, inputFile, outputFile)
+		fmt.Fprintln(os.Stderr, "密钥代理已清除密钥并退出")
+
 	default:
-		fmt.Fprintf(os.Stderr, "错误: 未知命令 '%s'. 可用命令: store, load, export, encrypt-file, decrypt-file\n", choice)
-		fmt.Fprintln(os.Stderr, "用法: ./lhkeymanager <command> [args...]")
+		fmt.Fprintln(os.Stderr, "用法: ./lhkeymanager agent [start|status|lock] [--ttl 15m] [--max-lifetime 8h]")
 		os.Exit(1)
 	}
 }
@@ -153,163 +678,1398 @@ func storeKey(reader *bufio.Reader, key string, envFilePath string) {
 	}
 }
 
-// Load keys from the .env file into a new bash session
-func loadKeysToNewBash(key string, envFilePath string) {
-	// Check if .env file exists
-	if _, err := os.Stat(envFilePath); os.IsNotExist(err) {
-		fmt.Printf("错误: 文件 %s 不存在\n", envFilePath)
+// sessionVar marks a shell started by load and holds the path of the loaded file
+const sessionVar = "LHKM_SESSION"
+
+// maxValueSize limits how much is read for a value from a file or stdin
+const maxValueSize = 1 << 20
+
+// checkSetArgs checks the arguments of set, so that mistakes are reported before the key is asked for
+func checkSetArgs(args []string, opts options) {
+	if len(args) != 1 {
+		fmt.Fprintln(os.Stderr, "用法: ./lhkeymanager set <NAME> [--file path] [--from-file path | --stdin]")
+		os.Exit(1)
+	}
+	if !utils.IsValidEnvName(args[0]) {
+		fmt.Fprintf(os.Stderr, "错误: 无效的变量名 '%s'\n", args[0])
+		os.Exit(1)
+	}
+	if problem := setSourceProblem(opts, term.IsTerminal(int(os.Stdin.Fd()))); problem != "" {
+		fmt.Fprintln(os.Stderr, "错误: "+problem)
+		fmt.Fprintln(os.Stderr, "用法: ./lhkeymanager set <NAME> [--file path] [--from-file path | --stdin]")
 		os.Exit(1)
 	}
+}
 
-	// Set file permissions
-	err := os.Chmod(envFilePath, 0600)
-	if err != nil {
-		fmt.Printf("设置 %s 文件权限失败: %v\n", envFilePath, err)
-		// Continue execution, don't exit
+// setSourceProblem describes what is wrong with where set would read the value from, or returns "".
+// The value is never read from a terminal, not even with --stdin, since it would be echoed;
+// only the key is prompted for.
+func setSourceProblem(opts options, stdinIsTerminal bool) string {
+	switch {
+	case opts.fromFile != "" && opts.stdin:
+		return "--from-file 和 --stdin 只能使用其中一个"
+	case opts.fromFile != "":
+		if _, err := os.Stat(opts.fromFile); err != nil {
+			return fmt.Sprintf("无法读取 %s: %v", opts.fromFile, err)
+		}
+	case stdinIsTerminal && opts.stdin:
+		return "--stdin 只接受管道输入，不会从终端读取值，以免回显"
+	case stdinIsTerminal:
+		return "请通过 --from-file、--stdin 或管道提供要加密的值"
 	}
+	return ""
+}
 
-	// Load and decrypt API keys
-	decryptedVars, err := core.LoadAPIKeys(key, envFilePath)
+// setKey encrypts a single value and stores it in the env file, updating an existing variable in place.
+// Nothing is asked for but the encryption key, and neither the value nor its ciphertext is printed.
+func setKey(key, name, envFilePath string, opts options) {
+	value, err := readSetValue(opts)
 	if err != nil {
-		fmt.Printf("从 %s 加载密钥失败: %v\n", envFilePath, err)
+		fmt.Fprintf(os.Stderr, "错误: 读取 %s 的值失败: %v\n", name, err)
 		os.Exit(1)
 	}
+	defer clearString(&value)
 
-	// Create temporary environment variables file
-	tempEnv, err := os.CreateTemp("", "env_vars_*")
-	if err != nil {
-		fmt.Printf("创建临时文件失败: %v\n", err)
+	if _, err := core.StoreAPIKey(value, name, key, envFilePath); err != nil {
+		warnIntegrity(err)
+		fmt.Fprintf(os.Stderr, "错误: 保存 %s 失败: %v\n", name, err)
 		os.Exit(1)
 	}
-	tempEnvPath := tempEnv.Name()
-	defer os.Remove(tempEnvPath) // Ensure temporary file is deleted on exit
+	fmt.Fprintf(os.Stderr, "已加密 %s 并保存到 %s\n", name, envFilePath)
+}
+
+// readSetValue reads the value for set from --from-file, or else from standard input,
+// which checkSetArgs only allows when it isn't a terminal
+func readSetValue(opts options) (string, error) {
+	if opts.fromFile != "" {
+		f, err := os.Open(opts.fromFile)
+		if err != nil {
+			return "", err
+		}
+		defer f.Close()
+		return readValueFrom(f)
+	}
+	return readValueFrom(os.Stdin)
+}
 
-	// Set temporary file permissions
-	err = os.Chmod(tempEnvPath, 0600)
+// readValueFrom reads a value that may span several lines, such as a certificate or an SSH key.
+// One trailing newline is removed, as added by echo and most editors.
+func readValueFrom(r io.Reader) (string, error) {
+	data, err := io.ReadAll(io.LimitReader(r, maxValueSize+1))
 	if err != nil {
-		fmt.Printf("设置临时文件权限失败: %v\n", err)
-		// Continue execution, don't exit
+		return "", err
+	}
+	if len(data) > maxValueSize {
+		return "", fmt.Errorf("value is longer than %d bytes", maxValueSize)
+	}
+	value := strings.TrimSuffix(string(data), "\n")
+	value = strings.TrimSuffix(value, "\r")
+	if value == "" {
+		return "", fmt.Errorf("value is empty")
+	}
+	if strings.ContainsRune(value, 0) {
+		return "", utils.ErrNULInValue
+	}
+	return value, nil
+}
+
+// Load keys from the .env file into a new shell session
+func loadKeysToNewShell(key string, envFilePath string, opts options) {
+	// A temporary key doesn't read the file
+	if opts.grant == nil {
+		// Check if .env file exists
+		if _, err := os.Stat(envFilePath); os.IsNotExist(err) {
+			fmt.Printf("错误: 文件 %s 不存在\n", envFilePath)
+			os.Exit(1)
+		}
+
+		// Set file permissions
+		if err := os.Chmod(envFilePath, 0600); err != nil {
+			fmt.Printf("设置 %s 文件权限失败: %v\n", envFilePath, err)
+			// Continue execution, don't exit
+		}
 	}
 
-	// Write basic shell configuration
-	tempEnv.WriteString("#!/bin/bash\n")
-	tempEnv.WriteString("# This is an automatically generated temporary environment variables file\n\n")
+	// Load and decrypt API keys
+	result, err := loadVariables(key, envFilePath, opts)
+	if err != nil {
+		warnIntegrity(err)
+		printLoadFailures(result)
+		fmt.Printf("从 %s 加载密钥失败: %v\n", envFilePath, err)
+		os.Exit(1)
+	}
+	checkLoadResult(envFilePath, result, opts)
 
-	// Write environment variables to temporary file
-	for name, value := range decryptedVars {
-		tempEnv.WriteString(fmt.Sprintf("export %s='%s'\n", name, value))
+	for _, name := range result.Names {
 		fmt.Printf("已设置环境变量: %s\n", name)
 	}
 	fmt.Println() // 添加换行
 
-	// Close temporary file
-	tempEnv.Close()
+	// Mark the session so prompts can show it and load can refuse to nest
+	session := envFilePath
+	if abs, err := filepath.Abs(envFilePath); err == nil {
+		session = abs
+	}
+	vars := append(loadedEntries(result), utils.EnvEntry{Name: sessionVar, Value: session})
 
-	// Start new bash session
-	fmt.Println("正在启动新的bash会话，环境变量已设置...")
+	// The variables are passed in the shell's environment, never through a file
+	shell := userShell(opts.shell)
+	fmt.Printf("正在启动新的 %s 会话，环境变量已设置...\n", shell)
 
-	// Use source command to load environment variables and start new bash
-	cmd := exec.Command("bash", "-c", fmt.Sprintf("source %s && bash", tempEnvPath))
+	cmd := exec.Command(shell)
+	cmd.Env = mergeEnv(os.Environ(), vars)
 	cmd.Stdin = os.Stdin
 	cmd.Stdout = os.Stdout
 	cmd.Stderr = os.Stderr
 
-	err = cmd.Run()
+	code, err := runChild(cmd)
 	if err != nil {
-		fmt.Printf("启动bash会话失败: %v\n", err)
+		fmt.Printf("启动 %s 会话失败: %v\n", shell, err)
 		os.Exit(1)
 	}
 
-	// Securely delete temporary file
-	secureDeleteFile(tempEnvPath)
+	fmt.Printf("\n%s 会话已结束，环境变量已清除\n", shell)
+	os.Exit(code)
+}
 
-	fmt.Println("\nbash会话已结束，环境变量已清除")
+// userShell returns the shell to start for load: the --shell flag, then $SHELL,
+// then the platform default
+func userShell(flagShell string) string {
+	if flagShell != "" {
+		return flagShell
+	}
+	if shell := os.Getenv("SHELL"); shell != "" {
+		return shell
+	}
+	if runtime.GOOS == "windows" {
+		if comspec := os.Getenv("COMSPEC"); comspec != "" {
+			return comspec
+		}
+		return "cmd.exe"
+	}
+	return "bash"
 }
 
 // exportKeys loads keys from the .env file and prints them as export commands
-func exportKeys(key string, envFilePath string) {
-	// Check if .env file exists
-	if _, err := os.Stat(envFilePath); os.IsNotExist(err) {
+func exportKeys(key string, envFilePath string, opts options) {
+	// Check if .env file exists; a temporary key doesn't read it
+	if _, err := os.Stat(envFilePath); os.IsNotExist(err) && opts.grant == nil {
 		// Print to stderr so it doesn't get captured by eval
 		fmt.Fprintf(os.Stderr, "错误: 文件 %s 不存在\n", envFilePath)
 		os.Exit(1)
 	}
 
 	// Load and decrypt API keys
-	decryptedVars, err := core.LoadAPIKeys(key, envFilePath)
+	result, err := loadVariables(key, envFilePath, opts)
 	if err != nil {
+		warnIntegrity(err)
+		printLoadFailures(result)
 		fmt.Fprintf(os.Stderr, "从 %s 加载密钥失败: %v\n", envFilePath, err)
 		os.Exit(1)
 	}
+	checkLoadResult(envFilePath, result, opts)
 
-	// Write environment variables to standard output
-	for name, value := range decryptedVars {
-		// Use single quotes to handle special characters in values
-		fmt.Printf("export %s='%s';\n", name, value)
-	}
-}
-
-// encryptFile reads a plaintext env file, encrypts values, and writes to an output file.
-func encryptFile(key, inputFile, outputFile string) {
-	// Read the plaintext file
-	vars, err := utils.ReadEnvFile(inputFile)
+	// Render every variable before printing, so eval never sees partial output
+	formatter, _ := utils.LookupExportFormatter(opts.format) // Checked before the key prompt
+	output, err := formatter(loadedEntries(result))
 	if err != nil {
-		fmt.Fprintf(os.Stderr, "错误: 读取输入文件 %s 失败: %v\n", inputFile, err)
+		fmt.Fprintf(os.Stderr, "错误: %v\n", err)
 		os.Exit(1)
 	}
 
-	// Open output file for writing, create or truncate
-	file, err := os.Create(outputFile)
+	// Write environment variables to standard output
+	fmt.Print(output)
+}
+
+// loadedEntries returns the loaded variables in file order
+func loadedEntries(result *core.LoadResult) []utils.EnvEntry {
+	entries := make([]utils.EnvEntry, 0, len(result.Names))
+	for _, name := range result.Names {
+		entries = append(entries, utils.EnvEntry{Name: name, Value: result.Vars[name]})
+	}
+	return entries
+}
+
+// nameCommand describes a command whose first arguments are variable names
+type nameCommand struct {
+	names int    // number of variable names before the optional file path
+	usage string // arguments for the usage message
+}
+
+// nameCommands are the commands that take variable names before the file path
+var nameCommands = map[string]nameCommand{
+	"get":    {names: 1, usage: "get [-n] [--clip [--clear-after 30s]] <NAME> [file_path]"},
+	"rm":     {names: 1, usage: "rm [--force] <NAME> [file_path]"},
+	"rename": {names: 2, usage: "rename <OLD_NAME> <NEW_NAME> [file_path]"},
+}
+
+// Exit codes of the get command, so scripts can tell why no value was printed.
+// 1 is used for other errors, and the flag package exits with 2 on invalid flags.
+const (
+	exitNotFound      = 3
+	exitDecryptFailed = 4
+)
+
+// getCommand decrypts a single variable and prints it to stdout, or copies it to the terminal's clipboard
+func getCommand(key, name, envFilePath string, opts options) {
+	if opts.grant != nil && !opts.grant.Allows(name) {
+		fmt.Fprintf(os.Stderr, "错误: 临时密钥 %s 无权读取变量 %s\n", opts.grant.Name, name)
+		os.Exit(1)
+	}
+
+	var value string
+	var err error
+	if opts.grant != nil {
+		value, err = opts.grant.Get(name)
+	} else {
+		value, err = core.GetAPIKey(key, name, envFilePath)
+	}
+	if err != nil {
+		var failure *core.DecryptFailure
+		switch {
+		case errors.Is(err, core.ErrVariableNotFound):
+			fmt.Fprintf(os.Stderr, "错误: %s 中没有变量 %s\n", envFilePath, name)
+			os.Exit(exitNotFound)
+		case errors.As(err, &failure):
+			fmt.Fprintf(os.Stderr, "错误: 变量 %s (第 %d 行) 解密失败: %s\n", name, failure.Line, failureReasonText(failure.Reason))
+			os.Exit(exitDecryptFailed)
+		default:
+			warnIntegrity(err)
+			fmt.Fprintf(os.Stderr, "错误: 从 %s 读取 %s 失败: %v\n", envFilePath, name, err)
+			os.Exit(1)
+		}
+	}
+	defer clearString(&value)
+
+	if opts.clip {
+		copyToClipboard(name, value, opts.clearAfter)
+		return
+	}
+	fmt.Print(value)
+	if !opts.noNewline {
+		fmt.Println()
+	}
+}
+
+// copyToClipboard puts a value on the terminal's clipboard with an OSC 52 escape sequence,
+// then waits and clears the clipboard again. Ctrl-C clears it right away.
+// clearAfter: how long to keep the value, or 0 to leave it on the clipboard
+func copyToClipboard(name, value string, clearAfter time.Duration) {
+	tty, err := openTerminal()
 	if err != nil {
-		fmt.Fprintf(os.Stderr, "错误: 创建输出文件 %s 失败: %v\n", outputFile, err)
+		fmt.Fprintf(os.Stderr, "错误: 无法复制到剪贴板: %v\n", err)
 		os.Exit(1)
 	}
-	defer file.Close()
+	defer tty.Close()
+
+	tmux := os.Getenv("TMUX") != ""
+	if _, err := io.WriteString(tty, utils.OSC52(value, tmux)); err != nil {
+		fmt.Fprintf(os.Stderr, "错误: 无法复制到剪贴板: %v\n", err)
+		os.Exit(1)
+	}
+	if clearAfter <= 0 {
+		fmt.Fprintf(os.Stderr, "已将 %s 复制到剪贴板 (终端需支持 OSC 52)\n", name)
+		return
+	}
 
-	// Set permissions
-	if err := os.Chmod(outputFile, 0600); err != nil {
-		fmt.Fprintf(os.Stderr, "警告: 无法在 %s 上设置权限: %v\n", outputFile, err)
+	fmt.Fprintf(os.Stderr, "已将 %s 复制到剪贴板 (终端需支持 OSC 52)，将在 %v 后清除，按 Ctrl-C 立即清除\n", name, clearAfter)
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	defer signal.Stop(signals)
+	select {
+	case <-time.After(clearAfter):
+	case <-signals:
 	}
 
-	writer := bufio.NewWriter(file)
+	io.WriteString(tty, utils.OSC52("", tmux))
+	fmt.Fprintln(os.Stderr, "剪贴板已清除")
+}
+
+// openTerminal opens the controlling terminal for writing escape sequences, so they reach it
+// even when stdout and stderr are redirected. Falls back to stderr if that is a terminal.
+func openTerminal() (io.WriteCloser, error) {
+	if tty, err := os.OpenFile("/dev/tty", os.O_WRONLY, 0); err == nil {
+		return tty, nil
+	}
+	if term.IsTerminal(int(os.Stderr.Fd())) {
+		return nopCloser{os.Stderr}, nil
+	}
+	return nil, errors.New("没有可用的终端")
+}
+
+// nopCloser keeps a shared writer such as stderr open when closed
+type nopCloser struct {
+	io.Writer
+}
+
+func (nopCloser) Close() error { return nil }
 
-	for name, value := range vars {
-		encrypted, err := core.EncryptValue(value, key)
+// removeKey removes a variable from the env file, keeping a backup
+func removeKey(key, name, envFilePath string, opts options) {
+	err := core.RemoveAPIKey(key, name, envFilePath, opts.force)
+	if err != nil {
+		var failure *core.DecryptFailure
+		switch {
+		case errors.Is(err, core.ErrVariableNotFound):
+			fmt.Fprintf(os.Stderr, "错误: %s 中没有变量 %s\n", envFilePath, name)
+		case errors.As(err, &failure):
+			fmt.Fprintf(os.Stderr, "错误: 变量 %s (第 %d 行) 无法用该密钥解密: %s\n", name, failure.Line, failureReasonText(failure.Reason))
+			fmt.Fprintln(os.Stderr, "确认要删除时请使用 --force")
+		default:
+			warnIntegrity(err)
+			fmt.Fprintf(os.Stderr, "错误: 从 %s 删除 %s 失败: %v\n", envFilePath, name, err)
+		}
+		os.Exit(1)
+	}
+	fmt.Fprintf(os.Stderr, "已从 %s 删除 %s，原文件已备份到 %s.bak\n", envFilePath, name, envFilePath)
+}
+
+// renameKey renames a variable in the env file, keeping a backup
+func renameKey(key, oldName, newName, envFilePath string) {
+	err := core.RenameAPIKey(key, oldName, newName, envFilePath)
+	if err != nil {
+		var failure *core.DecryptFailure
+		switch {
+		case errors.Is(err, core.ErrVariableNotFound):
+			fmt.Fprintf(os.Stderr, "错误: %s 中没有变量 %s\n", envFilePath, oldName)
+		case errors.As(err, &failure):
+			fmt.Fprintf(os.Stderr, "错误: 变量 %s (第 %d 行) 解密失败，无法重新加密: %s\n", oldName, failure.Line, failureReasonText(failure.Reason))
+		default:
+			warnIntegrity(err)
+			fmt.Fprintf(os.Stderr, "错误: 将 %s 重命名为 %s 失败: %v\n", oldName, newName, err)
+		}
+		os.Exit(1)
+	}
+	fmt.Fprintf(os.Stderr, "已将 %s 重命名为 %s，原文件已备份到 %s.bak\n", oldName, newName, envFilePath)
+}
+
+// editDirs are the candidate parents of the temporary directory of edit, in order of preference.
+// The decrypted file must not reach a disk, so only memory-backed file systems are used.
+func editDirs() []string {
+	return []string{"/dev/shm", os.Getenv("XDG_RUNTIME_DIR")}
+}
+
+// editFile decrypts the env file into a temporary file on a memory-backed file system, opens it in
+// the user's editor, and encrypts the changes again. The editor is reopened on syntax errors.
+// The temporary file is securely removed in any case, also on Ctrl-C, SIGTERM and SIGHUP.
+func editFile(reader *bufio.Reader, key, envFilePath string) {
+	edit, err := core.OpenEnvEdit(key, envFilePath)
+	if errors.Is(err, core.ErrDuplicateVariable) {
+		fmt.Fprintf(os.Stderr, "错误: %v\n请先删除重复的定义，例如使用 rm 命令\n", err)
+		os.Exit(1)
+	}
+	if err != nil {
+		warnIntegrity(err)
+		fmt.Fprintf(os.Stderr, "错误: 无法解密 %s: %v\n", envFilePath, err)
+		os.Exit(1)
+	}
+	if len(edit.Skipped) > 0 {
+		fmt.Fprintf(os.Stderr, "警告: %d 个变量无法解密，将以加密形式显示，不修改则保持原样:\n", len(edit.Skipped))
+		for _, failure := range edit.Skipped {
+			fmt.Fprintf(os.Stderr, "  %s (第 %d 行): %s\n", failure.Name, failure.Line, failureReasonText(failure.Reason))
+		}
+	}
+
+	dir, err := makeEditDir()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "错误: %v\n", err)
+		os.Exit(1)
+	}
+
+	// The editor handles Ctrl-C itself while it runs; any other time it aborts the edit
+	var editing atomic.Bool
+	var once sync.Once
+	cleanup := func() { once.Do(func() { removeEditDir(dir) }) }
+	defer cleanup()
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM, syscall.SIGHUP)
+	defer signal.Stop(signals)
+	go func() {
+		for sig := range signals {
+			if sig == os.Interrupt && editing.Load() {
+				continue
+			}
+			cleanup()
+			fmt.Fprintln(os.Stderr, "\n已中断，未保存任何修改，临时文件已删除")
+			os.Exit(130)
+		}
+	}()
+	fail := func(format string, args ...any) {
+		cleanup()
+		fmt.Fprintf(os.Stderr, format, args...)
+		os.Exit(1)
+	}
+
+	path := filepath.Join(dir, filepath.Base(envFilePath))
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		fail("错误: 无法创建临时文件: %v\n", err)
+	}
+	_, err = f.WriteString(edit.Text)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		fail("错误: 无法写入临时文件: %v\n", err)
+	}
+
+	editor := editorCommand()
+	for {
+		cmd := exec.Command(editor[0], append(editor[1:], path)...)
+		cmd.Stdin, cmd.Stdout, cmd.Stderr = os.Stdin, os.Stdout, os.Stderr
+		editing.Store(true)
+		err := cmd.Run()
+		editing.Store(false)
 		if err != nil {
-			fmt.Fprintf(os.Stderr, "错误: 加密 %s 的值失败: %v\n", name, err)
-			os.Exit(1)
+			fail("错误: 编辑器 %s 运行失败: %v\n", editor[0], err)
 		}
-		_, err = writer.WriteString(fmt.Sprintf("%s=%s\n", name, encrypted))
+
+		edited, err := os.ReadFile(path)
 		if err != nil {
-			fmt.Fprintf(os.Stderr, "错误: 写入输出文件失败: %v\n", err)
+			fail("错误: 无法读取临时文件: %v\n", err)
+		}
+		if string(edited) == edit.Text {
+			fmt.Fprintln(os.Stderr, "未作任何修改")
+			return
+		}
+
+		result, err := edit.Save(string(edited))
+		if errors.Is(err, core.ErrEditSyntax) {
+			fmt.Fprintf(os.Stderr, "错误: %v\n", err)
+			fmt.Fprint(os.Stderr, "按回车重新打开编辑器，输入 q 放弃所有修改: ")
+			answer, readErr := reader.ReadString('\n')
+			if readErr != nil || strings.EqualFold(strings.TrimSpace(answer), "q") {
+				fmt.Fprintln(os.Stderr, "已放弃修改")
+				return
+			}
+			continue
+		}
+		if err != nil {
+			warnIntegrity(err)
+			fail("错误: 保存 %s 失败，未写入任何修改: %v\n", envFilePath, err)
+		}
+
+		printEditResult(envFilePath, result)
+		return
+	}
+}
+
+// makeEditDir creates a private temporary directory on a memory-backed file system
+func makeEditDir() (string, error) {
+	for _, parent := range editDirs() {
+		if parent == "" {
+			continue
+		}
+		if info, err := os.Stat(parent); err != nil || !info.IsDir() {
+			continue
+		}
+		// MkdirTemp creates the directory with permissions 0700
+		if dir, err := os.MkdirTemp(parent, "lhkeymanager-edit-"); err == nil {
+			return dir, nil
+		}
+	}
+	return "", fmt.Errorf("找不到可用的内存文件系统 (/dev/shm 或 $XDG_RUNTIME_DIR)，为避免明文写入磁盘，已取消编辑")
+}
+
+// removeEditDir securely deletes every file in the temporary directory, including editor swap
+// and backup files, and then the directory itself
+func removeEditDir(dir string) {
+	filepath.WalkDir(dir, func(path string, d os.DirEntry, err error) error {
+		if err == nil && d.Type().IsRegular() {
+			secureDeleteFile(path)
+		}
+		return nil
+	})
+	os.RemoveAll(dir)
+}
+
+// editorCommand returns the user's editor from $VISUAL or $EDITOR, split into the program and its arguments
+func editorCommand() []string {
+	for _, name := range []string{"VISUAL", "EDITOR"} {
+		if fields := strings.Fields(os.Getenv(name)); len(fields) > 0 {
+			return fields
+		}
+	}
+	if runtime.GOOS == "windows" {
+		return []string{"notepad"}
+	}
+	return []string{"vi"}
+}
+
+// printEditResult reports the variables changed by edit
+func printEditResult(envFilePath string, result *core.EditResult) {
+	if !result.Saved {
+		fmt.Fprintln(os.Stderr, "未作任何修改")
+		return
+	}
+	parts := []struct {
+		label string
+		names []string
+	}{
+		{"修改", result.Changed},
+		{"新增", result.Added},
+		{"删除", result.Removed},
+	}
+	var summary []string
+	for _, part := range parts {
+		if len(part.names) > 0 {
+			summary = append(summary, fmt.Sprintf("%s %s", part.label, strings.Join(part.names, ", ")))
+		}
+	}
+	if len(summary) == 0 {
+		summary = append(summary, "只修改了注释或空行")
+	}
+	fmt.Fprintf(os.Stderr, "已保存 %s: %s\n", envFilePath, strings.Join(summary, "；"))
+	if result.Backup != "" {
+		fmt.Fprintf(os.Stderr, "原文件已备份到 %s\n", result.Backup)
+	}
+}
+
+// listEntries prints the variables of the env file with their format and length, never their values.
+// With a key, it also shows whether each encrypted value decrypts and checks the file's signature,
+// and exits with status 1 if anything fails.
+// key: the encryption key, or "" to list without decrypting
+func listEntries(key, envFilePath string, opts options) {
+	var infos []core.EntryInfo
+	var err error
+	if key == "" {
+		infos, err = core.ListEntries(envFilePath)
+	} else {
+		infos, err = core.VerifyEntries(key, envFilePath)
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "错误: 无法读取 %s: %v\n", envFilePath, err)
+		os.Exit(1)
+	}
+
+	if opts.json {
+		output, err := json.MarshalIndent(infos, "", "  ")
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "错误: %v\n", err)
+			os.Exit(1)
+		}
+		fmt.Println(string(output))
+	} else {
+		printEntryTable(infos, key != "")
+	}
+	if key == "" {
+		return
+	}
+
+	failed := 0
+	for _, info := range infos {
+		if info.Decrypts != nil && !*info.Decrypts {
+			failed++
+		}
+	}
+	if failed > 0 {
+		fmt.Fprintf(os.Stderr, "错误: %d 个变量解密失败\n", failed)
+	}
+
+	signed, err := core.VerifyFile(key, envFilePath)
+	switch {
+	case err != nil:
+		warnIntegrity(err)
+		fmt.Fprintf(os.Stderr, "错误: 文件签名校验失败: %v\n", err)
+		os.Exit(1)
+	case signed:
+		fmt.Fprintln(os.Stderr, "文件签名有效")
+	default:
+		fmt.Fprintln(os.Stderr, "文件未签名")
+	}
+	if failed > 0 {
+		os.Exit(1)
+	}
+}
+
+// printEntryTable prints the listed variables as a table
+// verified: whether the entries were checked with a key
+func printEntryTable(infos []core.EntryInfo, verified bool) {
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	header := "行\t名称\t格式\t长度"
+	if verified {
+		header += "\t解密"
+	}
+	fmt.Fprintln(w, header)
+	for _, info := range infos {
+		fmt.Fprintf(w, "%d\t%s\t%s\t%d", info.Line, info.Name, entryFormatText(info), info.Length)
+		if verified {
+			fmt.Fprintf(w, "\t%s", decryptStatusText(info))
+		}
+		fmt.Fprintln(w)
+	}
+	w.Flush()
+}
+
+// entryFormatText describes the format of a listed variable
+func entryFormatText(info core.EntryInfo) string {
+	switch info.Kind {
+	case core.KindPlaintext:
+		return "明文"
+	case core.KindLegacy:
+		return info.Format + " (旧版)"
+	case core.KindUnknown:
+		return info.Format + " (不支持)"
+	default:
+		return info.Format
+	}
+}
+
+// decryptStatusText describes whether a listed variable decrypts
+func decryptStatusText(info core.EntryInfo) string {
+	switch {
+	case info.Decrypts == nil:
+		return "-"
+	case *info.Decrypts:
+		return "成功"
+	default:
+		return "失败: " + failureReasonText(info.Reason)
+	}
+}
+
+// runCommand runs a program with the decrypted variables added to its environment.
+// The secrets are passed in memory only and never written to disk.
+// SIGTERM is forwarded to the program and its exit code is returned as ours.
+func runCommand(key, envFilePath string, command []string, opts options) {
+	// Load and decrypt API keys
+	result, err := loadVariables(key, envFilePath, opts)
+	if err != nil {
+		warnIntegrity(err)
+		printLoadFailures(result)
+		fmt.Fprintf(os.Stderr, "错误: 从 %s 加载密钥失败: %v\n", envFilePath, err)
+		os.Exit(1)
+	}
+	checkLoadResult(envFilePath, result, opts)
+	if err := result.Filter(opts.only, opts.exclude); err != nil {
+		fmt.Fprintf(os.Stderr, "错误: %v\n", err)
+		os.Exit(1)
+	}
+
+	cmd := exec.Command(command[0], command[1:]...)
+	cmd.Env = mergeEnv(os.Environ(), loadedEntries(result))
+	cmd.Stdin = os.Stdin
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+
+	code, err := runChild(cmd)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "错误: 启动 %s 失败: %v\n", command[0], err)
+		if errors.Is(err, exec.ErrNotFound) || errors.Is(err, os.ErrNotExist) {
+			os.Exit(127)
+		}
+		os.Exit(126)
+	}
+	os.Exit(code)
+}
+
+// runChild starts cmd, forwards SIGTERM to it while it runs and waits for it.
+// Ctrl-C, Ctrl-\ and a hangup of the terminal reach the child directly, as it shares our
+// foreground process group; they are only kept from stopping us, since forwarding them
+// as well would deliver each one twice, and a second SIGINT means "force quit" to many programs.
+// Returns the exit code of the command, or an error if it could not be started
+func runChild(cmd *exec.Cmd) (int, error) {
+	// Register before starting, so no signal is lost in between. The signals are caught
+	// rather than ignored, as an ignored signal would stay ignored in the child.
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM, syscall.SIGHUP, syscall.SIGQUIT)
+	defer signal.Stop(signals)
+
+	if err := cmd.Start(); err != nil {
+		return 0, err
+	}
+
+	done := make(chan struct{})
+	go func() {
+		for {
+			select {
+			case sig := <-signals:
+				if sig == syscall.SIGTERM {
+					cmd.Process.Signal(sig)
+				}
+			case <-done:
+				return
+			}
+		}
+	}()
+
+	err := cmd.Wait()
+	close(done)
+	return exitCode(err), nil
+}
+
+// mergeEnv returns base with the variables added, replacing variables of the same name
+func mergeEnv(base []string, vars []utils.EnvEntry) []string {
+	replaced := make(map[string]bool, len(vars))
+	for _, v := range vars {
+		replaced[v.Name] = true
+	}
+
+	env := make([]string, 0, len(base)+len(vars))
+	for _, entry := range base {
+		name, _, _ := strings.Cut(entry, "=")
+		if !replaced[name] {
+			env = append(env, entry)
+		}
+	}
+	for _, v := range vars {
+		env = append(env, v.Name+"="+v.Value)
+	}
+	return env
+}
+
+// exitCode converts the result of running a command to an exit code,
+// using the shell convention 128+n for a command killed by signal n
+func exitCode(err error) int {
+	if err == nil {
+		return 0
+	}
+	var exitErr *exec.ExitError
+	if !errors.As(err, &exitErr) {
+		return 1
+	}
+	if status, ok := exitErr.Sys().(syscall.WaitStatus); ok && status.Signaled() {
+		return 128 + int(status.Signal())
+	}
+	return exitErr.ExitCode()
+}
+
+// encryptFile reads a plaintext env file, encrypts values, and writes to an output file.
+// If sign is set, the output file gets an integrity trailer.
+func encryptFile(key, inputFile, outputFile string, sign bool) {
+	// Read the plaintext file, keeping its comments and order
+	doc, err := utils.LoadEnvDocument(inputFile)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "错误: 读取输入文件 %s 失败: %v\n", inputFile, err)
+		os.Exit(1)
+	}
+
+	// Encrypt values in place; values that are already encrypted are kept
+	count, err := doc.Update(func(name, value string) (string, error) {
+		if core.IsEncryptedValue(value) {
+			return value, nil
+		}
+		return core.EncryptValue(name, value, key)
+	})
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "错误: 加密失败: %v\n", err)
+		os.Exit(1)
+	}
+
+	// Any old trailer no longer matches the content
+	doc.SetMAC("")
+	if err := doc.Save(outputFile); err != nil {
+		fmt.Fprintf(os.Stderr, "错误: 写入输出文件 %s 失败: %v\n", outputFile, err)
+		os.Exit(1)
+	}
+
+	if sign {
+		if err := core.SignFile(key, outputFile); err != nil {
+			fmt.Fprintf(os.Stderr, "错误: 为 %s 添加完整性校验失败: %v\n", outputFile, err)
 			os.Exit(1)
 		}
 	}
 
-	writer.Flush()
-	fmt.Fprintf(os.Stderr, "成功将 %d 个变量加密到 %s\n", len(vars), outputFile)
+	fmt.Fprintf(os.Stderr, "成功将 %d 个变量加密到 %s\n", count, outputFile)
+}
+
+// signFile adds or refreshes the integrity trailer of an env file
+func signFile(key, envFilePath string) {
+	if _, err := os.Stat(envFilePath); os.IsNotExist(err) {
+		fmt.Fprintf(os.Stderr, "错误: 文件 %s 不存在\n", envFilePath)
+		os.Exit(1)
+	}
+
+	// Make sure the key is the one the file is encrypted with before signing
+	if _, err := core.LoadAPIKeys(key, envFilePath); err != nil && !errors.Is(err, core.ErrIntegrity) {
+		fmt.Fprintf(os.Stderr, "错误: 从 %s 加载密钥失败: %v\n", envFilePath, err)
+		os.Exit(1)
+	}
+
+	if err := core.SignFile(key, envFilePath); err != nil {
+		fmt.Fprintf(os.Stderr, "错误: 为 %s 添加完整性校验失败: %v\n", envFilePath, err)
+		os.Exit(1)
+	}
+	fmt.Fprintf(os.Stderr, "已为 %s 添加完整性校验\n", envFilePath)
 }
 
 // decryptFile reads an encrypted env file, decrypts values, and writes to an output file.
-func decryptFile(key, inputFile, outputFile string) {
-	decryptedVars, err := core.LoadAPIKeys(key, inputFile)
+func decryptFile(key, inputFile, outputFile string, opts options) {
+	result, err := core.LoadAPIKeys(key, inputFile)
 	if err != nil {
+		warnIntegrity(err)
+		printLoadFailures(result)
 		fmt.Fprintf(os.Stderr, "错误: 从 %s 加载或解密密钥失败: %v\n", inputFile, err)
 		os.Exit(1)
 	}
+	checkLoadResult(inputFile, result, opts)
 
-	file, err := os.Create(outputFile)
+	// Replace the values in place so comments and order survive; values that
+	// could not be decrypted were reported above and are left as they are
+	doc, err := utils.LoadEnvDocument(inputFile)
 	if err != nil {
-		fmt.Fprintf(os.Stderr, "错误: 创建输出文件 %s 失败: %v\n", outputFile, err)
+		fmt.Fprintf(os.Stderr, "错误: 读取输入文件 %s 失败: %v\n", inputFile, err)
 		os.Exit(1)
 	}
-	defer file.Close()
+	doc.Update(func(name, value string) (string, error) {
+		if plaintext, err := core.DecryptValue(name, value, key); err == nil {
+			return plaintext, nil
+		}
+		return value, nil
+	})
+	doc.SetMAC("")
+
+	if err := doc.Save(outputFile); err != nil {
+		fmt.Fprintf(os.Stderr, "错误: 写入输出文件 %s 失败: %v\n", outputFile, err)
+		os.Exit(1)
+	}
+
+	fmt.Fprintf(os.Stderr, "成功将 %d 个变量解密到 %s\n", len(result.Names), outputFile)
+}
+
+// rekeyFile re-encrypts every encrypted value in the env file with a new key
+func rekeyFile(oldKey, envFilePath string) {
+	if _, err := os.Stat(envFilePath); os.IsNotExist(err) {
+		fmt.Fprintf(os.Stderr, "错误: 文件 %s 不存在\n", envFilePath)
+		os.Exit(1)
+	}
+
+	// The new key may equal the old one, which upgrades outdated formats in place
+	newKey := readNewKey()
+	defer clearString(&newKey)
+
+	count, err := core.RekeyFile(oldKey, newKey, envFilePath)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "错误: 更换 %s 的密钥失败: %v\n", envFilePath, err)
+		os.Exit(1)
+	}
+
+	fmt.Fprintf(os.Stderr, "成功使用新密钥重新加密 %d 个变量，原文件已备份到 %s.bak\n", count, envFilePath)
+
+	// A running agent still holds the old key
+	if err := agent.Lock(agent.SocketPath()); err == nil {
+		fmt.Fprintln(os.Stderr, "密钥代理持有旧密钥，已将其锁定")
+	}
+}
+
+// readNewKey asks for a new encryption key twice, at most 3 times
+// The rules a rejected key breaks are always shown, since the user is creating the key.
+// Exits the program after the last failed attempt
+func readNewKey() string {
+	policy, err := core.LoadPolicy()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "错误: 安全策略无效: %v\n", err)
+		os.Exit(1)
+	}
+
+	maxAttempts := 3
+	for i := 0; i < maxAttempts; i++ {
+		newKey := readPassword("请输入新的加密密钥: ")
+
+		if violations := policy.Explain(newKey); len(violations) > 0 {
+			clearString(&newKey)
+			fmt.Fprintln(os.Stderr, "错误: 新密钥不符合安全策略:")
+			for _, v := range violations {
+				fmt.Fprintf(os.Stderr, "  - %s\n", violationText(v, policy))
+			}
+		} else {
+			confirm := readPassword("请再次输入新的加密密钥: ")
+			match := newKey == confirm
+			clearString(&confirm)
+			if match {
+				return newKey
+			}
+			clearString(&newKey)
+			fmt.Fprintln(os.Stderr, "错误: 两次输入的密钥不一致")
+		}
+
+		if i < maxAttempts-1 {
+			fmt.Fprintf(os.Stderr, "您还有 %d 次机会。\n", maxAttempts-1-i)
+		}
+	}
+	fmt.Fprintln(os.Stderr, "错误: 已达到最大尝试次数。")
+	os.Exit(1)
+	return ""
+}
+
+// readPassword prints a prompt and reads a line from the terminal without echo
+// Exits the program if the terminal can't be read
+func readPassword(prompt string) string {
+	fmt.Fprint(os.Stderr, prompt)
+	bytePassword, err := term.ReadPassword(int(syscall.Stdin))
+	fmt.Fprintln(os.Stderr)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "读取密钥失败: %v\n", err)
+		os.Exit(1)
+	}
+	return string(bytePassword)
+}
+
+// tempKeyCommand implements "tempkey add|list|revoke", which manage the named temporary keys,
+// and "tempkey arm", which grants the policy's temporary key its uses
+func tempKeyCommand(args []string, opts options) {
+	usage := "用法: ./lhkeymanager tempkey add <name> [--file .env] [--ttl 24h] [--max-uses N] [--only names] | list | revoke <name> | arm"
+	if len(args) == 0 {
+		fmt.Fprintln(os.Stderr, usage)
+		os.Exit(1)
+	}
+
+	switch args[0] {
+	case "add":
+		if len(args) != 2 {
+			fmt.Fprintln(os.Stderr, usage)
+			os.Exit(1)
+		}
+		if opts.ttl < 0 || opts.maxUses < 0 {
+			fmt.Fprintln(os.Stderr, "错误: --ttl 和 --max-uses 不能为负数")
+			os.Exit(1)
+		}
+		if opts.ttl == 0 && opts.maxUses == 0 {
+			fmt.Fprintln(os.Stderr, "错误: 临时密钥至少需要 --ttl 或 --max-uses 其中一项限制")
+			os.Exit(1)
+		}
+
+		key, _ := obtainKey(opts) // Temporary keys are refused for tempkey
+		defer clearString(&key)
+		defer utils.ClearKDFCache()
+
+		spec := core.NamedTempKey{Name: args[1], MaxUses: opts.maxUses, Only: opts.only}
+		if opts.ttl > 0 {
+			spec.ExpiresAt = time.Now().Add(opts.ttl).Truncate(time.Second)
+		}
+		tempKey, err := core.AddTempKey(key, opts.file, spec)
+		if err != nil {
+			warnIntegrity(err)
+			if errors.Is(err, core.ErrNotOwner) {
+				fmt.Fprintln(os.Stderr, "错误: 状态目录中的临时密钥记录属于另一个加密密钥")
+			} else {
+				fmt.Fprintf(os.Stderr, "错误: 创建临时密钥失败: %v\n", err)
+			}
+			os.Exit(1)
+		}
+		defer clearString(&tempKey)
+
+		fmt.Fprintf(os.Stderr, "已创建临时密钥 %s (%s，%s)，可读取 %s 中变量的当前快照。密钥只显示这一次:\n",
+			spec.Name, usesLeftText(&spec), expiryText(&spec, time.Now()), opts.file)
+		fmt.Println(tempKey)
+
+	case "list":
+		keys, err := core.ListTempKeys()
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "错误: 读取临时密钥失败: %v\n", err)
+			os.Exit(1)
+		}
+		if len(keys) == 0 {
+			fmt.Println("没有临时密钥")
+			return
+		}
+
+		now := time.Now()
+		w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(w, "名称\t状态\t已用/上限\t过期时间\t可读取的变量\t文件")
+		for _, tk := range keys {
+			state := "有效"
+			if tk.Expired(now) {
+				state = "已过期"
+			} else if tk.UsesLeft() == 0 {
+				state = "已用完"
+			}
+			limit := "不限"
+			if tk.MaxUses > 0 {
+				limit = strconv.Itoa(tk.MaxUses)
+			}
+			expires := "永不"
+			if !tk.ExpiresAt.IsZero() {
+				expires = tk.ExpiresAt.Local().Format("2006-01-02 15:04")
+			}
+			only := "全部"
+			if len(tk.Only) > 0 {
+				only = strings.Join(tk.Only, ",")
+			}
+			fmt.Fprintf(w, "%s\t%s\t%d/%s\t%s\t%s\t%s\n", tk.Name, state, tk.Uses, limit, expires, only, tk.File)
+		}
+		w.Flush()
+
+	case "revoke":
+		if len(args) != 2 {
+			fmt.Fprintln(os.Stderr, usage)
+			os.Exit(1)
+		}
+		key, _ := obtainKey(opts)
+		defer clearString(&key)
+
+		if err := core.RevokeTempKey(key, args[1]); err != nil {
+			switch {
+			case errors.Is(err, core.ErrTempKeyNotFound):
+				fmt.Fprintf(os.Stderr, "错误: 临时密钥 %s 不存在\n", args[1])
+			case errors.Is(err, core.ErrNotOwner):
+				fmt.Fprintln(os.Stderr, "错误: 状态目录中的临时密钥记录属于另一个加密密钥")
+			default:
+				fmt.Fprintf(os.Stderr, "错误: 撤销临时密钥失败: %v\n", err)
+			}
+			os.Exit(1)
+		}
+		fmt.Fprintf(os.Stderr, "已撤销临时密钥 %s\n", args[1])
+
+	case "arm":
+		if len(args) != 1 {
+			fmt.Fprintln(os.Stderr, usage)
+			os.Exit(1)
+		}
+		key, _ := obtainKey(opts)
+		defer clearString(&key)
+
+		if err := core.ArmTempKey(key); err != nil {
+			switch {
+			case errors.Is(err, core.ErrNoTempKey):
+				fmt.Fprintln(os.Stderr, "错误: 安全策略中没有设置 temp_key")
+			case errors.Is(err, core.ErrNotOwner):
+				fmt.Fprintln(os.Stderr, "错误: 状态目录中的临时密钥记录属于另一个加密密钥")
+			default:
+				fmt.Fprintf(os.Stderr, "错误: 启用临时密钥失败: %v\n", err)
+			}
+			os.Exit(1)
+		}
+		policy, _ := core.LoadPolicy() // Loaded by ArmTempKey
+		fmt.Fprintf(os.Stderr, "已启用策略中的临时密钥，可使用 %d 次\n", policy.TempKeyMaxUsage)
+
+	default:
+		fmt.Fprintln(os.Stderr, usage)
+		os.Exit(1)
+	}
+}
 
-	for name, value := range decryptedVars {
-		fmt.Fprintf(file, "%s=%s\n", name, value)
+// policyCommand implements "policy show" and "policy check"
+func policyCommand(args []string) {
+	sub := "show"
+	if len(args) > 0 {
+		sub = args[0]
 	}
+	if sub != "show" && sub != "check" {
+		fmt.Fprintln(os.Stderr, "用法: ./lhkeymanager policy [show|check]")
+		os.Exit(1)
+	}
+
+	policy, err := core.LoadPolicy()
+
+	fmt.Println("策略文件 (按顺序应用):")
+	for _, path := range core.PolicyFiles() {
+		state := "已应用"
+		if _, statErr := os.Stat(path); statErr != nil {
+			state = "不存在"
+		}
+		fmt.Printf("  %s (%s)\n", path, state)
+	}
+
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "错误: 安全策略无效: %v\n", err)
+		os.Exit(1)
+	}
+
+	if sub == "show" {
+		fmt.Println()
+		w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(w, "规则\t值\t来源")
+		for _, rule := range policy.Rules() {
+			value := rule.Value
+			if rule.Secret {
+				value = "(未设置)"
+				if rule.Value != "" {
+					value = "(已设置，不显示)"
+				}
+			}
+			fmt.Fprintf(w, "%s\t%s\t%s\n", rule.Key, value, rule.Source)
+		}
+		w.Flush()
+		for _, rule := range policy.Ignored {
+			fmt.Fprintf(os.Stderr, "警告: %s\n", ignoredRuleWarning(rule))
+		}
+		return
+	}
+
+	for _, warning := range policyWarnings(policy) {
+		fmt.Fprintf(os.Stderr, "警告: %s\n", warning)
+	}
+	fmt.Println("安全策略有效")
+}
+
+// policyWarnings lists settings that are valid but probably not intended
+func policyWarnings(policy *core.Policy) []string {
+	var warnings []string
+	if policy.RequiredChars == "" && policy.MinSpecialChars > 0 {
+		warnings = append(warnings, "未设置 required_chars，min_special_chars 不会生效")
+	}
+	if policy.MinKeyLength < 12 {
+		warnings = append(warnings, fmt.Sprintf("min_key_length 为 %d，建议至少为 12", policy.MinKeyLength))
+	}
+	if policy.TempKey != "" && policy.TempKeyMaxUsage == 0 {
+		warnings = append(warnings, "已设置 temp_key，但 temp_key_max_usage 为 0，临时密钥永远无法使用")
+	}
+	for _, rule := range policy.Ignored {
+		warnings = append(warnings, ignoredRuleWarning(rule))
+	}
+	return warnings
+}
+
+// ignoredRuleWarning describes a user policy rule that was ignored because it is weaker than the system policy
+func ignoredRuleWarning(rule core.PolicyRule) string {
+	return fmt.Sprintf("%s 中的 %s 比系统策略宽松，已忽略", rule.Source, rule.Key)
+}
+
+// patternNames are the descriptions of the strength patterns shown by check-key
+var patternNames = map[string]string{
+	core.PatternDictionary: "常用词或密码",
+	core.PatternKeyboard:   "键盘连续按键",
+	core.PatternRepeat:     "重复字符",
+	core.PatternSequence:   "连续字符序列",
+	core.PatternYear:       "年份",
+	core.PatternBruteForce: "无规律字符",
+}
+
+// checkKeyCommand scores a candidate key and checks it against the policy without storing it.
+// The key is read from --key-fd, --key-file, the terminal or standard input.
+// Exits with status 1 if the key doesn't satisfy the policy.
+func checkKeyCommand(opts options) {
+	policy, err := core.LoadPolicy()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "错误: 安全策略无效: %v\n", err)
+		os.Exit(1)
+	}
+
+	var key string
+	switch {
+	case opts.keyFD >= 0:
+		key, err = readKeyFD(opts.keyFD)
+	case opts.keyFile != "":
+		key, err = readKeyFile(opts.keyFile)
+	case term.IsTerminal(int(syscall.Stdin)):
+		key = readPassword("请输入要检查的密钥: ")
+	default:
+		key, err = readKeyFrom(os.Stdin)
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "错误: 读取密钥失败: %v\n", err)
+		os.Exit(1)
+	}
+	defer clearString(&key)
+
+	strength := core.EstimateStrength(key)
+	fmt.Printf("估计熵: %.0f 比特\n", strength.Bits)
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	for _, m := range strength.Matches {
+		// Positions only, so the output doesn't reveal the key
+		fmt.Fprintf(w, "  第 %d-%d 个字符\t%s\t%.1f 比特\n", m.Start+1, m.End, patternNames[m.Pattern], m.Bits)
+	}
+	w.Flush()
+
+	violations := policy.Explain(key)
+	if len(violations) == 0 {
+		fmt.Println("密钥符合安全策略")
+		return
+	}
+	fmt.Println("密钥不符合安全策略:")
+	for _, v := range violations {
+		fmt.Printf("  - %s\n", violationText(v, policy))
+	}
+	os.Exit(1)
+}
+
+// benchmarkKDF measures the key derivation on this machine and suggests cost settings
+func benchmarkKDF(args []string) {
+	target := 500 * time.Millisecond
+	if len(args) > 0 {
+		ms, err := strconv.Atoi(args[0])
+		if err != nil || ms <= 0 {
+			fmt.Fprintln(os.Stderr, "用法: ./lhkeymanager kdf-bench [target_ms]")
+			os.Exit(1)
+		}
+		target = time.Duration(ms) * time.Millisecond
+	}
+
+	current := core.ConfiguredKDFParams()
+	fmt.Fprintf(os.Stderr, "正在测试 Argon2id (内存 %d KiB, 并行度 %d)，目标耗时 %v...\n", current.Memory, current.Threads, target)
+	params, elapsed := utils.BenchmarkKDF(target, current.Memory, current.Threads)
+
+	fmt.Printf("建议参数: %s (单次派生耗时 %v)\n", params, elapsed.Round(time.Millisecond))
+	fmt.Println("构建时可通过以下 -ldflags 设置:")
+	fmt.Printf("  -X 'github.com/clh021/lhkeymanager/core.KDFTime=%d'\n", params.Time)
+	fmt.Printf("  -X 'github.com/clh021/lhkeymanager/core.KDFMemory=%d'\n", params.Memory)
+	fmt.Printf("  -X 'github.com/clh021/lhkeymanager/core.KDFThreads=%d'\n", params.Threads)
+}
+
+// warnIntegrity prints a prominent warning if err reports a failed file integrity check
+func warnIntegrity(err error) {
+	if !errors.Is(err, core.ErrIntegrity) {
+		return
+	}
+	fmt.Fprintln(os.Stderr, "!!!!!!!!!!!!!!!!!!!!!!!!!!!!!!!!!!!!!!!!!!!!!!!!!!!!!!!!!!!!")
+	fmt.Fprintln(os.Stderr, "警告: 文件完整性校验失败！")
+	if errors.Is(err, core.ErrUnsigned) {
+		fmt.Fprintln(os.Stderr, "文件缺少完整性签名，但它曾经签过名，或安全策略要求签名 (require_mac)。")
+		fmt.Fprintln(os.Stderr, "签名行可能被删除了，以便让注入的条目不经校验就被加载。")
+	} else {
+		fmt.Fprintln(os.Stderr, "文件中的条目在签名后被删除、修改、重新排序或注入。")
+	}
+	fmt.Fprintln(os.Stderr, "为安全起见，不会导出任何变量。确认改动无误后可运行 sign 命令重新签名。")
+	fmt.Fprintln(os.Stderr, "!!!!!!!!!!!!!!!!!!!!!!!!!!!!!!!!!!!!!!!!!!!!!!!!!!!!!!!!!!!!")
+}
+
+// options holds the command line flags
+type options struct {
+	command string // the command being run
+
+	strict bool   // fail if any encrypted variable can't be decrypted
+	mac    bool   // sign the output file of encrypt-file
+	file   string // env file of the run and set commands
+	format string // output format of the export command
+	shell  string // shell started by load
+	force  bool   // allow load inside an existing session, or rm of a value that doesn't decrypt
+
+	explain bool   // show which rules a rejected key breaks
+	keyFD   int    // read the key from this file descriptor
+	keyFile string // read the key from this file
 
-	fmt.Fprintf(os.Stderr, "成功将 %d 个变量解密到 %s\n", len(decryptedVars), outputFile)
+	ttl         time.Duration // idle timeout of the agent
+	maxLifetime time.Duration // maximum lifetime of the agent
+	only        stringList    // name patterns to pass to the program
+	exclude     stringList    // name patterns to keep from the program
+	maxUses     int           // uses of a new temporary key
+	json        bool          // print the list as JSON
+	noNewline   bool          // print the value of get without a trailing newline
+	clip        bool          // copy the value of get to the clipboard instead of printing it
+	clearAfter  time.Duration // clear the clipboard after this long
+	fromFile    string        // read the value of set from this file
+	stdin       bool          // read the value of set from stdin
+	verify      bool          // check that the listed values decrypt
+
+	grant *core.TempKeyGrant // the temporary key the encryption key was redeemed from, if any
+}
+
+// stringList is a flag that may be repeated and takes comma separated values
+type stringList []string
+
+func (l *stringList) String() string {
+	return strings.Join(*l, ",")
+}
+
+func (l *stringList) Set(value string) error {
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			*l = append(*l, item)
+		}
+	}
+	return nil
+}
+
+// newFlagSet creates the flag set for a command, registering only the flags it uses
+func newFlagSet(command string, opts *options) *flag.FlagSet {
+	fs := flag.NewFlagSet(command, flag.ExitOnError)
+
+	// Non-interactive key sources, shared by all commands that need the key
+	fs.IntVar(&opts.keyFD, "key-fd", -1, "从该文件描述符读取加密密钥")
+	fs.StringVar(&opts.keyFile, "key-file", "", "从该文件读取加密密钥 (权限不得宽于 600)")
+	fs.BoolVar(&opts.explain, "explain", false, "密钥验证失败时说明违反了哪些规则 (会暴露安全策略)")
+
+	switch command {
+	case "load":
+		fs.BoolVar(&opts.strict, "strict", false, "任何加密变量解密失败时立即退出")
+		fs.StringVar(&opts.shell, "shell", "", "要启动的 shell (默认使用 $SHELL)")
+		fs.BoolVar(&opts.force, "force", false, "允许在已有会话中再次加载")
+	case "decrypt-file":
+		fs.BoolVar(&opts.strict, "strict", false, "任何加密变量解密失败时立即退出")
+	case "export":
+		fs.BoolVar(&opts.strict, "strict", false, "任何加密变量解密失败时立即退出")
+		fs.StringVar(&opts.format, "format", "sh", "输出格式: "+strings.Join(utils.ExportFormatNames(), ", "))
+	case "run":
+		fs.BoolVar(&opts.strict, "strict", false, "任何加密变量解密失败时立即退出")
+		fs.StringVar(&opts.file, "file", ".env", "环境文件路径")
+		fs.Var(&opts.only, "only", "只传递匹配的变量 (逗号分隔, 支持 * 通配符)")
+		fs.Var(&opts.exclude, "exclude", "不传递匹配的变量 (逗号分隔, 支持 * 通配符)")
+	case "agent":
+		fs.DurationVar(&opts.ttl, "ttl", agent.DefaultIdleTimeout, "空闲多久后清除密钥")
+		fs.DurationVar(&opts.maxLifetime, "max-lifetime", agent.DefaultMaxLifetime, "最长保留密钥的时间")
+	case "encrypt-file":
+		fs.BoolVar(&opts.mac, "mac", false, "为输出文件添加完整性校验 (MAC)")
+	case "set":
+		fs.StringVar(&opts.file, "file", ".env", "环境文件路径")
+		fs.StringVar(&opts.fromFile, "from-file", "", "从该文件读取要加密的值")
+		fs.BoolVar(&opts.stdin, "stdin", false, "从标准输入（管道）读取要加密的值")
+	case "rm":
+		fs.BoolVar(&opts.force, "force", false, "即使变量无法用该密钥解密也删除")
+	case "get":
+		fs.BoolVar(&opts.noNewline, "n", false, "输出值后不换行")
+		fs.BoolVar(&opts.clip, "clip", false, "通过 OSC 52 复制到终端剪贴板，而不是输出")
+		fs.DurationVar(&opts.clearAfter, "clear-after", 30*time.Second, "多久后清除剪贴板 (0 表示不清除)")
+	case "list":
+		fs.BoolVar(&opts.json, "json", false, "以 JSON 格式输出")
+		fs.BoolVar(&opts.verify, "verify", false, "输入密钥并检查每个加密变量能否解密")
+	case "tempkey":
+		fs.DurationVar(&opts.ttl, "ttl", 24*time.Hour, "临时密钥的有效期 (0 表示永不过期)")
+		fs.IntVar(&opts.maxUses, "max-uses", 0, "临时密钥的最大使用次数 (0 表示不限)")
+		fs.Var(&opts.only, "only", "临时密钥只能读取匹配的变量 (逗号分隔, 支持 * 通配符)")
+		fs.StringVar(&opts.file, "file", ".env", "为临时密钥保存变量快照的环境文件")
+	}
+	return fs
+}
+
+// parseFlags parses command flags that may appear before, between or after positional arguments
+// Returns the positional arguments in their original order
+func parseFlags(fs *flag.FlagSet, args []string) []string {
+	var positional []string
+	for {
+		fs.Parse(args) // ExitOnError: prints usage and exits on invalid flags
+		rest := fs.Args()
+
+		// Parsing stops right after a "--" terminator; everything that follows is positional
+		if n := len(args) - len(rest); n > 0 && args[n-1] == "--" {
+			return append(positional, rest...)
+		}
+		if len(rest) == 0 {
+			return positional
+		}
+		positional = append(positional, rest[0])
+		args = rest[1:]
+	}
+}
+
+// checkLoadResult reports skipped and outdated variables on stderr, so it doesn't get captured by eval.
+// In strict mode any skipped variable aborts the command.
+func checkLoadResult(envFilePath string, result *core.LoadResult, opts options) {
+	printLoadFailures(result)
+	if opts.strict && len(result.Failures) > 0 {
+		fmt.Fprintf(os.Stderr, "错误: 严格模式下 %s 中的所有加密变量都必须解密成功\n", envFilePath)
+		os.Exit(1)
+	}
+
+	if len(result.Legacy) > 0 {
+		fmt.Fprintf(os.Stderr, "警告: %s 中有 %d 个变量仍使用旧版加密格式: %s\n",
+			envFilePath, len(result.Legacy), strings.Join(result.Legacy, ", "))
+		fmt.Fprintln(os.Stderr, "建议使用 rekey 命令重新加密这些变量 (新密钥可以与旧密钥相同)")
+	}
+}
+
+// printLoadFailures prints a summary of the variables that could not be decrypted
+func printLoadFailures(result *core.LoadResult) {
+	if result == nil || len(result.Failures) == 0 {
+		return
+	}
+	fmt.Fprintf(os.Stderr, "警告: %d 个变量解密失败，已跳过:\n", len(result.Failures))
+	for _, failure := range result.Failures {
+		fmt.Fprintf(os.Stderr, "  %s (第 %d 行): %s\n", failure.Name, failure.Line, failureReasonText(failure.Reason))
+	}
+}
+
+// failureReasonText describes a decryption failure reason for the user
+func failureReasonText(reason core.FailureReason) string {
+	switch reason {
+	case core.ReasonBadEncoding:
+		return "base64 编码无效"
+	case core.ReasonAuthFailed:
+		return "认证失败 (密钥错误、内容被篡改或值来自其他变量)"
+	case core.ReasonUnknownFormat:
+		return "不支持的加密格式版本"
+	default:
+		return "密文格式错误"
+	}
 }
 
 // secureDeleteFile attempts to securely delete a file
@@ -1,8 +1,18 @@
 package main
 
 import (
+	"flag"
 	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"syscall"
 	"testing"
+	"time"
+
+	"github.com/clh021/lhkeymanager/core"
+	"github.com/clh021/lhkeymanager/utils"
 )
 
 // TestMain is a simple test to ensure the main package compiles
@@ -93,3 +103,322 @@ func TestSecureDeleteFile(t *testing.T) {
 		t.Errorf("Expected file to be deleted, but it still exists")
 	}
 }
+
+// TestParseFlags tests that flags may be mixed with positional arguments
+func TestParseFlags(t *testing.T) {
+	testCases := []struct {
+		name       string
+		args       []string
+		expectMAC  bool
+		positional []string
+	}{
+		{name: "Flags first", args: []string{"--mac", "in", "out"}, expectMAC: true, positional: []string{"in", "out"}},
+		{name: "Flags between", args: []string{"in", "--mac", "out"}, expectMAC: true, positional: []string{"in", "out"}},
+		{name: "Flags last", args: []string{"in", "out", "-mac"}, expectMAC: true, positional: []string{"in", "out"}},
+		{name: "No flags", args: []string{"in", "out"}, positional: []string{"in", "out"}},
+		{name: "Terminator", args: []string{"in", "--", "--mac"}, positional: []string{"in", "--mac"}},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			fs := flag.NewFlagSet("test", flag.ContinueOnError)
+			mac := fs.Bool("mac", false, "")
+			positional := parseFlags(fs, tc.args)
+
+			if *mac != tc.expectMAC {
+				t.Errorf("Expected mac=%v, got %v", tc.expectMAC, *mac)
+			}
+			if strings.Join(positional, " ") != strings.Join(tc.positional, " ") {
+				t.Errorf("Expected %q, got %q", tc.positional, positional)
+			}
+		})
+	}
+}
+
+func TestMergeEnv(t *testing.T) {
+	vars := []utils.EnvEntry{{Name: "API_KEY", Value: "secret"}, {Name: "EMPTY", Value: ""}}
+	env := mergeEnv([]string{"PATH=/bin", "API_KEY=old", "HOME=/root"}, vars)
+
+	expected := "PATH=/bin HOME=/root API_KEY=secret EMPTY="
+	if strings.Join(env, " ") != expected {
+		t.Errorf("Expected %q, got %q", expected, env)
+	}
+}
+
+func TestUserShell(t *testing.T) {
+	t.Setenv("SHELL", "/usr/bin/fish")
+	if shell := userShell(""); shell != "/usr/bin/fish" {
+		t.Errorf("Expected $SHELL, got %q", shell)
+	}
+	if shell := userShell("/bin/zsh"); shell != "/bin/zsh" {
+		t.Errorf("Expected --shell to win, got %q", shell)
+	}
+
+	t.Setenv("SHELL", "")
+	if shell := userShell(""); shell == "" {
+		t.Errorf("Expected a default shell")
+	}
+}
+
+func TestExitCode(t *testing.T) {
+	if code := exitCode(nil); code != 0 {
+		t.Errorf("Expected 0 for success, got %d", code)
+	}
+
+	err := exec.Command("sh", "-c", "exit 3").Run()
+	if code := exitCode(err); code != 3 {
+		t.Errorf("Expected exit code 3, got %d (%v)", code, err)
+	}
+
+	err = exec.Command("sh", "-c", "kill -TERM $$").Run()
+	if code := exitCode(err); code != 128+int(syscall.SIGTERM) {
+		t.Errorf("Expected exit code %d, got %d (%v)", 128+int(syscall.SIGTERM), code, err)
+	}
+}
+
+func TestStringList(t *testing.T) {
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	var list stringList
+	fs.Var(&list, "only", "")
+	if err := fs.Parse([]string{"--only", "A, B", "--only", "C"}); err != nil {
+		t.Fatalf("Parse failed: %v", err)
+	}
+	if list.String() != "A,B,C" {
+		t.Errorf("Expected A,B,C, got %q", list.String())
+	}
+}
+
+func TestLoadedEntries(t *testing.T) {
+	result := &core.LoadResult{
+		Vars:  map[string]string{"B": "it's", "A": "$(id)"},
+		Names: []string{"B", "A"},
+	}
+	entries := loadedEntries(result)
+	if len(entries) != 2 || entries[0].Name != "B" || entries[0].Value != "it's" || entries[1].Name != "A" {
+		t.Errorf("Unexpected entries: %+v", entries)
+	}
+}
+
+func TestAgentKey_NotRunning(t *testing.T) {
+	t.Setenv("LHKM_AGENT_SOCK", t.TempDir()+"/missing.sock")
+	if key := agentKey(); key != "" {
+		t.Errorf("Expected no key without an agent, got %q", key)
+	}
+}
+
+func TestReadKeyFile(t *testing.T) {
+	dir := t.TempDir()
+	path := dir + "/key"
+	if err := os.WriteFile(path, []byte("lh-test-key-1234!@u\n"), 0600); err != nil {
+		t.Fatalf("Failed to write key file: %v", err)
+	}
+
+	key, err := readKeyFile(path)
+	if err != nil || key != "lh-test-key-1234!@u" {
+		t.Errorf("Expected key without newline, got %q (%v)", key, err)
+	}
+
+	// Files other users can read are refused
+	if err := os.Chmod(path, 0640); err != nil {
+		t.Fatalf("Failed to chmod: %v", err)
+	}
+	if _, err := readKeyFile(path); err == nil {
+		t.Errorf("Expected error for a key file with permissions 0640")
+	}
+
+	if _, err := readKeyFile(dir); err == nil {
+		t.Errorf("Expected error for a directory")
+	}
+}
+
+func TestReadKeyFD(t *testing.T) {
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatalf("Failed to create pipe: %v", err)
+	}
+	w.WriteString("lh-test-key-1234!@u\r\n")
+	w.Close()
+
+	key, err := readKeyFD(int(r.Fd()))
+	if err != nil || key != "lh-test-key-1234!@u" {
+		t.Errorf("Expected key without newline, got %q (%v)", key, err)
+	}
+}
+
+func TestReadKeyFrom(t *testing.T) {
+	testCases := []struct {
+		name    string
+		input   string
+		key     string
+		wantErr bool
+	}{
+		{name: "Plain", input: "secret", key: "secret"},
+		{name: "Only one newline removed", input: "secret\n\n", key: "secret\n"},
+		{name: "Spaces kept", input: " secret ", key: " secret "},
+		{name: "Empty", input: "\n", wantErr: true},
+		{name: "Too long", input: strings.Repeat("a", maxKeySize+1), wantErr: true},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			key, err := readKeyFrom(strings.NewReader(tc.input))
+			if tc.wantErr {
+				if err == nil {
+					t.Errorf("Expected error, got key %q", key)
+				}
+				return
+			}
+			if err != nil || key != tc.key {
+				t.Errorf("Expected %q, got %q (%v)", tc.key, key, err)
+			}
+		})
+	}
+}
+
+func TestReadValueFrom(t *testing.T) {
+	pem := "-----BEGIN CERTIFICATE-----\nMIIB\n-----END CERTIFICATE-----"
+	testCases := []struct {
+		name    string
+		input   string
+		value   string
+		wantErr bool
+	}{
+		{name: "Plain", input: "secret\n", value: "secret"},
+		{name: "Multiline", input: pem + "\n", value: pem},
+		{name: "CRLF", input: "secret\r\n", value: "secret"},
+		{name: "Only one newline removed", input: "a\nb\n\n", value: "a\nb\n"},
+		{name: "Empty", input: "", wantErr: true},
+		{name: "NUL", input: "a\x00b", wantErr: true},
+		{name: "Too long", input: strings.Repeat("a", maxValueSize+1), wantErr: true},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			value, err := readValueFrom(strings.NewReader(tc.input))
+			if tc.wantErr {
+				if err == nil {
+					t.Errorf("Expected error, got value %q", value)
+				}
+				return
+			}
+			if err != nil || value != tc.value {
+				t.Errorf("Expected %q, got %q (%v)", tc.value, value, err)
+			}
+		})
+	}
+}
+
+func TestSetSourceProblem(t *testing.T) {
+	valueFile := filepath.Join(t.TempDir(), "value")
+	if err := os.WriteFile(valueFile, []byte("secret\n"), 0600); err != nil {
+		t.Fatalf("Failed to write value file: %v", err)
+	}
+
+	testCases := []struct {
+		name     string
+		opts     options
+		terminal bool
+		ok       bool
+	}{
+		{name: "Pipe", ok: true},
+		{name: "Pipe with --stdin", opts: options{stdin: true}, ok: true},
+		{name: "From file at a terminal", opts: options{fromFile: valueFile}, terminal: true, ok: true},
+		{name: "Terminal", terminal: true},
+		{name: "Terminal with --stdin", opts: options{stdin: true}, terminal: true},
+		{name: "Both sources", opts: options{stdin: true, fromFile: valueFile}},
+		{name: "Missing file", opts: options{fromFile: valueFile + ".missing"}},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			problem := setSourceProblem(tc.opts, tc.terminal)
+			if (problem == "") != tc.ok {
+				t.Errorf("setSourceProblem() = %q, expected ok=%v", problem, tc.ok)
+			}
+		})
+	}
+}
+
+func TestViolationText(t *testing.T) {
+	policy := &core.Policy{KeyPrefix: "lh-", RequiredChars: "!@#"}
+	testCases := []struct {
+		violation core.Violation
+		contains  string
+	}{
+		{core.Violation{Rule: "min_key_length", Want: 14, Got: 8}, "14"},
+		{core.Violation{Rule: "key_prefix"}, `"lh-"`},
+		{core.Violation{Rule: "min_special_chars", Want: 2, Got: 1}, `"!@#"`},
+		{core.Violation{Rule: "min_entropy_bits", Want: 60, Got: 53}, "53"},
+	}
+
+	for _, tc := range testCases {
+		if text := violationText(tc.violation, policy); !strings.Contains(text, tc.contains) {
+			t.Errorf("%s: expected %q in %q", tc.violation.Rule, tc.contains, text)
+		}
+	}
+}
+
+func TestTempKeyTexts(t *testing.T) {
+	now := time.Now()
+	tk := &core.NamedTempKey{MaxUses: 3, Uses: 1, ExpiresAt: now.Add(90 * time.Minute)}
+	if text := usesLeftText(tk); !strings.Contains(text, "2") {
+		t.Errorf("Expected 2 uses left, got %q", text)
+	}
+	if text := expiryText(tk, now); !strings.Contains(text, "1h30m") {
+		t.Errorf("Expected 1h30m left, got %q", text)
+	}
+
+	unlimited := &core.NamedTempKey{}
+	if usesLeftText(unlimited) != "使用次数不限" || expiryText(unlimited, now) != "永不过期" {
+		t.Errorf("Unexpected texts for an unlimited key: %q, %q", usesLeftText(unlimited), expiryText(unlimited, now))
+	}
+}
+
+func TestEntryTexts(t *testing.T) {
+	ok, failed := true, false
+	testCases := []struct {
+		info           core.EntryInfo
+		format, status string
+	}{
+		{core.EntryInfo{Kind: core.KindPlaintext}, "明文", "-"},
+		{core.EntryInfo{Kind: core.KindCurrent, Format: "enc:AES256v4", Decrypts: &ok}, "enc:AES256v4", "成功"},
+		{core.EntryInfo{Kind: core.KindLegacy, Format: "enc:AES256v3", Decrypts: &ok}, "enc:AES256v3 (旧版)", "成功"},
+		{core.EntryInfo{Kind: core.KindUnknown, Format: "enc:AES256v9", Decrypts: &failed, Reason: core.ReasonUnknownFormat}, "enc:AES256v9 (不支持)", "失败: 不支持的加密格式版本"},
+	}
+	for _, tc := range testCases {
+		if text := entryFormatText(tc.info); text != tc.format {
+			t.Errorf("Expected format %q, got %q", tc.format, text)
+		}
+		if text := decryptStatusText(tc.info); text != tc.status {
+			t.Errorf("Expected status %q, got %q", tc.status, text)
+		}
+	}
+}
+
+func TestNameCommands(t *testing.T) {
+	for name, cmd := range nameCommands {
+		if !strings.HasPrefix(cmd.usage, name+" ") {
+			t.Errorf("%s: usage %q doesn't start with the command", name, cmd.usage)
+		}
+		if got := strings.Count(cmd.usage, "_NAME>") + strings.Count(cmd.usage, "<NAME>"); got != cmd.names {
+			t.Errorf("%s: usage %q names %d variables, expected %d", name, cmd.usage, got, cmd.names)
+		}
+	}
+}
+
+func TestEditorCommand(t *testing.T) {
+	t.Setenv("VISUAL", "")
+	t.Setenv("EDITOR", "code --wait")
+	if got := editorCommand(); !reflect.DeepEqual(got, []string{"code", "--wait"}) {
+		t.Errorf("Expected $EDITOR split into arguments, got %q", got)
+	}
+	t.Setenv("VISUAL", "nano")
+	if got := editorCommand(); !reflect.DeepEqual(got, []string{"nano"}) {
+		t.Errorf("Expected $VISUAL to take precedence, got %q", got)
+	}
+	t.Setenv("VISUAL", "")
+	t.Setenv("EDITOR", " ")
+	if got := editorCommand(); len(got) != 1 || got[0] == "" {
+		t.Errorf("Expected a default editor, got %q", got)
+	}
+}
@@ -3,11 +3,28 @@ package utils
 import (
 	"crypto/aes"
 	"crypto/cipher"
+	"crypto/rand"
 	"crypto/sha256"
 	"encoding/base64"
+	"errors"
 	"fmt"
 )
 
+// Errors returned by the decryption functions, so callers can tell why a value failed
+var (
+	// ErrBadEncoding means the encrypted data is not valid base64
+	ErrBadEncoding = errors.New("base64 decoding failed")
+
+	// ErrMalformedData means the encrypted data is truncated or its fields are invalid
+	ErrMalformedData = errors.New("malformed encrypted data")
+
+	// ErrAuthFailed means the data failed authentication: wrong key, tampering, or a value moved to another name
+	ErrAuthFailed = errors.New("decryption failed")
+
+	// ErrUnsupported means the data was produced with an algorithm this version doesn't know
+	ErrUnsupported = errors.New("unsupported encryption format")
+)
+
 // DecryptAES256 decrypts data using AES-256-GCM
 // encryptedData: base64 encoded encrypted data
 // key: decryption key
@@ -16,40 +33,16 @@ func DecryptAES256(encryptedData string, key string) (string, error) {
 	// Decode base64
 	ciphertext, err := base64.StdEncoding.DecodeString(encryptedData)
 	if err != nil {
-		return "", fmt.Errorf("base64 decoding failed: %w", err)
-	}
-
-	// Check data length
-	if len(ciphertext) < 12+16 {
-		return "", fmt.Errorf("encrypted data too short")
+		return "", fmt.Errorf("%w: %v", ErrBadEncoding, err)
 	}
 
 	// Generate a 32-byte key from the provided key
 	keyBytes := sha256.Sum256([]byte(key))
 
-	// Create AES-256-GCM cipher
-	block, err := aes.NewCipher(keyBytes[:])
-	if err != nil {
-		return "", fmt.Errorf("failed to create AES cipher: %w", err)
-	}
-
-	// Create GCM mode
-	gcm, err := cipher.NewGCM(block)
-	if err != nil {
-		return "", fmt.Errorf("failed to create GCM mode: %w", err)
-	}
-
-	// Extract nonce
-	nonceSize := gcm.NonceSize()
-	if len(ciphertext) < nonceSize {
-		return "", fmt.Errorf("encrypted data too short")
-	}
-	nonce, ciphertext := ciphertext[:nonceSize], ciphertext[nonceSize:]
-
 	// Decrypt
-	plaintext, err := gcm.Open(nil, nonce, ciphertext, nil)
+	plaintext, err := openGCM(keyBytes[:], ciphertext, nil)
 	if err != nil {
-		return "", fmt.Errorf("decryption failed: %w", err)
+		return "", err
 	}
 
 	return string(plaintext), nil
@@ -63,31 +56,53 @@ func EncryptAES256(plaintext string, key string) (string, error) {
 	// Generate a 32-byte key from the provided key
 	keyBytes := sha256.Sum256([]byte(key))
 
-	// Create AES-256-GCM cipher
-	block, err := aes.NewCipher(keyBytes[:])
+	// Encrypt with a random nonce
+	ciphertext, err := sealGCM(keyBytes[:], []byte(plaintext), nil)
 	if err != nil {
-		return "", fmt.Errorf("failed to create AES cipher: %w", err)
+		return "", err
 	}
 
-	// Create GCM mode
+	// Base64 encode
+	encoded := base64.StdEncoding.EncodeToString(ciphertext)
+
+	return encoded, nil
+}
+
+// sealGCM encrypts plaintext with AES-256-GCM under a raw key and a random nonce.
+// additionalData is authenticated but not encrypted. The result is nonce||ciphertext.
+func sealGCM(keyBytes []byte, plaintext []byte, additionalData []byte) ([]byte, error) {
+	block, err := aes.NewCipher(keyBytes)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create AES cipher: %w", err)
+	}
 	gcm, err := cipher.NewGCM(block)
 	if err != nil {
-		return "", fmt.Errorf("failed to create GCM mode: %w", err)
+		return nil, fmt.Errorf("failed to create GCM mode: %w", err)
 	}
-
-	// Create nonce
 	nonce := make([]byte, gcm.NonceSize())
-	// In a production environment, a cryptographically secure random number generator should be used
-	// For simplicity, we use a fixed nonce here
-	for i := range nonce {
-		nonce[i] = byte(i)
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, fmt.Errorf("failed to generate nonce: %w", err)
 	}
+	return gcm.Seal(nonce, nonce, plaintext, additionalData), nil
+}
 
-	// Encrypt
-	ciphertext := gcm.Seal(nonce, nonce, []byte(plaintext), nil)
-
-	// Base64 encode
-	encoded := base64.StdEncoding.EncodeToString(ciphertext)
-
-	return encoded, nil
+// openGCM decrypts nonce||ciphertext produced by sealGCM with the same additionalData
+func openGCM(keyBytes []byte, ciphertext []byte, additionalData []byte) ([]byte, error) {
+	block, err := aes.NewCipher(keyBytes)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create AES cipher: %w", err)
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create GCM mode: %w", err)
+	}
+	if len(ciphertext) < gcm.NonceSize()+gcm.Overhead() {
+		return nil, fmt.Errorf("%w: encrypted data too short", ErrMalformedData)
+	}
+	nonce, ciphertext := ciphertext[:gcm.NonceSize()], ciphertext[gcm.NonceSize():]
+	plaintext, err := gcm.Open(nil, nonce, ciphertext, additionalData)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrAuthFailed, err)
+	}
+	return plaintext, nil
 }
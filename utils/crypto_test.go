@@ -129,8 +129,9 @@ func TestEncryptAES256_DifferentKeys(t *testing.T) {
 	}
 }
 
-func TestEncryptAES256_Deterministic(t *testing.T) {
-	// Since we're using a fixed nonce, encryption should be deterministic
+func TestEncryptAES256_RandomNonce(t *testing.T) {
+	// Every encryption must use a fresh nonce, so the same plaintext never
+	// produces the same ciphertext twice under one key
 	plaintext := "test-data"
 	key := "test-key-12345u"
 
@@ -145,8 +146,32 @@ func TestEncryptAES256_Deterministic(t *testing.T) {
 		t.Fatalf("EncryptAES256 failed: %v", err)
 	}
 
-	// Verify that the encrypted data is the same
-	if encrypted1 != encrypted2 {
-		t.Errorf("Expected same encrypted data for same plaintext and key")
+	// Verify that the encrypted data differs
+	if encrypted1 == encrypted2 {
+		t.Errorf("Expected different encrypted data for repeated encryption")
+	}
+
+	// Both must still decrypt to the original plaintext
+	for _, encrypted := range []string{encrypted1, encrypted2} {
+		decrypted, err := DecryptAES256(encrypted, key)
+		if err != nil {
+			t.Fatalf("DecryptAES256 failed: %v", err)
+		}
+		if decrypted != plaintext {
+			t.Errorf("Expected %q, got %q", plaintext, decrypted)
+		}
+	}
+}
+
+func TestDecryptAES256_LegacyFixedNonce(t *testing.T) {
+	// Produced by the original implementation, which used the nonce 0,1,...,11
+	legacy := "AAECAwQFBgcICQoLoPermubQm+/vw6TIoKrFGOY9Gfu4O5JgH9XXjAW3GQ=="
+
+	decrypted, err := DecryptAES256(legacy, "test-key-12345u")
+	if err != nil {
+		t.Fatalf("DecryptAES256 failed: %v", err)
+	}
+	if decrypted != "sk-legacy-value" {
+		t.Errorf("Expected %q, got %q", "sk-legacy-value", decrypted)
 	}
 }
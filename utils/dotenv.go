@@ -0,0 +1,294 @@
+package utils
+
+import (
+	"fmt"
+	"strings"
+)
+
+// The dotenv syntax follows the conventions shared by godotenv and docker compose:
+//
+//	# full line comment
+//	export NAME=value          # "export" prefix is optional
+//	NAME = unquoted value      # inline comments need whitespace before '#'
+//	NAME='literal $value'      # single quotes: no escapes, may span lines
+//	NAME="line\nbreak \"x\""   # double quotes: \n \r \t \\ \" \' \$ escapes, may span lines
+//
+// Variable expansion ($VAR, ${VAR}) is deliberately not performed: values are secrets
+// and are kept exactly as written.
+
+// envStatement is one top-level element of a dotenv file: an assignment, a comment or a blank line.
+// start and end are byte offsets into the source, end includes the terminating newline.
+type envStatement struct {
+	start, end int
+	entry      *EnvEntry // nil for comments and blank lines
+}
+
+// envParser scans dotenv content
+type envParser struct {
+	src  string
+	pos  int
+	line int
+}
+
+// ParseEnv parses dotenv content
+// content: the file content
+// Returns the variables in file order, including duplicates, or an error naming the offending line
+func ParseEnv(content string) ([]EnvEntry, error) {
+	statements, err := parseEnvStatements(content)
+	if err != nil {
+		return nil, err
+	}
+
+	var entries []EnvEntry
+	for _, st := range statements {
+		if st.entry != nil {
+			entries = append(entries, *st.entry)
+		}
+	}
+	return entries, nil
+}
+
+// parseEnvStatements splits dotenv content into statements that together cover the whole content
+func parseEnvStatements(content string) ([]envStatement, error) {
+	p := &envParser{src: content, line: 1}
+	var statements []envStatement
+
+	for p.pos < len(p.src) {
+		start := p.pos
+		entry, err := p.parseLine()
+		if err != nil {
+			return nil, err
+		}
+		statements = append(statements, envStatement{start: start, end: p.pos, entry: entry})
+	}
+	return statements, nil
+}
+
+// parseLine parses one statement and advances past its terminating newline
+func (p *envParser) parseLine() (*EnvEntry, error) {
+	p.skipBlanks()
+
+	// Blank line or comment
+	if p.atLineEnd() || p.peek() == '#' {
+		p.skipToLineEnd()
+		p.consumeNewline()
+		return nil, nil
+	}
+
+	line := p.line
+
+	// Optional "export" prefix, only when followed by whitespace
+	if rest := p.src[p.pos:]; strings.HasPrefix(rest, "export") && len(rest) > 6 && (rest[6] == ' ' || rest[6] == '\t') {
+		p.pos += 6
+		p.skipBlanks()
+	}
+
+	// Variable name
+	nameStart := p.pos
+	for p.pos < len(p.src) && isEnvNameChar(p.src[p.pos]) {
+		p.pos++
+	}
+	name := p.src[nameStart:p.pos]
+	if name == "" || !isEnvNameStart(name[0]) {
+		return nil, fmt.Errorf("line %d: invalid variable name", line)
+	}
+
+	p.skipBlanks()
+	if p.peek() != '=' {
+		return nil, fmt.Errorf("line %d: expected '=' after %s", line, name)
+	}
+	p.pos++
+	valueStart := p.pos
+	p.skipBlanks()
+
+	// Value
+	var value string
+	var err error
+	switch p.peek() {
+	case '#':
+		// "NAME= # comment" has an empty value, "NAME=#x" has the value "#x"
+		if p.pos > valueStart {
+			p.skipToLineEnd()
+		} else {
+			value = p.parseUnquoted()
+		}
+	case '\'':
+		value, err = p.parseSingleQuoted(line)
+	case '"':
+		value, err = p.parseDoubleQuoted(line)
+	default:
+		value = p.parseUnquoted()
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	// Only whitespace or a comment may follow a quoted value
+	p.skipBlanks()
+	if p.peek() == '#' {
+		p.skipToLineEnd()
+	}
+	if !p.atLineEnd() {
+		return nil, fmt.Errorf("line %d: unexpected characters after value of %s", p.line, name)
+	}
+	p.consumeNewline()
+
+	return &EnvEntry{Name: name, Value: value, Line: line}, nil
+}
+
+// parseSingleQuoted reads a literal value up to the closing quote
+func (p *envParser) parseSingleQuoted(line int) (string, error) {
+	end := strings.IndexByte(p.src[p.pos+1:], '\'')
+	if end < 0 {
+		return "", fmt.Errorf("line %d: unterminated single-quoted value", line)
+	}
+	value := p.src[p.pos+1 : p.pos+1+end]
+	p.line += strings.Count(value, "\n")
+	p.pos += end + 2
+	return value, nil
+}
+
+// parseDoubleQuoted reads a value up to the closing unescaped quote, resolving escapes
+func (p *envParser) parseDoubleQuoted(line int) (string, error) {
+	var b strings.Builder
+	for i := p.pos + 1; i < len(p.src); i++ {
+		c := p.src[i]
+		switch {
+		case c == '"':
+			p.pos = i + 1
+			return b.String(), nil
+		case c == '\\' && i+1 < len(p.src):
+			i++
+			switch p.src[i] {
+			case 'n':
+				b.WriteByte('\n')
+			case 'r':
+				b.WriteByte('\r')
+			case 't':
+				b.WriteByte('\t')
+			case '\\', '"', '\'', '$':
+				b.WriteByte(p.src[i])
+			default:
+				// Unknown escapes are kept as written
+				b.WriteByte('\\')
+				b.WriteByte(p.src[i])
+			}
+			if p.src[i] == '\n' {
+				p.line++
+			}
+		default:
+			if c == '\n' {
+				p.line++
+			}
+			b.WriteByte(c)
+		}
+	}
+	return "", fmt.Errorf("line %d: unterminated double-quoted value", line)
+}
+
+// parseUnquoted reads the rest of the line, dropping an inline comment and surrounding whitespace
+func (p *envParser) parseUnquoted() string {
+	start := p.pos
+	p.skipToLineEnd()
+	value := p.src[start:p.pos]
+
+	// An inline comment starts at a '#' preceded by whitespace
+	for i := 1; i < len(value); i++ {
+		if value[i] == '#' && (value[i-1] == ' ' || value[i-1] == '\t') {
+			value = value[:i]
+			break
+		}
+	}
+	return strings.TrimRight(value, " \t")
+}
+
+// peek returns the current byte, or 0 at the end of the input
+func (p *envParser) peek() byte {
+	if p.pos >= len(p.src) {
+		return 0
+	}
+	return p.src[p.pos]
+}
+
+// skipBlanks skips spaces and tabs
+func (p *envParser) skipBlanks() {
+	for p.pos < len(p.src) && (p.src[p.pos] == ' ' || p.src[p.pos] == '\t') {
+		p.pos++
+	}
+}
+
+// atLineEnd reports whether the parser is at a newline (LF or CRLF) or the end of the input
+func (p *envParser) atLineEnd() bool {
+	rest := p.src[p.pos:]
+	return rest == "" || rest[0] == '\n' || strings.HasPrefix(rest, "\r\n")
+}
+
+// skipToLineEnd advances to the next newline without consuming it
+func (p *envParser) skipToLineEnd() {
+	for !p.atLineEnd() {
+		p.pos++
+	}
+}
+
+// consumeNewline consumes a newline at the current position, if any
+func (p *envParser) consumeNewline() {
+	if p.peek() == '\r' {
+		p.pos++
+	}
+	if p.peek() == '\n' {
+		p.pos++
+		p.line++
+	}
+}
+
+// isEnvNameStart reports whether c may start a variable name
+func isEnvNameStart(c byte) bool {
+	return c == '_' || (c >= 'A' && c <= 'Z') || (c >= 'a' && c <= 'z')
+}
+
+// isEnvNameChar reports whether c may appear in a variable name
+func isEnvNameChar(c byte) bool {
+	return isEnvNameStart(c) || (c >= '0' && c <= '9') || c == '.' || c == '-'
+}
+
+// IsValidEnvName reports whether name can be used as a variable name in a dotenv file
+func IsValidEnvName(name string) bool {
+	if name == "" || !isEnvNameStart(name[0]) {
+		return false
+	}
+	for i := 1; i < len(name); i++ {
+		if !isEnvNameChar(name[i]) {
+			return false
+		}
+	}
+	return true
+}
+
+// FormatEnvValue renders a value so that ParseEnv reads it back unchanged.
+// Simple values are written as is; others are single- or double-quoted.
+func FormatEnvValue(value string) string {
+	if !strings.ContainsAny(value, " \t\r\n#'\"\\$`") {
+		return value
+	}
+	if !strings.ContainsAny(value, "'\r") {
+		return "'" + value + "'"
+	}
+
+	var b strings.Builder
+	b.WriteByte('"')
+	for i := 0; i < len(value); i++ {
+		switch c := value[i]; c {
+		case '\n':
+			b.WriteString(`\n`)
+		case '\r':
+			b.WriteString(`\r`)
+		case '\\', '"', '$':
+			b.WriteByte('\\')
+			b.WriteByte(c)
+		default:
+			b.WriteByte(c)
+		}
+	}
+	b.WriteByte('"')
+	return b.String()
+}
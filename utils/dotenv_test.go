@@ -0,0 +1,160 @@
+package utils
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestParseEnv(t *testing.T) {
+	content := strings.Join([]string{
+		"# comment",
+		"",
+		"PLAIN=value",
+		"  SPACED  =  spaced value  ",
+		"export EXPORTED=yes",
+		"export=not a prefix",
+		"INLINE=value # comment",
+		"HASH=a#b",
+		"EMPTY=",
+		"EMPTY_COMMENT= # only a comment",
+		"SINGLE='literal $HOME \\n # not a comment'",
+		`DOUBLE="line1\nline2 \"quoted\" \$HOME \\ \x"`,
+		`DOUBLE_COMMENT="value" # comment`,
+		"PEM=\"-----BEGIN KEY-----",
+		"abc=",
+		"-----END KEY-----\"",
+		"MULTI_SINGLE='first",
+		"second'",
+		"CRLF=windows\r",
+		"ENCRYPTED=enc:AES256v4:argon2id:t=3,m=65536,p=4:c2FsdA==:ZGF0YQ==",
+		"DOTTED.NAME-1=ok",
+		"LAST=no newline",
+	}, "\n")
+
+	entries, err := ParseEnv(content)
+	if err != nil {
+		t.Fatalf("ParseEnv failed: %v", err)
+	}
+
+	expected := []EnvEntry{
+		{Name: "PLAIN", Value: "value", Line: 3},
+		{Name: "SPACED", Value: "spaced value", Line: 4},
+		{Name: "EXPORTED", Value: "yes", Line: 5},
+		{Name: "export", Value: "not a prefix", Line: 6},
+		{Name: "INLINE", Value: "value", Line: 7},
+		{Name: "HASH", Value: "a#b", Line: 8},
+		{Name: "EMPTY", Value: "", Line: 9},
+		{Name: "EMPTY_COMMENT", Value: "", Line: 10},
+		{Name: "SINGLE", Value: "literal $HOME \\n # not a comment", Line: 11},
+		{Name: "DOUBLE", Value: "line1\nline2 \"quoted\" $HOME \\ \\x", Line: 12},
+		{Name: "DOUBLE_COMMENT", Value: "value", Line: 13},
+		{Name: "PEM", Value: "-----BEGIN KEY-----\nabc=\n-----END KEY-----", Line: 14},
+		{Name: "MULTI_SINGLE", Value: "first\nsecond", Line: 17},
+		{Name: "CRLF", Value: "windows", Line: 19},
+		{Name: "ENCRYPTED", Value: "enc:AES256v4:argon2id:t=3,m=65536,p=4:c2FsdA==:ZGF0YQ==", Line: 20},
+		{Name: "DOTTED.NAME-1", Value: "ok", Line: 21},
+		{Name: "LAST", Value: "no newline", Line: 22},
+	}
+
+	if len(entries) != len(expected) {
+		t.Fatalf("Expected %d entries, got %d: %+v", len(expected), len(entries), entries)
+	}
+	for i, want := range expected {
+		if entries[i] != want {
+			t.Errorf("Entry %d: expected %+v, got %+v", i, want, entries[i])
+		}
+	}
+}
+
+func TestParseEnv_Errors(t *testing.T) {
+	testCases := []struct {
+		name    string
+		content string
+		line    string
+	}{
+		{name: "Missing equals", content: "A=1\nmalformed line\n", line: "line 2"},
+		{name: "Invalid name", content: "1ABC=value", line: "line 1"},
+		{name: "Unterminated single quote", content: "A='open\nB=2\n", line: "line 1"},
+		{name: "Unterminated double quote", content: "A=1\nB=\"open\\\"", line: "line 2"},
+		{name: "Garbage after quote", content: "A='x' y", line: "line 1"},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			_, err := ParseEnv(tc.content)
+			if err == nil {
+				t.Fatalf("Expected error for %q", tc.content)
+			}
+			if !strings.Contains(err.Error(), tc.line) {
+				t.Errorf("Expected error to mention %q, got %v", tc.line, err)
+			}
+		})
+	}
+}
+
+func TestFormatEnvValue(t *testing.T) {
+	testCases := []struct {
+		value    string
+		expected string
+	}{
+		{value: "simple", expected: "simple"},
+		{value: "", expected: ""},
+		{value: "enc:AES256v4:argon2id:t=3,m=65536,p=4:c2FsdA==:ZGF0YQ==", expected: "enc:AES256v4:argon2id:t=3,m=65536,p=4:c2FsdA==:ZGF0YQ=="},
+		{value: "with space", expected: "'with space'"},
+		{value: "$HOME#x", expected: "'$HOME#x'"},
+		{value: "multi\nline", expected: "'multi\nline'"},
+		{value: "it's", expected: `"it's"`},
+		{value: "it's \"$x\"\n\\", expected: `"it's \"\$x\"\n\\"`},
+	}
+
+	for _, tc := range testCases {
+		formatted := FormatEnvValue(tc.value)
+		if formatted != tc.expected {
+			t.Errorf("FormatEnvValue(%q): expected %s, got %s", tc.value, tc.expected, formatted)
+		}
+	}
+}
+
+// FuzzParseEnv checks that arbitrary input never panics and that statements cover the input
+func FuzzParseEnv(f *testing.F) {
+	f.Add("A=1\n# c\nexport B='x'\nC=\"y\\n\" # z\n")
+	f.Add("PEM=\"-----BEGIN-----\nabc\n-----END-----\"\r\n")
+	f.Add("A='unterminated")
+	f.Add("A= #\n\tB = c d # e")
+
+	f.Fuzz(func(t *testing.T, content string) {
+		statements, err := parseEnvStatements(content)
+		if err != nil {
+			return
+		}
+		pos := 0
+		for _, st := range statements {
+			if st.start != pos || st.end <= st.start {
+				t.Fatalf("Statements don't cover the input: %+v", statements)
+			}
+			pos = st.end
+		}
+		if pos != len(content) {
+			t.Fatalf("Statements end at %d, input has %d bytes", pos, len(content))
+		}
+	})
+}
+
+// FuzzFormatEnvValue checks that every formatted value parses back unchanged
+func FuzzFormatEnvValue(f *testing.F) {
+	f.Add("simple")
+	f.Add("")
+	f.Add("it's \"quoted\" $HOME\n\\ # x")
+	f.Add("\r\n\t '")
+
+	f.Fuzz(func(t *testing.T, value string) {
+		line := "NAME=" + FormatEnvValue(value) + "\n"
+		entries, err := ParseEnv(line)
+		if err != nil {
+			t.Fatalf("ParseEnv(%q) failed: %v", line, err)
+		}
+		if len(entries) != 1 || entries[0].Value != value {
+			t.Fatalf("Round trip of %q through %q gave %+v", value, line, entries)
+		}
+	})
+}
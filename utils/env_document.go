@@ -0,0 +1,268 @@
+package utils
+
+import (
+	"fmt"
+	"os"
+	"strings"
+)
+
+// EnvDocument is an editable .env file that keeps line order, comments and blank lines.
+// Statements that are not modified are written back byte for byte, so a saved document
+// differs from the original only on the changed lines.
+type EnvDocument struct {
+	nodes []envNode
+}
+
+// envNode is one statement of the document with its original text
+type envNode struct {
+	raw   string    // text including the terminating newline, if any
+	entry *EnvEntry // nil for comments and blank lines
+}
+
+// NewEnvDocument returns an empty document
+func NewEnvDocument() *EnvDocument {
+	return &EnvDocument{}
+}
+
+// ParseEnvDocument parses dotenv content into a document
+// content: the file content
+// Returns the document or a syntax error naming the offending line
+func ParseEnvDocument(content string) (*EnvDocument, error) {
+	statements, err := parseEnvStatements(content)
+	if err != nil {
+		return nil, err
+	}
+
+	doc := &EnvDocument{}
+	for _, st := range statements {
+		doc.nodes = append(doc.nodes, envNode{raw: content[st.start:st.end], entry: st.entry})
+	}
+	return doc, nil
+}
+
+// LoadEnvDocument reads and parses a .env file
+// envFilePath: path to the .env file
+// Returns the document, or an error if the file can't be read or has a syntax error
+func LoadEnvDocument(envFilePath string) (*EnvDocument, error) {
+	content, err := os.ReadFile(envFilePath)
+	if err != nil {
+		return nil, err
+	}
+
+	doc, err := ParseEnvDocument(string(content))
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", envFilePath, err)
+	}
+	return doc, nil
+}
+
+// Entries returns the variables in file order, including duplicates, with current line numbers
+func (d *EnvDocument) Entries() []EnvEntry {
+	var entries []EnvEntry
+	line := 1
+	for _, node := range d.nodes {
+		if node.entry != nil {
+			entry := *node.entry
+			entry.Line = line
+			entries = append(entries, entry)
+		}
+		line += strings.Count(node.raw, "\n")
+	}
+	return entries
+}
+
+// Get returns the value of a variable; later definitions override earlier ones
+func (d *EnvDocument) Get(name string) (string, bool) {
+	i := d.lastIndex(name)
+	if i < 0 {
+		return "", false
+	}
+	return d.nodes[i].entry.Value, true
+}
+
+// Set updates a variable in place, or appends it if it doesn't exist yet.
+// Earlier duplicate definitions of the variable are removed, so exactly one remains.
+func (d *EnvDocument) Set(name, value string) error {
+	if !IsValidEnvName(name) {
+		return fmt.Errorf("invalid variable name %q", name)
+	}
+
+	i := d.lastIndex(name)
+	if i < 0 {
+		d.insertBeforeTrailer(envNode{raw: renderEnvLine("", name, value, "\n"), entry: &EnvEntry{Name: name, Value: value}})
+		return nil
+	}
+
+	d.setAt(i, name, value)
+	d.removeDuplicates(name, i)
+	return nil
+}
+
+// Delete removes every definition of a variable
+// Returns false if the variable doesn't exist
+func (d *EnvDocument) Delete(name string) bool {
+	found := false
+	nodes := d.nodes[:0]
+	for _, node := range d.nodes {
+		if node.entry != nil && node.entry.Name == name {
+			found = true
+			continue
+		}
+		nodes = append(nodes, node)
+	}
+	d.nodes = nodes
+	return found
+}
+
+// Rename changes the name of a variable, keeping its value and position
+// Returns an error if the old name doesn't exist or the new name is invalid or already taken
+func (d *EnvDocument) Rename(oldName, newName string) error {
+	if !IsValidEnvName(newName) {
+		return fmt.Errorf("invalid variable name %q", newName)
+	}
+	i := d.lastIndex(oldName)
+	if i < 0 {
+		return fmt.Errorf("variable %s does not exist", oldName)
+	}
+	if oldName != newName && d.lastIndex(newName) >= 0 {
+		return fmt.Errorf("variable %s already exists", newName)
+	}
+
+	d.setAt(i, newName, d.nodes[i].entry.Value)
+	d.removeDuplicates(oldName, i)
+	return nil
+}
+
+// Update calls fn for every variable in file order and stores the returned value in place
+// Returns the number of changed variables, or the first error returned by fn
+func (d *EnvDocument) Update(fn func(name, value string) (string, error)) (int, error) {
+	changed := 0
+	for i, node := range d.nodes {
+		if node.entry == nil {
+			continue
+		}
+		newValue, err := fn(node.entry.Name, node.entry.Value)
+		if err != nil {
+			return changed, fmt.Errorf("%s: %w", node.entry.Name, err)
+		}
+		if newValue != node.entry.Value {
+			d.setAt(i, node.entry.Name, newValue)
+			changed++
+		}
+	}
+	return changed, nil
+}
+
+// MAC returns the payload of the integrity trailer, or "" if the document has none
+func (d *EnvDocument) MAC() string {
+	mac := ""
+	for _, node := range d.nodes {
+		if isTrailer(node) {
+			mac = strings.TrimSpace(strings.TrimPrefix(node.raw, MACTrailerPrefix))
+		}
+	}
+	return mac
+}
+
+// SetMAC replaces the integrity trailer with a new one at the end of the document
+// mac: the trailer payload; an empty string removes the trailer
+func (d *EnvDocument) SetMAC(mac string) {
+	nodes := d.nodes[:0]
+	for _, node := range d.nodes {
+		if !isTrailer(node) {
+			nodes = append(nodes, node)
+		}
+	}
+	d.nodes = nodes
+
+	if mac != "" {
+		d.terminateLastLine()
+		d.nodes = append(d.nodes, envNode{raw: fmt.Sprintf("%s %s\n", MACTrailerPrefix, mac)})
+	}
+}
+
+// String renders the document
+func (d *EnvDocument) String() string {
+	var b strings.Builder
+	for _, node := range d.nodes {
+		b.WriteString(node.raw)
+	}
+	return b.String()
+}
+
+// Save writes the document atomically with permissions 0600
+// envFilePath: path to the .env file
+func (d *EnvDocument) Save(envFilePath string) error {
+	return WriteFileAtomic(envFilePath, []byte(d.String()), 0600)
+}
+
+// lastIndex returns the node index of the last definition of a variable, or -1
+func (d *EnvDocument) lastIndex(name string) int {
+	for i := len(d.nodes) - 1; i >= 0; i-- {
+		if d.nodes[i].entry != nil && d.nodes[i].entry.Name == name {
+			return i
+		}
+	}
+	return -1
+}
+
+// setAt re-renders the node at index i, keeping its indentation, export prefix and line ending
+func (d *EnvDocument) setAt(i int, name, value string) {
+	raw := d.nodes[i].raw
+
+	newline := ""
+	if strings.HasSuffix(raw, "\r\n") {
+		newline = "\r\n"
+	} else if strings.HasSuffix(raw, "\n") {
+		newline = "\n"
+	}
+
+	trimmed := strings.TrimLeft(raw, " \t")
+	prefix := raw[:len(raw)-len(trimmed)]
+	if rest := strings.TrimPrefix(trimmed, "export"); len(rest) < len(trimmed) && rest != "" && (rest[0] == ' ' || rest[0] == '\t') {
+		prefix += "export "
+	}
+
+	d.nodes[i] = envNode{raw: renderEnvLine(prefix, name, value, newline), entry: &EnvEntry{Name: name, Value: value}}
+}
+
+// removeDuplicates removes all definitions of name except the one at index keep
+func (d *EnvDocument) removeDuplicates(name string, keep int) {
+	nodes := d.nodes[:0]
+	for i, node := range d.nodes {
+		if i != keep && node.entry != nil && node.entry.Name == name {
+			continue
+		}
+		nodes = append(nodes, node)
+	}
+	d.nodes = nodes
+}
+
+// insertBeforeTrailer appends a node, keeping an integrity trailer as the last line
+func (d *EnvDocument) insertBeforeTrailer(node envNode) {
+	i := len(d.nodes)
+	for i > 0 && isTrailer(d.nodes[i-1]) {
+		i--
+	}
+	if i == len(d.nodes) {
+		d.terminateLastLine()
+	}
+	d.nodes = append(d.nodes[:i], append([]envNode{node}, d.nodes[i:]...)...)
+}
+
+// terminateLastLine adds a newline to the last node if the file didn't end with one
+func (d *EnvDocument) terminateLastLine() {
+	if n := len(d.nodes); n > 0 && !strings.HasSuffix(d.nodes[n-1].raw, "\n") {
+		d.nodes[n-1].raw += "\n"
+	}
+}
+
+// isTrailer reports whether a node is the integrity trailer comment
+func isTrailer(node envNode) bool {
+	return node.entry == nil && strings.HasPrefix(node.raw, MACTrailerPrefix)
+}
+
+// renderEnvLine formats an assignment statement
+func renderEnvLine(prefix, name, value, newline string) string {
+	return prefix + name + "=" + FormatEnvValue(value) + newline
+}
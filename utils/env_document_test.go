@@ -0,0 +1,216 @@
+package utils
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestEnvDocument_SetUpdatesInPlace(t *testing.T) {
+	content := "# header\n\nexport FIRST=one # note\r\n  SECOND='two'\nTHIRD=three\n"
+	doc, err := ParseEnvDocument(content)
+	if err != nil {
+		t.Fatalf("ParseEnvDocument failed: %v", err)
+	}
+
+	// Unchanged documents are written back byte for byte
+	if doc.String() != content {
+		t.Fatalf("Expected round trip %q, got %q", content, doc.String())
+	}
+
+	if err := doc.Set("FIRST", "uno"); err != nil {
+		t.Fatalf("Set failed: %v", err)
+	}
+	if err := doc.Set("SECOND", "dos dos"); err != nil {
+		t.Fatalf("Set failed: %v", err)
+	}
+	if err := doc.Set("FOURTH", "four"); err != nil {
+		t.Fatalf("Set failed: %v", err)
+	}
+
+	expected := "# header\n\nexport FIRST=uno\r\n  SECOND='dos dos'\nTHIRD=three\nFOURTH=four\n"
+	if doc.String() != expected {
+		t.Errorf("Expected %q, got %q", expected, doc.String())
+	}
+}
+
+func TestEnvDocument_SetRemovesDuplicates(t *testing.T) {
+	doc, err := ParseEnvDocument("A=1\nB=2\nA=3\n")
+	if err != nil {
+		t.Fatalf("ParseEnvDocument failed: %v", err)
+	}
+	if value, ok := doc.Get("A"); !ok || value != "3" {
+		t.Errorf("Expected last definition to win, got %q", value)
+	}
+
+	if err := doc.Set("A", "4"); err != nil {
+		t.Fatalf("Set failed: %v", err)
+	}
+	if doc.String() != "B=2\nA=4\n" {
+		t.Errorf("Unexpected content: %q", doc.String())
+	}
+
+	if err := doc.Set("1BAD", "x"); err == nil {
+		t.Errorf("Expected error for invalid name")
+	}
+}
+
+func TestEnvDocument_SetWithoutTrailingNewline(t *testing.T) {
+	doc, err := ParseEnvDocument("A=1")
+	if err != nil {
+		t.Fatalf("ParseEnvDocument failed: %v", err)
+	}
+	if err := doc.Set("B", "2"); err != nil {
+		t.Fatalf("Set failed: %v", err)
+	}
+	if doc.String() != "A=1\nB=2\n" {
+		t.Errorf("Unexpected content: %q", doc.String())
+	}
+}
+
+func TestEnvDocument_DeleteAndRename(t *testing.T) {
+	doc, err := ParseEnvDocument("# keep\nA=1\nB=2\nA=3\nC=4\n")
+	if err != nil {
+		t.Fatalf("ParseEnvDocument failed: %v", err)
+	}
+
+	if !doc.Delete("A") {
+		t.Errorf("Expected Delete to report an existing variable")
+	}
+	if doc.Delete("MISSING") {
+		t.Errorf("Expected Delete to report a missing variable")
+	}
+	if err := doc.Rename("B", "RENAMED"); err != nil {
+		t.Fatalf("Rename failed: %v", err)
+	}
+	if doc.String() != "# keep\nRENAMED=2\nC=4\n" {
+		t.Errorf("Unexpected content: %q", doc.String())
+	}
+
+	if err := doc.Rename("MISSING", "X"); err == nil {
+		t.Errorf("Expected error when renaming a missing variable")
+	}
+	if err := doc.Rename("C", "RENAMED"); err == nil {
+		t.Errorf("Expected error when the new name is taken")
+	}
+	if err := doc.Rename("C", "bad name"); err == nil {
+		t.Errorf("Expected error for invalid name")
+	}
+}
+
+func TestEnvDocument_Update(t *testing.T) {
+	content := "# comment\nFIRST=one\n\nSECOND = two\r\nTHIRD=three"
+	doc, err := ParseEnvDocument(content)
+	if err != nil {
+		t.Fatalf("ParseEnvDocument failed: %v", err)
+	}
+
+	count, err := doc.Update(func(name, value string) (string, error) {
+		if name == "FIRST" {
+			return value, nil
+		}
+		return value + "-new", nil
+	})
+	if err != nil {
+		t.Fatalf("Update failed: %v", err)
+	}
+	if count != 2 {
+		t.Errorf("Expected 2 changed values, got %d", count)
+	}
+
+	expected := "# comment\nFIRST=one\n\nSECOND=two-new\r\nTHIRD=three-new"
+	if doc.String() != expected {
+		t.Errorf("Expected %q, got %q", expected, doc.String())
+	}
+}
+
+func TestEnvDocument_MAC(t *testing.T) {
+	doc, err := ParseEnvDocument("# comment\nA=1\n" + MACTrailerPrefix + " old\nB=2")
+	if err != nil {
+		t.Fatalf("ParseEnvDocument failed: %v", err)
+	}
+	if mac := doc.MAC(); mac != "old" {
+		t.Fatalf("Expected mac %q, got %q", "old", mac)
+	}
+
+	doc.SetMAC("new")
+	if doc.String() != "# comment\nA=1\nB=2\n"+MACTrailerPrefix+" new\n" {
+		t.Errorf("Unexpected content after SetMAC: %q", doc.String())
+	}
+
+	// The trailer is a comment, so it is not reported as an entry
+	entries := doc.Entries()
+	if len(entries) != 2 || entries[0].Name != "A" || entries[1].Name != "B" || entries[1].Line != 3 {
+		t.Errorf("Unexpected entries: %+v", entries)
+	}
+
+	// New variables go before the trailer
+	if err := doc.Set("C", "3"); err != nil {
+		t.Fatalf("Set failed: %v", err)
+	}
+	if !strings.HasSuffix(doc.String(), "C=3\n"+MACTrailerPrefix+" new\n") {
+		t.Errorf("Expected trailer to stay last, got %q", doc.String())
+	}
+
+	doc.SetMAC("")
+	if strings.Contains(doc.String(), MACTrailerPrefix) {
+		t.Errorf("Expected trailer to be removed, got %q", doc.String())
+	}
+}
+
+func TestEnvDocument_Save(t *testing.T) {
+	// Create a temporary directory for testing
+	tempDir, err := os.MkdirTemp("", "env_test")
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	envFilePath := filepath.Join(tempDir, ".env")
+	content := "# comment\nA=1\n"
+	if err := os.WriteFile(envFilePath, []byte(content), 0644); err != nil {
+		t.Fatalf("Failed to write .env file: %v", err)
+	}
+
+	doc, err := LoadEnvDocument(envFilePath)
+	if err != nil {
+		t.Fatalf("LoadEnvDocument failed: %v", err)
+	}
+	if err := doc.Set("A", "2"); err != nil {
+		t.Fatalf("Set failed: %v", err)
+	}
+	if err := BackupFile(envFilePath); err != nil {
+		t.Fatalf("BackupFile failed: %v", err)
+	}
+	if err := doc.Save(envFilePath); err != nil {
+		t.Fatalf("Save failed: %v", err)
+	}
+
+	after, _ := os.ReadFile(envFilePath)
+	if string(after) != "# comment\nA=2\n" {
+		t.Errorf("Unexpected content: %q", after)
+	}
+	backup, err := os.ReadFile(envFilePath + ".bak")
+	if err != nil || string(backup) != content {
+		t.Errorf("Expected backup with original content, got %q (%v)", backup, err)
+	}
+
+	info, err := os.Stat(envFilePath)
+	if err != nil {
+		t.Fatalf("Failed to stat .env file: %v", err)
+	}
+	if info.Mode().Perm() != 0600 {
+		t.Errorf("Expected file permissions 0600, got %o", info.Mode().Perm())
+	}
+
+	// No temporary files are left behind
+	files, _ := os.ReadDir(tempDir)
+	if len(files) != 2 {
+		t.Errorf("Expected only the file and its backup, got %d entries", len(files))
+	}
+
+	if _, err := LoadEnvDocument(filepath.Join(tempDir, "missing")); !os.IsNotExist(err) {
+		t.Errorf("Expected not-exist error, got %v", err)
+	}
+}
@@ -1,91 +1,118 @@
 package utils
 
 import (
-	"bufio"
 	"fmt"
 	"os"
-	"strings"
+	"path/filepath"
 )
 
 // SaveToEnvFile saves a key-value pair to the .env file
 // name: environment variable name
 // value: environment variable value
 // envFilePath: path to the .env file
+// An existing variable is updated in place; a new one is appended.
+// Comments, blank lines and other variables are kept as they are.
 // Returns an error if the operation fails
 func SaveToEnvFile(name, value, envFilePath string) error {
-	// Check if .env file exists
-	var file *os.File
-	var err error
-
-	if _, err := os.Stat(envFilePath); os.IsNotExist(err) {
-		// File doesn't exist, create a new one
-		file, err = os.Create(envFilePath)
-		if err != nil {
-			return err
-		}
-	} else {
-		// File exists, open in append mode
-		file, err = os.OpenFile(envFilePath, os.O_APPEND|os.O_WRONLY, 0600)
-		if err != nil {
-			return err
-		}
+	doc, err := LoadEnvDocument(envFilePath)
+	if os.IsNotExist(err) {
+		// File doesn't exist, start a new one
+		doc, err = NewEnvDocument(), nil
 	}
-	defer file.Close()
-
-	// Set file permissions to 600 (readable and writable only by the owner)
-	err = os.Chmod(envFilePath, 0600)
 	if err != nil {
 		return err
 	}
 
-	// Write the environment variable
-	_, err = fmt.Fprintf(file, "%s=%s\n", name, value)
-	return err
+	if err := doc.Set(name, value); err != nil {
+		return err
+	}
+
+	// Written with permissions 600 (readable and writable only by the owner)
+	return doc.Save(envFilePath)
+}
+
+// MACTrailerPrefix starts the comment line holding the whole-file integrity MAC
+const MACTrailerPrefix = "# lhkm-mac:"
+
+// EnvEntry is a variable read from a .env file
+type EnvEntry struct {
+	Name  string
+	Value string
+	Line  int // 1-based line number in the file
 }
 
 // ReadEnvFile reads and parses the .env file
 // envFilePath: path to the .env file
 // Returns a map of environment variable names to values and an error if the operation fails
 func ReadEnvFile(envFilePath string) (map[string]string, error) {
-	// Check if .env file exists
-	if _, err := os.Stat(envFilePath); os.IsNotExist(err) {
-		return nil, fmt.Errorf(".env file does not exist")
-	}
-
-	// Open the .env file
-	file, err := os.Open(envFilePath)
+	entries, err := ReadEnvEntries(envFilePath)
 	if err != nil {
 		return nil, err
 	}
-	defer file.Close()
 
-	// Read and parse the file
+	// Later definitions override earlier ones
 	envVars := make(map[string]string)
-	scanner := bufio.NewScanner(file)
+	for _, entry := range entries {
+		envVars[entry.Name] = entry.Value
+	}
 
-	for scanner.Scan() {
-		line := scanner.Text()
+	return envVars, nil
+}
 
-		// Skip empty lines and comments
-		if line == "" || strings.HasPrefix(line, "#") {
-			continue
-		}
+// ReadEnvEntries reads the variables of the .env file in file order, including duplicates
+// envFilePath: path to the .env file
+// Returns the entries and an error if the operation fails
+func ReadEnvEntries(envFilePath string) ([]EnvEntry, error) {
+	// Check if .env file exists
+	if _, err := os.Stat(envFilePath); os.IsNotExist(err) {
+		return nil, fmt.Errorf(".env file does not exist")
+	}
 
-		// Parse the environment variable
-		parts := strings.SplitN(line, "=", 2)
-		if len(parts) != 2 {
-			continue // Skip malformed lines
-		}
+	content, err := os.ReadFile(envFilePath)
+	if err != nil {
+		return nil, err
+	}
 
-		name := strings.TrimSpace(parts[0])
-		value := strings.TrimSpace(parts[1])
+	entries, err := ParseEnv(string(content))
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", envFilePath, err)
+	}
+	return entries, nil
+}
 
-		envVars[name] = value
+// BackupFile copies a file to path + ".bak" with permissions 0600
+func BackupFile(path string) error {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return err
 	}
+	return WriteFileAtomic(path+".bak", content, 0600)
+}
 
-	if err := scanner.Err(); err != nil {
-		return nil, err
+// WriteFileAtomic writes data to a temporary file in the same directory and renames it over path,
+// so readers see either the old or the new content, never a partially written file
+func WriteFileAtomic(path string, data []byte, perm os.FileMode) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".tmp-*")
+	if err != nil {
+		return err
 	}
+	tmpPath := tmp.Name()
+	defer os.Remove(tmpPath) // No-op once the rename succeeded
 
-	return envVars, nil
+	if err := tmp.Chmod(perm); err != nil {
+		tmp.Close()
+		return err
+	}
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmpPath, path)
 }
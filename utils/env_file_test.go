@@ -81,3 +81,29 @@ func TestReadEnvFile_NonExistent(t *testing.T) {
 		t.Errorf("Expected error when reading non-existent .env file")
 	}
 }
+
+func TestSaveToEnvFile_Upsert(t *testing.T) {
+	// Create a temporary directory for testing
+	tempDir, err := os.MkdirTemp("", "env_test")
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	envFilePath := filepath.Join(tempDir, ".env")
+	if err := os.WriteFile(envFilePath, []byte("# keys\nAPI_KEY=old\nOTHER=x\n"), 0600); err != nil {
+		t.Fatalf("Failed to write .env file: %v", err)
+	}
+
+	// Storing the same variable twice must not add a second line
+	for _, value := range []string{"first", "second"} {
+		if err := SaveToEnvFile("API_KEY", value, envFilePath); err != nil {
+			t.Fatalf("SaveToEnvFile failed: %v", err)
+		}
+	}
+
+	content, _ := os.ReadFile(envFilePath)
+	if string(content) != "# keys\nAPI_KEY=second\nOTHER=x\n" {
+		t.Errorf("Unexpected content: %q", content)
+	}
+}
@@ -0,0 +1,217 @@
+package utils
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+	"unicode/utf8"
+)
+
+// ExportFormatter renders variables for one target, such as a shell or a config file format
+// vars: the variables in the order they should appear
+// Returns the complete output, or an error if a variable can't be represented in the format
+type ExportFormatter func(vars []EnvEntry) (string, error)
+
+// exportFormatters holds the registered formatters by name
+var exportFormatters = map[string]ExportFormatter{}
+
+// RegisterExportFormatter makes a formatter available under a name
+// It panics if the name is already taken, as registration happens at init time.
+func RegisterExportFormatter(name string, formatter ExportFormatter) {
+	if _, exists := exportFormatters[name]; exists {
+		panic("export formatter registered twice: " + name)
+	}
+	exportFormatters[name] = formatter
+}
+
+// LookupExportFormatter returns the formatter registered under a name
+func LookupExportFormatter(name string) (ExportFormatter, bool) {
+	formatter, ok := exportFormatters[name]
+	return formatter, ok
+}
+
+// ExportFormatNames returns the names of all registered formatters, sorted
+func ExportFormatNames() []string {
+	names := make([]string, 0, len(exportFormatters))
+	for name := range exportFormatters {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func init() {
+	RegisterExportFormatter("sh", formatLines(func(name, value string) (string, error) {
+		statement, err := ExportPOSIX(name, value)
+		return statement + ";", err
+	}))
+	RegisterExportFormatter("fish", formatLines(func(name, value string) (string, error) {
+		statement, err := ExportFish(name, value)
+		return statement + ";", err
+	}))
+	RegisterExportFormatter("powershell", formatLines(powershellLine))
+	RegisterExportFormatter("dotenv", formatLines(dotenvLine))
+	RegisterExportFormatter("docker", formatLines(dockerLine))
+	RegisterExportFormatter("systemd", formatLines(systemdLine))
+	RegisterExportFormatter("json", formatJSON)
+	RegisterExportFormatter("yaml", formatYAML)
+}
+
+// formatLines builds a formatter that writes one line per variable
+func formatLines(line func(name, value string) (string, error)) ExportFormatter {
+	return func(vars []EnvEntry) (string, error) {
+		var b strings.Builder
+		for _, v := range vars {
+			l, err := line(v.Name, v.Value)
+			if err != nil {
+				return "", err
+			}
+			b.WriteString(l)
+			b.WriteByte('\n')
+		}
+		return b.String(), nil
+	}
+}
+
+// checkNUL rejects values that no target can represent
+func checkNUL(name, value string) error {
+	if strings.IndexByte(value, 0) >= 0 {
+		return fmt.Errorf("%s: %w", name, ErrNULInValue)
+	}
+	return nil
+}
+
+// powershellLine renders $env:NAME = 'value'. PowerShell single quotes only need the quote
+// doubled, but it also accepts the typographic single quotes as delimiters.
+func powershellLine(name, value string) (string, error) {
+	if !IsValidEnvName(name) {
+		return "", fmt.Errorf("invalid variable name %q", name)
+	}
+	if err := checkNUL(name, value); err != nil {
+		return "", err
+	}
+
+	var b strings.Builder
+	for _, r := range value {
+		switch r {
+		case '\'', '‘', '’', '‚', '‛':
+			b.WriteRune(r)
+		}
+		b.WriteRune(r)
+	}
+
+	target := "$env:" + name
+	if !IsValidShellName(name) {
+		target = "${env:" + name + "}"
+	}
+	return target + " = '" + b.String() + "'", nil
+}
+
+// dotenvLine renders NAME=value using the same quoting rules as the files this tool writes
+func dotenvLine(name, value string) (string, error) {
+	if !IsValidEnvName(name) {
+		return "", fmt.Errorf("invalid variable name %q", name)
+	}
+	if err := checkNUL(name, value); err != nil {
+		return "", err
+	}
+	return name + "=" + FormatEnvValue(value), nil
+}
+
+// dockerLine renders NAME=value for docker --env-file, which takes the rest of the line
+// literally and has no quoting, so values can't contain line breaks
+func dockerLine(name, value string) (string, error) {
+	if !IsValidEnvName(name) {
+		return "", fmt.Errorf("invalid variable name %q", name)
+	}
+	if err := checkNUL(name, value); err != nil {
+		return "", err
+	}
+	if strings.ContainsAny(value, "\r\n") {
+		return "", fmt.Errorf("%s: docker env files can't hold values with line breaks", name)
+	}
+	return name + "=" + value, nil
+}
+
+// systemdLine renders NAME="value" for systemd EnvironmentFile=. Inside double quotes
+// systemd treats \ " ` $ as escapable and keeps newlines.
+func systemdLine(name, value string) (string, error) {
+	if !IsValidEnvName(name) {
+		return "", fmt.Errorf("invalid variable name %q", name)
+	}
+	if err := checkNUL(name, value); err != nil {
+		return "", err
+	}
+
+	var b strings.Builder
+	for i := 0; i < len(value); i++ {
+		switch c := value[i]; c {
+		case '\\', '"', '`', '$':
+			b.WriteByte('\\')
+			b.WriteByte(c)
+		default:
+			b.WriteByte(c)
+		}
+	}
+	return name + "=\"" + b.String() + "\"", nil
+}
+
+// jsonString encodes s as a JSON string without HTML escaping
+func jsonString(s string) string {
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	enc.SetEscapeHTML(false)
+	enc.Encode(s) // Strings always encode
+	return strings.TrimSuffix(buf.String(), "\n")
+}
+
+// checkUTF8 rejects values that JSON and YAML would silently alter
+func checkUTF8(vars []EnvEntry) error {
+	for _, v := range vars {
+		if !utf8.ValidString(v.Value) {
+			return fmt.Errorf("%s: value is not valid UTF-8", v.Name)
+		}
+	}
+	return nil
+}
+
+// formatJSON renders a JSON object, keeping the variable order
+func formatJSON(vars []EnvEntry) (string, error) {
+	if err := checkUTF8(vars); err != nil {
+		return "", err
+	}
+	if len(vars) == 0 {
+		return "{}\n", nil
+	}
+
+	var b strings.Builder
+	b.WriteString("{\n")
+	for i, v := range vars {
+		b.WriteString("  " + jsonString(v.Name) + ": " + jsonString(v.Value))
+		if i < len(vars)-1 {
+			b.WriteByte(',')
+		}
+		b.WriteByte('\n')
+	}
+	b.WriteString("}\n")
+	return b.String(), nil
+}
+
+// formatYAML renders a YAML mapping. JSON strings are valid YAML double-quoted scalars,
+// so every key and value is quoted and nothing is interpreted as a number, bool or null.
+func formatYAML(vars []EnvEntry) (string, error) {
+	if err := checkUTF8(vars); err != nil {
+		return "", err
+	}
+	if len(vars) == 0 {
+		return "{}\n", nil
+	}
+
+	var b strings.Builder
+	for _, v := range vars {
+		b.WriteString(jsonString(v.Name) + ": " + jsonString(v.Value) + "\n")
+	}
+	return b.String(), nil
+}
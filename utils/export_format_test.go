@@ -0,0 +1,130 @@
+package utils
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+func TestExportFormatNames(t *testing.T) {
+	expected := "docker,dotenv,fish,json,powershell,sh,systemd,yaml"
+	if names := strings.Join(ExportFormatNames(), ","); names != expected {
+		t.Errorf("Expected %s, got %s", expected, names)
+	}
+	if _, ok := LookupExportFormatter("csv"); ok {
+		t.Errorf("Expected unknown format not to be found")
+	}
+}
+
+func TestRegisterExportFormatter_Duplicate(t *testing.T) {
+	defer func() {
+		if recover() == nil {
+			t.Errorf("Expected panic for duplicate registration")
+		}
+	}()
+	RegisterExportFormatter("sh", formatJSON)
+}
+
+func TestExportFormatters(t *testing.T) {
+	vars := []EnvEntry{
+		{Name: "B", Value: "it's $HOME"},
+		{Name: "A", Value: `say "hi" \ ` + "`id`"},
+	}
+
+	testCases := []struct {
+		format   string
+		expected string
+	}{
+		{format: "sh", expected: "export B='it'\\''s $HOME';\nexport A='say \"hi\" \\ `id`';\n"},
+		{format: "fish", expected: "set -gx B 'it\\'s $HOME';\nset -gx A 'say \"hi\" \\\\ `id`';\n"},
+		{format: "powershell", expected: "$env:B = 'it''s $HOME'\n$env:A = 'say \"hi\" \\ `id`'\n"},
+		{format: "dotenv"},
+		{format: "docker", expected: "B=it's $HOME\nA=say \"hi\" \\ `id`\n"},
+		{format: "systemd", expected: "B=\"it's \\$HOME\"\nA=\"say \\\"hi\\\" \\\\ \\`id\\`\"\n"},
+		{format: "json", expected: "{\n  \"B\": \"it's $HOME\",\n  \"A\": \"say \\\"hi\\\" \\\\ `id`\"\n}\n"},
+		{format: "yaml", expected: "\"B\": \"it's $HOME\"\n\"A\": \"say \\\"hi\\\" \\\\ `id`\"\n"},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.format, func(t *testing.T) {
+			formatter, ok := LookupExportFormatter(tc.format)
+			if !ok {
+				t.Fatalf("Formatter %s not registered", tc.format)
+			}
+			out, err := formatter(vars)
+			if err != nil {
+				t.Fatalf("Format failed: %v", err)
+			}
+			if tc.format == "dotenv" {
+				// The dotenv output must read back unchanged; the exact quoting is FormatEnvValue's
+				parsed, err := ParseEnv(out)
+				if err != nil {
+					t.Fatalf("ParseEnv failed: %v", err)
+				}
+				if len(parsed) != 2 || parsed[0].Value != vars[0].Value || parsed[1].Value != vars[1].Value {
+					t.Errorf("Unexpected round trip: %+v", parsed)
+				}
+				return
+			}
+			if out != tc.expected {
+				t.Errorf("Expected %q, got %q", tc.expected, out)
+			}
+		})
+	}
+}
+
+func TestExportFormatters_JSONRoundTrip(t *testing.T) {
+	formatter, _ := LookupExportFormatter("json")
+	vars := []EnvEntry{{Name: "PEM", Value: "-----BEGIN-----\nabc\n-----END-----\n"}, {Name: "HTML", Value: "<a&b>"}}
+	out, err := formatter(vars)
+	if err != nil {
+		t.Fatalf("Format failed: %v", err)
+	}
+
+	var decoded map[string]string
+	if err := json.Unmarshal([]byte(out), &decoded); err != nil {
+		t.Fatalf("Output is not valid JSON: %v\n%s", err, out)
+	}
+	for _, v := range vars {
+		if decoded[v.Name] != v.Value {
+			t.Errorf("%s: expected %q, got %q", v.Name, v.Value, decoded[v.Name])
+		}
+	}
+
+	if out, _ := formatter(nil); out != "{}\n" {
+		t.Errorf("Expected empty object, got %q", out)
+	}
+}
+
+func TestExportFormatters_Rejects(t *testing.T) {
+	testCases := []struct {
+		format string
+		vars   []EnvEntry
+	}{
+		{format: "sh", vars: []EnvEntry{{Name: "A-B", Value: "x"}}},
+		{format: "fish", vars: []EnvEntry{{Name: "A", Value: "a\x00b"}}},
+		{format: "powershell", vars: []EnvEntry{{Name: "A", Value: "a\x00b"}}},
+		{format: "dotenv", vars: []EnvEntry{{Name: "1A", Value: "x"}}},
+		{format: "docker", vars: []EnvEntry{{Name: "A", Value: "line1\nline2"}}},
+		{format: "systemd", vars: []EnvEntry{{Name: "A", Value: "a\x00b"}}},
+		{format: "json", vars: []EnvEntry{{Name: "A", Value: "\xff"}}},
+		{format: "yaml", vars: []EnvEntry{{Name: "A", Value: "\xff"}}},
+	}
+
+	for _, tc := range testCases {
+		formatter, _ := LookupExportFormatter(tc.format)
+		if _, err := formatter(tc.vars); err == nil {
+			t.Errorf("%s: expected error for %+v", tc.format, tc.vars)
+		}
+	}
+}
+
+func TestPowershellLine_Quotes(t *testing.T) {
+	line, err := powershellLine("A.B", "‘x’")
+	if err != nil {
+		t.Fatalf("powershellLine failed: %v", err)
+	}
+	if line != "${env:A.B} = '‘‘x’’'" {
+		t.Errorf("Unexpected line: %q", line)
+	}
+}
@@ -0,0 +1,6 @@
+package utils
+
+import "errors"
+
+// ErrLockUnsupported is returned by LockFile on platforms without file locking
+var ErrLockUnsupported = errors.New("file locking is not supported on this platform")
@@ -0,0 +1,8 @@
+//go:build !unix && !windows
+
+package utils
+
+// LockFile is not supported on this platform
+func LockFile(path string) (func(), error) {
+	return nil, ErrLockUnsupported
+}
@@ -0,0 +1,44 @@
+//go:build unix || windows
+
+package utils
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestLockFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "test.lock")
+
+	unlock, err := LockFile(path)
+	if err != nil {
+		t.Fatalf("LockFile failed: %v", err)
+	}
+
+	// A second lock waits until the first one is released
+	acquired := make(chan struct{})
+	go func() {
+		unlock2, err := LockFile(path)
+		if err != nil {
+			t.Errorf("Second LockFile failed: %v", err)
+			close(acquired)
+			return
+		}
+		close(acquired)
+		unlock2()
+	}()
+
+	select {
+	case <-acquired:
+		t.Fatalf("Second lock acquired while the first was held")
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	unlock()
+	select {
+	case <-acquired:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Second lock not acquired after release")
+	}
+}
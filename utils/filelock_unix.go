@@ -0,0 +1,28 @@
+//go:build unix
+
+package utils
+
+import (
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+// LockFile takes an exclusive lock on a lock file, creating it with permissions 0600 if needed.
+// It blocks until the lock is available. The lock is advisory: it only excludes other callers of LockFile.
+// path: the lock file; it should not be the file being protected if that file is replaced by a rename
+// Returns a function that releases the lock
+func LockFile(path string) (func(), error) {
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, err
+	}
+	if err := unix.Flock(int(f.Fd()), unix.LOCK_EX); err != nil {
+		f.Close()
+		return nil, err
+	}
+	return func() {
+		unix.Flock(int(f.Fd()), unix.LOCK_UN)
+		f.Close()
+	}, nil
+}
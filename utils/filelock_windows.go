@@ -0,0 +1,29 @@
+//go:build windows
+
+package utils
+
+import (
+	"os"
+
+	"golang.org/x/sys/windows"
+)
+
+// LockFile takes an exclusive lock on a lock file, creating it if needed.
+// It blocks until the lock is available.
+// path: the lock file; it should not be the file being protected if that file is replaced by a rename
+// Returns a function that releases the lock
+func LockFile(path string) (func(), error) {
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, err
+	}
+	handle := windows.Handle(f.Fd())
+	if err := windows.LockFileEx(handle, windows.LOCKFILE_EXCLUSIVE_LOCK, 0, 1, 0, &windows.Overlapped{}); err != nil {
+		f.Close()
+		return nil, err
+	}
+	return func() {
+		windows.UnlockFileEx(handle, 0, 1, 0, &windows.Overlapped{})
+		f.Close()
+	}, nil
+}
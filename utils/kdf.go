@@ -0,0 +1,295 @@
+package utils
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/argon2"
+)
+
+// KDFAlgorithm is the name of the key derivation function stored with each value
+const KDFAlgorithm = "argon2id"
+
+// Bounds of any cost setting. Settings read from stored data are held to the lower
+// limit set with SetStoredKDFLimit.
+const (
+	kdfSaltSize   = 16
+	maxKDFTime    = 64
+	maxKDFMemory  = 4 * 1024 * 1024 // 4 GiB in KiB
+	maxKDFThreads = 64
+)
+
+// storedKDFFactor is how far the time and memory cost of stored data may exceed the configured settings
+const storedKDFFactor = 4
+
+// KDFParams holds the Argon2id cost settings
+type KDFParams struct {
+	Time    uint32 // number of passes over the memory
+	Memory  uint32 // memory size in KiB
+	Threads uint8  // degree of parallelism
+}
+
+// DefaultKDFParams are the cost settings used when nothing else is configured
+var DefaultKDFParams = KDFParams{Time: 3, Memory: 64 * 1024, Threads: 4}
+
+// String formats the parameters as stored in an encrypted value, e.g. "t=3,m=65536,p=4"
+func (p KDFParams) String() string {
+	return fmt.Sprintf("t=%d,m=%d,p=%d", p.Time, p.Memory, p.Threads)
+}
+
+// Validate checks that the parameters are within sane bounds
+func (p KDFParams) Validate() error {
+	if p.Time < 1 || p.Time > maxKDFTime {
+		return fmt.Errorf("kdf time cost %d out of range [1, %d]", p.Time, maxKDFTime)
+	}
+	if p.Memory < 8*uint32(p.Threads) || p.Memory > maxKDFMemory {
+		return fmt.Errorf("kdf memory cost %d KiB out of range [%d, %d]", p.Memory, 8*uint32(p.Threads), maxKDFMemory)
+	}
+	if p.Threads < 1 || p.Threads > maxKDFThreads {
+		return fmt.Errorf("kdf parallelism %d out of range [1, %d]", p.Threads, maxKDFThreads)
+	}
+	return nil
+}
+
+// ParseKDFParams parses parameters in the form produced by KDFParams.String
+func ParseKDFParams(s string) (KDFParams, error) {
+	var p KDFParams
+	seen := make(map[string]bool)
+	for _, field := range strings.Split(s, ",") {
+		name, value, ok := strings.Cut(field, "=")
+		if !ok || seen[name] {
+			return p, fmt.Errorf("malformed kdf parameters %q", s)
+		}
+		seen[name] = true
+
+		n, err := strconv.ParseUint(value, 10, 32)
+		if err != nil {
+			return p, fmt.Errorf("malformed kdf parameter %q: %w", field, err)
+		}
+		switch name {
+		case "t":
+			p.Time = uint32(n)
+		case "m":
+			p.Memory = uint32(n)
+		case "p":
+			if n > 255 {
+				return p, fmt.Errorf("kdf parallelism %d out of range", n)
+			}
+			p.Threads = uint8(n)
+		default:
+			return p, fmt.Errorf("unknown kdf parameter %q", name)
+		}
+	}
+	if len(seen) != 3 {
+		return p, fmt.Errorf("incomplete kdf parameters %q", s)
+	}
+	return p, p.Validate()
+}
+
+// storedKDFLimit is the highest cost accepted from stored data, see SetStoredKDFLimit
+var storedKDFLimit = storedLimit(DefaultKDFParams)
+
+// SetStoredKDFLimit caps the cost settings accepted from encrypted values and integrity trailers
+// near the configured settings. A file may come from someone else, and a single value with a crafted
+// cost could otherwise make decryption allocate gigabytes of memory or run for minutes.
+// configured: the cost settings used for new values
+func SetStoredKDFLimit(configured KDFParams) {
+	storedKDFLimit = storedLimit(configured)
+}
+
+// storedLimit allows storedKDFFactor times the configured time and memory cost and any parallelism
+func storedLimit(configured KDFParams) KDFParams {
+	return KDFParams{
+		Time:    min(configured.Time*storedKDFFactor, maxKDFTime),
+		Memory:  min(configured.Memory*storedKDFFactor, maxKDFMemory),
+		Threads: maxKDFThreads,
+	}
+}
+
+// parseStoredKDFParams parses cost settings read from stored data and checks them against storedKDFLimit
+func parseStoredKDFParams(s string) (KDFParams, error) {
+	params, err := ParseKDFParams(s)
+	if err != nil {
+		return params, err
+	}
+	limit := storedKDFLimit
+	if params.Time > limit.Time || params.Memory > limit.Memory {
+		return params, fmt.Errorf("%w: kdf cost %s exceeds the limit t=%d,m=%d of this build", ErrUnsupported, params, limit.Time, limit.Memory)
+	}
+	return params, nil
+}
+
+// kdfCache remembers derived keys within this process, so that values sharing a salt, such as
+// the values of a file encrypted by older versions, only pay for the expensive derivation once.
+// Entries are found by an HMAC of the passphrase under a random per-process secret,
+// so the cache holds nothing that would help to guess the passphrase faster than Argon2id.
+var kdfCache = struct {
+	sync.Mutex
+	secret []byte
+	keys   map[string][]byte
+}{keys: make(map[string][]byte)}
+
+// cacheID identifies a passphrase, parameter and salt combination without keeping the passphrase itself.
+// The caller must hold kdfCache's lock.
+func cacheID(key string, params KDFParams, salt []byte) string {
+	if kdfCache.secret == nil {
+		kdfCache.secret = make([]byte, 32)
+		if _, err := rand.Read(kdfCache.secret); err != nil {
+			panic(fmt.Sprintf("failed to generate kdf cache secret: %v", err))
+		}
+	}
+	h := hmac.New(sha256.New, kdfCache.secret)
+	h.Write([]byte(key))
+	h.Write([]byte{0})
+	h.Write([]byte(params.String()))
+	h.Write([]byte{0})
+	h.Write(salt)
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// ClearKDFCache overwrites and forgets all derived keys. Commands call it once they have
+// decrypted what they need, in particular before running another program for a long time.
+func ClearKDFCache() {
+	kdfCache.Lock()
+	defer kdfCache.Unlock()
+	for id, derived := range kdfCache.keys {
+		clear(derived)
+		delete(kdfCache.keys, id)
+	}
+	clear(kdfCache.secret)
+	kdfCache.secret = nil
+}
+
+// DeriveKey derives a 32-byte AES key from a passphrase with Argon2id
+// key: the passphrase
+// salt: random salt stored alongside the ciphertext
+// params: cost settings
+// Returns the derived key
+func DeriveKey(key string, salt []byte, params KDFParams) []byte {
+	kdfCache.Lock()
+	defer kdfCache.Unlock()
+	id := cacheID(key, params, salt)
+	if derived, ok := kdfCache.keys[id]; ok {
+		return derived
+	}
+	derived := argon2.IDKey([]byte(key), salt, params.Time, params.Memory, params.Threads, 32)
+	kdfCache.keys[id] = derived
+	return derived
+}
+
+// newSalt returns a fresh random salt, so that every value is encrypted with its own derived key
+func newSalt() ([]byte, error) {
+	salt := make([]byte, kdfSaltSize)
+	if _, err := rand.Read(salt); err != nil {
+		return nil, fmt.Errorf("failed to generate salt: %w", err)
+	}
+	return salt, nil
+}
+
+// EncryptAES256KDF encrypts data using AES-256-GCM with an Argon2id-derived key
+// plaintext: plain text data to encrypt
+// key: encryption passphrase
+// params: Argon2id cost settings
+// additionalData: authenticated context that must be presented again for decryption (may be nil)
+// Returns a self-describing string "argon2id:<params>:<salt>:<data>" or an error
+func EncryptAES256KDF(plaintext string, key string, params KDFParams, additionalData []byte) (string, error) {
+	if err := params.Validate(); err != nil {
+		return "", err
+	}
+	salt, err := newSalt()
+	if err != nil {
+		return "", err
+	}
+
+	ciphertext, err := sealGCM(DeriveKey(key, salt, params), []byte(plaintext), additionalData)
+	if err != nil {
+		return "", err
+	}
+
+	return strings.Join([]string{
+		KDFAlgorithm,
+		params.String(),
+		base64.StdEncoding.EncodeToString(salt),
+		base64.StdEncoding.EncodeToString(ciphertext),
+	}, ":"), nil
+}
+
+// DecryptAES256KDF decrypts data produced by EncryptAES256KDF
+// encryptedData: the self-describing string including algorithm, parameters and salt
+// key: decryption passphrase
+// additionalData: the context given at encryption; a mismatch fails authentication
+// Returns the decrypted string or an error
+func DecryptAES256KDF(encryptedData string, key string, additionalData []byte) (string, error) {
+	parts := strings.Split(encryptedData, ":")
+	if len(parts) != 4 {
+		return "", ErrMalformedData
+	}
+	if parts[0] != KDFAlgorithm {
+		return "", fmt.Errorf("%w: kdf %q", ErrUnsupported, parts[0])
+	}
+
+	params, err := parseStoredKDFParams(parts[1])
+	if errors.Is(err, ErrUnsupported) {
+		return "", err
+	}
+	if err != nil {
+		return "", fmt.Errorf("%w: %v", ErrMalformedData, err)
+	}
+	salt, err := base64.StdEncoding.DecodeString(parts[2])
+	if err != nil {
+		return "", fmt.Errorf("%w: salt: %v", ErrBadEncoding, err)
+	}
+	ciphertext, err := base64.StdEncoding.DecodeString(parts[3])
+	if err != nil {
+		return "", fmt.Errorf("%w: %v", ErrBadEncoding, err)
+	}
+
+	plaintext, err := openGCM(DeriveKey(key, salt, params), ciphertext, additionalData)
+	if err != nil {
+		return "", err
+	}
+	return string(plaintext), nil
+}
+
+// BenchmarkKDF suggests cost settings for the current machine
+// target: how long a single derivation should take
+// memory: memory size in KiB to use
+// threads: degree of parallelism
+// Returns the suggested parameters and the measured duration of one derivation with them
+func BenchmarkKDF(target time.Duration, memory uint32, threads uint8) (KDFParams, time.Duration) {
+	params := KDFParams{Time: 1, Memory: memory, Threads: threads}
+	salt := make([]byte, kdfSaltSize)
+	password := []byte("lhkeymanager-benchmark")
+
+	for {
+		start := time.Now()
+		argon2.IDKey(password, salt, params.Time, params.Memory, params.Threads, 32)
+		elapsed := time.Since(start)
+
+		if elapsed >= target || params.Time >= maxKDFTime {
+			return params, elapsed
+		}
+
+		// Estimate the number of passes needed from the time per pass, and always make progress
+		perPass := elapsed / time.Duration(params.Time)
+		next := params.Time + 1
+		if perPass > 0 {
+			if estimate := uint32(target / perPass); estimate > next {
+				next = estimate
+			}
+		}
+		if next > maxKDFTime {
+			next = maxKDFTime
+		}
+		params.Time = next
+	}
+}
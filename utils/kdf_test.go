@@ -0,0 +1,176 @@
+package utils
+
+import (
+	"bytes"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testKDFParams keeps the tests fast; production values come from DefaultKDFParams
+var testKDFParams = KDFParams{Time: 1, Memory: 1024, Threads: 1}
+
+func TestEncryptDecryptAES256KDF(t *testing.T) {
+	encrypted, err := EncryptAES256KDF("sk-1234567890abcdef", "test-key-12345u", testKDFParams, nil)
+	if err != nil {
+		t.Fatalf("EncryptAES256KDF failed: %v", err)
+	}
+
+	// The value must describe how it was produced
+	parts := strings.Split(encrypted, ":")
+	if len(parts) != 4 || parts[0] != KDFAlgorithm || parts[1] != testKDFParams.String() {
+		t.Fatalf("Unexpected encrypted layout: %s", encrypted)
+	}
+
+	decrypted, err := DecryptAES256KDF(encrypted, "test-key-12345u", nil)
+	if err != nil {
+		t.Fatalf("DecryptAES256KDF failed: %v", err)
+	}
+	if decrypted != "sk-1234567890abcdef" {
+		t.Errorf("Expected %q, got %q", "sk-1234567890abcdef", decrypted)
+	}
+
+	if _, err := DecryptAES256KDF(encrypted, "wrong-key-12345u", nil); err == nil {
+		t.Errorf("Expected error when decrypting with wrong key")
+	}
+}
+
+func TestDecryptAES256KDF_StoredParams(t *testing.T) {
+	// Values encrypted with different cost settings must decrypt with the settings they carry
+	stronger := KDFParams{Time: 2, Memory: 2048, Threads: 2}
+	for _, params := range []KDFParams{testKDFParams, stronger} {
+		encrypted, err := EncryptAES256KDF("value", "test-key-12345u", params, nil)
+		if err != nil {
+			t.Fatalf("EncryptAES256KDF failed: %v", err)
+		}
+		decrypted, err := DecryptAES256KDF(encrypted, "test-key-12345u", nil)
+		if err != nil {
+			t.Fatalf("DecryptAES256KDF with %s failed: %v", params, err)
+		}
+		if decrypted != "value" {
+			t.Errorf("Expected %q, got %q", "value", decrypted)
+		}
+	}
+}
+
+func TestDecryptAES256KDF_InvalidInput(t *testing.T) {
+	testCases := []struct {
+		name          string
+		encryptedData string
+	}{
+		{name: "Missing fields", encryptedData: "argon2id:t=1,m=1024,p=1"},
+		{name: "Unknown kdf", encryptedData: "pbkdf2:t=1,m=1024,p=1:AAAA:AAAA"},
+		{name: "Malformed params", encryptedData: "argon2id:t=1,m=1024:AAAA:AAAA"},
+		{name: "Excessive memory", encryptedData: "argon2id:t=1,m=4294967295,p=1:AAAA:AAAA"},
+		{name: "Invalid salt", encryptedData: "argon2id:t=1,m=1024,p=1:not-base64:AAAA"},
+		{name: "Data too short", encryptedData: "argon2id:t=1,m=1024,p=1:AAAA:AAEC"},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			if _, err := DecryptAES256KDF(tc.encryptedData, "test-key-12345u", nil); err == nil {
+				t.Errorf("Expected error for %q", tc.encryptedData)
+			}
+		})
+	}
+}
+
+func TestParseKDFParams(t *testing.T) {
+	params, err := ParseKDFParams("t=3,m=65536,p=4")
+	if err != nil {
+		t.Fatalf("ParseKDFParams failed: %v", err)
+	}
+	if params != (KDFParams{Time: 3, Memory: 65536, Threads: 4}) {
+		t.Errorf("Unexpected params: %+v", params)
+	}
+
+	for _, invalid := range []string{"", "t=3", "t=3,m=65536,p=4,x=1", "t=3,t=3,m=65536", "t=0,m=65536,p=4", "t=3,m=abc,p=4"} {
+		if _, err := ParseKDFParams(invalid); err == nil {
+			t.Errorf("Expected error for %q", invalid)
+		}
+	}
+}
+
+func TestBenchmarkKDF(t *testing.T) {
+	params, elapsed := BenchmarkKDF(5*time.Millisecond, 1024, 1)
+	if err := params.Validate(); err != nil {
+		t.Fatalf("BenchmarkKDF suggested invalid params: %v", err)
+	}
+	if elapsed < 5*time.Millisecond && params.Time < maxKDFTime {
+		t.Errorf("Expected suggestion to reach the target, got %s in %v", params, elapsed)
+	}
+}
+
+func TestDecryptAES256KDF_AdditionalData(t *testing.T) {
+	encrypted, err := EncryptAES256KDF("secret", "test-key-12345u", testKDFParams, []byte("PROD_DB_PASSWORD"))
+	if err != nil {
+		t.Fatalf("EncryptAES256KDF failed: %v", err)
+	}
+
+	if _, err := DecryptAES256KDF(encrypted, "test-key-12345u", []byte("PROD_DB_PASSWORD")); err != nil {
+		t.Errorf("Expected decryption with matching additional data to succeed: %v", err)
+	}
+	if _, err := DecryptAES256KDF(encrypted, "test-key-12345u", []byte("DEV_DB_PASSWORD")); err == nil {
+		t.Errorf("Expected error when decrypting with different additional data")
+	}
+	if _, err := DecryptAES256KDF(encrypted, "test-key-12345u", nil); err == nil {
+		t.Errorf("Expected error when decrypting without additional data")
+	}
+}
+
+func TestEncryptAES256KDF_FreshSalt(t *testing.T) {
+	first, err := EncryptAES256KDF("value", "test-key-12345u", testKDFParams, nil)
+	if err != nil {
+		t.Fatalf("EncryptAES256KDF failed: %v", err)
+	}
+	second, err := EncryptAES256KDF("value", "test-key-12345u", testKDFParams, nil)
+	if err != nil {
+		t.Fatalf("EncryptAES256KDF failed: %v", err)
+	}
+	if strings.Split(first, ":")[2] == strings.Split(second, ":")[2] {
+		t.Errorf("Expected every value to get its own salt")
+	}
+}
+
+func TestDecryptAES256KDF_StoredLimit(t *testing.T) {
+	defer SetStoredKDFLimit(DefaultKDFParams)
+	SetStoredKDFLimit(testKDFParams)
+
+	// Up to storedKDFFactor times the configured cost is accepted
+	within := KDFParams{Time: storedKDFFactor, Memory: testKDFParams.Memory * storedKDFFactor, Threads: 2}
+	encrypted, err := EncryptAES256KDF("value", "test-key-12345u", within, nil)
+	if err != nil {
+		t.Fatalf("EncryptAES256KDF failed: %v", err)
+	}
+	if _, err := DecryptAES256KDF(encrypted, "test-key-12345u", nil); err != nil {
+		t.Errorf("Expected cost within the limit to decrypt: %v", err)
+	}
+
+	// A crafted cost is refused before anything is derived
+	for _, params := range []string{"t=5,m=1024,p=1", "t=1,m=4194304,p=1"} {
+		_, err := DecryptAES256KDF("argon2id:"+params+":AAAA:AAAA", "test-key-12345u", nil)
+		if !errors.Is(err, ErrUnsupported) {
+			t.Errorf("%s: expected ErrUnsupported, got %v", params, err)
+		}
+	}
+}
+
+func TestClearKDFCache(t *testing.T) {
+	salt := []byte("0123456789abcdef")
+	derived := DeriveKey("test-key-12345u", salt, testKDFParams)
+	want := append([]byte(nil), derived...)
+
+	ClearKDFCache()
+	if !bytes.Equal(derived, make([]byte, len(derived))) {
+		t.Errorf("Expected the cached key to be overwritten")
+	}
+	if len(kdfCache.keys) != 0 || kdfCache.secret != nil {
+		t.Errorf("Expected the cache to be empty")
+	}
+
+	// Keys are derived again afterwards
+	if again := DeriveKey("test-key-12345u", salt, testKDFParams); !bytes.Equal(again, want) {
+		t.Errorf("Expected the same key after clearing the cache")
+	}
+}
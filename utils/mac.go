@@ -0,0 +1,102 @@
+package utils
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// macVersion identifies the layout of the integrity trailer and the signed message
+const macVersion = "v1"
+
+// ErrMACMismatch is returned when the integrity trailer doesn't match the file content
+var ErrMACMismatch = errors.New("file integrity check failed")
+
+// macKey derives the HMAC key from the passphrase-derived key, so the MAC never
+// uses the same key bytes as the value encryption
+func macKey(key string, salt []byte, params KDFParams) []byte {
+	h := hmac.New(sha256.New, DeriveKey(key, salt, params))
+	h.Write([]byte("lhkeymanager file mac"))
+	return h.Sum(nil)
+}
+
+// macMessage serializes the names, values and order of all entries unambiguously
+func macMessage(entries []EnvEntry) []byte {
+	var b []byte
+	b = append(b, "lhkm-mac-"+macVersion...)
+	for _, entry := range entries {
+		b = binary.BigEndian.AppendUint32(b, uint32(len(entry.Name)))
+		b = append(b, entry.Name...)
+		b = binary.BigEndian.AppendUint32(b, uint32(len(entry.Value)))
+		b = append(b, entry.Value...)
+	}
+	return b
+}
+
+// SignEnvEntries computes the integrity trailer payload for the entries of a .env file
+// entries: all entries of the file in file order, with their raw (encrypted) values
+// key: the encryption passphrase
+// params: Argon2id cost settings
+// Returns "v1:argon2id:<params>:<salt>:<mac>" or an error
+func SignEnvEntries(entries []EnvEntry, key string, params KDFParams) (string, error) {
+	if err := params.Validate(); err != nil {
+		return "", err
+	}
+	salt, err := newSalt()
+	if err != nil {
+		return "", err
+	}
+
+	h := hmac.New(sha256.New, macKey(key, salt, params))
+	h.Write(macMessage(entries))
+
+	return strings.Join([]string{
+		macVersion,
+		KDFAlgorithm,
+		params.String(),
+		base64.StdEncoding.EncodeToString(salt),
+		base64.StdEncoding.EncodeToString(h.Sum(nil)),
+	}, ":"), nil
+}
+
+// VerifyEnvEntries checks the entries of a .env file against its integrity trailer
+// entries: all entries of the file in file order, with their raw (encrypted) values
+// key: the encryption passphrase
+// mac: the trailer payload produced by SignEnvEntries
+// Returns ErrMACMismatch if the entries were changed, or another error if the trailer is malformed
+func VerifyEnvEntries(entries []EnvEntry, key string, mac string) error {
+	parts := strings.Split(mac, ":")
+	if len(parts) != 5 {
+		return fmt.Errorf("malformed integrity trailer")
+	}
+	if parts[0] != macVersion {
+		return fmt.Errorf("unsupported integrity trailer version %q", parts[0])
+	}
+	if parts[1] != KDFAlgorithm {
+		return fmt.Errorf("unsupported kdf %q", parts[1])
+	}
+
+	params, err := parseStoredKDFParams(parts[2])
+	if err != nil {
+		return err
+	}
+	salt, err := base64.StdEncoding.DecodeString(parts[3])
+	if err != nil {
+		return fmt.Errorf("base64 decoding of salt failed: %w", err)
+	}
+	expected, err := base64.StdEncoding.DecodeString(parts[4])
+	if err != nil {
+		return fmt.Errorf("base64 decoding of mac failed: %w", err)
+	}
+
+	h := hmac.New(sha256.New, macKey(key, salt, params))
+	h.Write(macMessage(entries))
+	if !hmac.Equal(h.Sum(nil), expected) {
+		return ErrMACMismatch
+	}
+	return nil
+}
@@ -0,0 +1,54 @@
+package utils
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestSignVerifyEnvEntries(t *testing.T) {
+	key := "test-key-12345u"
+	entries := []EnvEntry{
+		{Name: "API_KEY", Value: "enc:AES256v4:abc"},
+		{Name: "PLAIN", Value: "value"},
+	}
+
+	mac, err := SignEnvEntries(entries, key, testKDFParams)
+	if err != nil {
+		t.Fatalf("SignEnvEntries failed: %v", err)
+	}
+	if err := VerifyEnvEntries(entries, key, mac); err != nil {
+		t.Fatalf("VerifyEnvEntries failed: %v", err)
+	}
+
+	// Line numbers are not covered, only names, values and order
+	moved := []EnvEntry{{Name: "API_KEY", Value: "enc:AES256v4:abc", Line: 7}, {Name: "PLAIN", Value: "value", Line: 9}}
+	if err := VerifyEnvEntries(moved, key, mac); err != nil {
+		t.Errorf("Expected blank line changes to keep the mac valid: %v", err)
+	}
+
+	testCases := []struct {
+		name    string
+		entries []EnvEntry
+		key     string
+	}{
+		{name: "Deleted entry", entries: entries[:1], key: key},
+		{name: "Reordered entries", entries: []EnvEntry{entries[1], entries[0]}, key: key},
+		{name: "Injected entry", entries: append(append([]EnvEntry{}, entries...), EnvEntry{Name: "LD_PRELOAD", Value: "/tmp/x.so"}), key: key},
+		{name: "Changed value", entries: []EnvEntry{entries[0], {Name: "PLAIN", Value: "other"}}, key: key},
+		{name: "Shifted boundary", entries: []EnvEntry{{Name: "API_KEYe", Value: "nc:AES256v4:abc"}, entries[1]}, key: key},
+		{name: "Wrong key", entries: entries, key: "wrong-key-12345u"},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			err := VerifyEnvEntries(tc.entries, tc.key, mac)
+			if !errors.Is(err, ErrMACMismatch) {
+				t.Errorf("Expected ErrMACMismatch, got %v", err)
+			}
+		})
+	}
+
+	if err := VerifyEnvEntries(entries, key, "v9:argon2id:t=1,m=1024,p=1:AAAA:AAAA"); err == nil || errors.Is(err, ErrMACMismatch) {
+		t.Errorf("Expected malformed trailer error, got %v", err)
+	}
+}
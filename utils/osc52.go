@@ -0,0 +1,19 @@
+package utils
+
+import (
+	"encoding/base64"
+	"strings"
+)
+
+// OSC52 returns the escape sequence that asks the terminal to put text on the system clipboard.
+// Terminals that support it (xterm, kitty, WezTerm, iTerm2, Windows Terminal, ...) also accept it
+// over SSH, since it travels with the terminal output. An empty text clears the clipboard.
+// tmux: wrap the sequence so that tmux passes it to the outer terminal
+func OSC52(text string, tmux bool) string {
+	seq := "\x1b]52;c;" + base64.StdEncoding.EncodeToString([]byte(text)) + "\a"
+	if !tmux {
+		return seq
+	}
+	// tmux forwards DCS passthrough sequences, with every ESC inside doubled
+	return "\x1bPtmux;" + strings.ReplaceAll(seq, "\x1b", "\x1b\x1b") + "\x1b\\"
+}
@@ -0,0 +1,34 @@
+package utils
+
+import (
+	"encoding/base64"
+	"strings"
+	"testing"
+)
+
+func TestOSC52(t *testing.T) {
+	secret := "sk-abc\n$(id)"
+	seq := OSC52(secret, false)
+	if !strings.HasPrefix(seq, "\x1b]52;c;") || !strings.HasSuffix(seq, "\a") {
+		t.Fatalf("Unexpected sequence %q", seq)
+	}
+	payload := strings.TrimSuffix(strings.TrimPrefix(seq, "\x1b]52;c;"), "\a")
+	decoded, err := base64.StdEncoding.DecodeString(payload)
+	if err != nil || string(decoded) != secret {
+		t.Errorf("Expected the base64 encoded text, got %q (%v)", payload, err)
+	}
+
+	// The text never appears in the clear, so control characters can't end the sequence early
+	if strings.ContainsAny(payload, "\x1b\a\n") {
+		t.Errorf("Payload contains control characters: %q", payload)
+	}
+
+	if seq := OSC52("", false); seq != "\x1b]52;c;\a" {
+		t.Errorf("Expected an empty payload to clear the clipboard, got %q", seq)
+	}
+
+	wrapped := OSC52(secret, true)
+	if !strings.HasPrefix(wrapped, "\x1bPtmux;\x1b\x1b]52;c;") || !strings.HasSuffix(wrapped, "\x1b\\") {
+		t.Errorf("Unexpected tmux sequence %q", wrapped)
+	}
+}
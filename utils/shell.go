@@ -0,0 +1,81 @@
+package utils
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// ErrNULInValue is returned for values containing a NUL byte, which no shell or
+// process environment can represent
+var ErrNULInValue = errors.New("value contains a NUL byte")
+
+// IsValidShellName reports whether name can be used as a shell variable name.
+// This is stricter than IsValidEnvName: '.' and '-' are not allowed.
+func IsValidShellName(name string) bool {
+	if name == "" || !isEnvNameStart(name[0]) {
+		return false
+	}
+	for i := 1; i < len(name); i++ {
+		if c := name[i]; !isEnvNameStart(c) && (c < '0' || c > '9') {
+			return false
+		}
+	}
+	return true
+}
+
+// QuotePOSIX quotes a value for POSIX sh, bash and zsh
+// value: the value to quote
+// The value is wrapped in single quotes, inside which nothing is special; embedded
+// single quotes are written as '\''. Newlines are kept literally.
+// Returns the quoted value, or ErrNULInValue
+func QuotePOSIX(value string) (string, error) {
+	if strings.IndexByte(value, 0) >= 0 {
+		return "", ErrNULInValue
+	}
+	return "'" + strings.ReplaceAll(value, "'", `'\''`) + "'", nil
+}
+
+// QuoteFish quotes a value for the fish shell
+// value: the value to quote
+// Fish single quotes treat \\ and \' as escapes, so both are escaped.
+// Returns the quoted value, or ErrNULInValue
+func QuoteFish(value string) (string, error) {
+	if strings.IndexByte(value, 0) >= 0 {
+		return "", ErrNULInValue
+	}
+	value = strings.ReplaceAll(value, `\`, `\\`)
+	value = strings.ReplaceAll(value, `'`, `\'`)
+	return "'" + value + "'", nil
+}
+
+// checkShellVar validates a variable for use in a shell statement
+func checkShellVar(name, value string) error {
+	if !IsValidShellName(name) {
+		return fmt.Errorf("invalid shell variable name %q", name)
+	}
+	if strings.IndexByte(value, 0) >= 0 {
+		return fmt.Errorf("%s: %w", name, ErrNULInValue)
+	}
+	return nil
+}
+
+// ExportPOSIX returns an "export NAME='value'" statement for sh, bash and zsh
+// Returns an error if the name is not a valid shell variable name or the value contains NUL
+func ExportPOSIX(name, value string) (string, error) {
+	if err := checkShellVar(name, value); err != nil {
+		return "", err
+	}
+	quoted, _ := QuotePOSIX(value)
+	return "export " + name + "=" + quoted, nil
+}
+
+// ExportFish returns a "set -gx NAME 'value'" statement for fish
+// Returns an error if the name is not a valid shell variable name or the value contains NUL
+func ExportFish(name, value string) (string, error) {
+	if err := checkShellVar(name, value); err != nil {
+		return "", err
+	}
+	quoted, _ := QuoteFish(value)
+	return "set -gx " + name + " " + quoted, nil
+}
@@ -0,0 +1,140 @@
+package utils
+
+import (
+	"errors"
+	"os/exec"
+	"testing"
+)
+
+// hostileValues are values that break naive quoting
+var hostileValues = []string{
+	"",
+	"plain",
+	"it's",
+	"''",
+	`"double"`,
+	`back\slash\`,
+	`\'`,
+	"line1\nline2\n",
+	"$(touch /tmp/pwned)",
+	"`id`",
+	"${HOME} $HOME",
+	"; rm -rf / #",
+	"tab\tand\rreturn",
+	"'; echo injected; '",
+	"emoji 🔑 and ünïcode",
+}
+
+func TestIsValidShellName(t *testing.T) {
+	valid := []string{"A", "_", "API_KEY", "key2", "_x9"}
+	invalid := []string{"", "1A", "A-B", "A.B", "A B", "A=B", "$(id)", "A;B", "ü"}
+
+	for _, name := range valid {
+		if !IsValidShellName(name) {
+			t.Errorf("Expected %q to be valid", name)
+		}
+	}
+	for _, name := range invalid {
+		if IsValidShellName(name) {
+			t.Errorf("Expected %q to be invalid", name)
+		}
+	}
+}
+
+func TestQuotePOSIX(t *testing.T) {
+	testCases := []struct {
+		value    string
+		expected string
+	}{
+		{value: "", expected: "''"},
+		{value: "plain", expected: "'plain'"},
+		{value: "it's", expected: `'it'\''s'`},
+		{value: "$(id)", expected: "'$(id)'"},
+		{value: "a\nb", expected: "'a\nb'"},
+	}
+	for _, tc := range testCases {
+		quoted, err := QuotePOSIX(tc.value)
+		if err != nil || quoted != tc.expected {
+			t.Errorf("QuotePOSIX(%q): expected %q, got %q (%v)", tc.value, tc.expected, quoted, err)
+		}
+	}
+}
+
+func TestQuoteFish(t *testing.T) {
+	testCases := []struct {
+		value    string
+		expected string
+	}{
+		{value: "", expected: "''"},
+		{value: "it's", expected: `'it\'s'`},
+		{value: `a\b`, expected: `'a\\b'`},
+		{value: "$(id)", expected: "'$(id)'"},
+	}
+	for _, tc := range testCases {
+		quoted, err := QuoteFish(tc.value)
+		if err != nil || quoted != tc.expected {
+			t.Errorf("QuoteFish(%q): expected %q, got %q (%v)", tc.value, tc.expected, quoted, err)
+		}
+	}
+}
+
+func TestQuote_RejectsNUL(t *testing.T) {
+	if _, err := QuotePOSIX("a\x00b"); !errors.Is(err, ErrNULInValue) {
+		t.Errorf("QuotePOSIX: expected ErrNULInValue, got %v", err)
+	}
+	if _, err := QuoteFish("a\x00b"); !errors.Is(err, ErrNULInValue) {
+		t.Errorf("QuoteFish: expected ErrNULInValue, got %v", err)
+	}
+	if _, err := ExportPOSIX("A", "\x00"); !errors.Is(err, ErrNULInValue) {
+		t.Errorf("ExportPOSIX: expected ErrNULInValue, got %v", err)
+	}
+}
+
+func TestExport_RejectsInvalidNames(t *testing.T) {
+	for _, name := range []string{"", "A-B", "A;id", "$(id)"} {
+		if _, err := ExportPOSIX(name, "v"); err == nil {
+			t.Errorf("ExportPOSIX: expected error for name %q", name)
+		}
+		if _, err := ExportFish(name, "v"); err == nil {
+			t.Errorf("ExportFish: expected error for name %q", name)
+		}
+	}
+}
+
+// TestExport_RoundTrip evaluates the generated statements in real shells and checks
+// that the variable holds exactly the original value
+func TestExport_RoundTrip(t *testing.T) {
+	shells := []struct {
+		shell  string
+		export func(name, value string) (string, error)
+		print  string
+	}{
+		{shell: "sh", export: ExportPOSIX, print: `; printf %s "$SECRET"`},
+		{shell: "bash", export: ExportPOSIX, print: `; printf %s "$SECRET"`},
+		{shell: "zsh", export: ExportPOSIX, print: `; printf %s "$SECRET"`},
+		{shell: "fish", export: ExportFish, print: `; printf %s "$SECRET"`},
+	}
+
+	for _, sh := range shells {
+		t.Run(sh.shell, func(t *testing.T) {
+			path, err := exec.LookPath(sh.shell)
+			if err != nil {
+				t.Skipf("%s not installed", sh.shell)
+			}
+			for _, value := range hostileValues {
+				statement, err := sh.export("SECRET", value)
+				if err != nil {
+					t.Fatalf("export %q failed: %v", value, err)
+				}
+				out, err := exec.Command(path, "-c", statement+sh.print).Output()
+				if err != nil {
+					t.Errorf("%s failed for %q: %v", sh.shell, value, err)
+					continue
+				}
+				if string(out) != value {
+					t.Errorf("%s: expected %q, got %q", sh.shell, value, out)
+				}
+			}
+		})
+	}
+}